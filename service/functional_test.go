@@ -4,9 +4,15 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"math/rand"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 
@@ -17,20 +23,20 @@ import (
 func populateTestData(db *gorm.DB) (err error) {
 
 	accounts := []Account{
-		Account{Owner: "alice", Balance: 100.0, Currency: "USD"},
-		Account{Owner: "bob", Balance: 10.0, Currency: "USD"},
-		Account{Owner: "alice", Balance: 70.0, Currency: "PHP"},
-		Account{Owner: "tmp", Balance: 1.0, Currency: "EUR"},
-		Account{Owner: "tmp", Balance: 1.0, Currency: "EUR"},
-		Account{Owner: "tmp", Balance: 1.0, Currency: "EUR"},
-		Account{Owner: "tmp", Balance: 1.0, Currency: "EUR"},
-		Account{Owner: "tmp", Balance: 1.0, Currency: "EUR"},
-		Account{Owner: "tmp", Balance: 1.0, Currency: "EUR"},
-		Account{Owner: "tmp", Balance: 1.0, Currency: "EUR"},
-		Account{Owner: "tmp", Balance: 1.0, Currency: "EUR"},
-		Account{Owner: "tmp", Balance: 1.0, Currency: "EUR"},
-		Account{Owner: "tmp", Balance: 1.0, Currency: "EUR"},
-		Account{Owner: "tmp", Balance: 1.0, Currency: "EUR"},
+		Account{Owner: "alice", Balance: 10000, Currency: "USD"},
+		Account{Owner: "bob", Balance: 1000, Currency: "USD"},
+		Account{Owner: "alice", Balance: 7000, Currency: "PHP"},
+		Account{Owner: "tmp", Balance: 100, Currency: "EUR"},
+		Account{Owner: "tmp", Balance: 100, Currency: "EUR"},
+		Account{Owner: "tmp", Balance: 100, Currency: "EUR"},
+		Account{Owner: "tmp", Balance: 100, Currency: "EUR"},
+		Account{Owner: "tmp", Balance: 100, Currency: "EUR"},
+		Account{Owner: "tmp", Balance: 100, Currency: "EUR"},
+		Account{Owner: "tmp", Balance: 100, Currency: "EUR"},
+		Account{Owner: "tmp", Balance: 100, Currency: "EUR"},
+		Account{Owner: "tmp", Balance: 100, Currency: "EUR"},
+		Account{Owner: "tmp", Balance: 100, Currency: "EUR"},
+		Account{Owner: "tmp", Balance: 100, Currency: "EUR"},
 	}
 	for _, acc := range accounts {
 		if err = db.Create(&acc).Error; err != nil {
@@ -39,20 +45,20 @@ func populateTestData(db *gorm.DB) (err error) {
 	}
 
 	payments := []Payment{
-		Payment{AccountID: 1, Amount: 1.0, Direction: "outgoing", AccountToID: 2},
-		Payment{AccountID: 2, Amount: 1.0, Direction: "incoming", AccountFromID: 1},
-		Payment{AccountID: 1, Amount: 1.0, Direction: "outgoing", AccountToID: 2},
-		Payment{AccountID: 2, Amount: 1.0, Direction: "incoming", AccountFromID: 1},
-		Payment{AccountID: 1, Amount: 1.0, Direction: "outgoing", AccountToID: 2},
-		Payment{AccountID: 2, Amount: 1.0, Direction: "incoming", AccountFromID: 1},
-		Payment{AccountID: 1, Amount: 1.0, Direction: "outgoing", AccountToID: 2},
-		Payment{AccountID: 2, Amount: 1.0, Direction: "incoming", AccountFromID: 1},
-		Payment{AccountID: 1, Amount: 1.0, Direction: "outgoing", AccountToID: 2},
-		Payment{AccountID: 2, Amount: 1.0, Direction: "incoming", AccountFromID: 1},
-		Payment{AccountID: 1, Amount: 1.0, Direction: "outgoing", AccountToID: 2},
-		Payment{AccountID: 2, Amount: 1.0, Direction: "incoming", AccountFromID: 1},
-		Payment{AccountID: 1, Amount: 1.0, Direction: "outgoing", AccountToID: 2},
-		Payment{AccountID: 2, Amount: 1.0, Direction: "incoming", AccountFromID: 1},
+		Payment{AccountID: 1, Amount: 100, Currency: "USD", Direction: "outgoing", AccountToID: 2},
+		Payment{AccountID: 2, Amount: 100, Currency: "USD", Direction: "incoming", AccountFromID: 1},
+		Payment{AccountID: 1, Amount: 100, Currency: "USD", Direction: "outgoing", AccountToID: 2},
+		Payment{AccountID: 2, Amount: 100, Currency: "USD", Direction: "incoming", AccountFromID: 1},
+		Payment{AccountID: 1, Amount: 100, Currency: "USD", Direction: "outgoing", AccountToID: 2},
+		Payment{AccountID: 2, Amount: 100, Currency: "USD", Direction: "incoming", AccountFromID: 1},
+		Payment{AccountID: 1, Amount: 100, Currency: "USD", Direction: "outgoing", AccountToID: 2},
+		Payment{AccountID: 2, Amount: 100, Currency: "USD", Direction: "incoming", AccountFromID: 1},
+		Payment{AccountID: 1, Amount: 100, Currency: "USD", Direction: "outgoing", AccountToID: 2},
+		Payment{AccountID: 2, Amount: 100, Currency: "USD", Direction: "incoming", AccountFromID: 1},
+		Payment{AccountID: 1, Amount: 100, Currency: "USD", Direction: "outgoing", AccountToID: 2},
+		Payment{AccountID: 2, Amount: 100, Currency: "USD", Direction: "incoming", AccountFromID: 1},
+		Payment{AccountID: 1, Amount: 100, Currency: "USD", Direction: "outgoing", AccountToID: 2},
+		Payment{AccountID: 2, Amount: 100, Currency: "USD", Direction: "incoming", AccountFromID: 1},
 	}
 	for _, payment := range payments {
 		if err = db.Create(&payment).Error; err != nil {
@@ -68,7 +74,7 @@ func functionalSetUp() (db *gorm.DB, engine *gin.Engine, err error) {
 	if db, err = setupDatabase("sqlite3", "test.db"); err != nil {
 		return
 	}
-	engine = setupRouter(db)
+	engine = setupRouter(db, defaultOptions())
 	if err = populateTestData(db); err != nil {
 		return
 	}
@@ -78,6 +84,22 @@ func functionalSetUp() (db *gorm.DB, engine *gin.Engine, err error) {
 func functionalTearDown(db *gorm.DB, engine *gin.Engine) {
 	db.DropTableIfExists(&Account{})
 	db.DropTableIfExists(&Payment{})
+	db.DropTableIfExists(&Transfer{})
+	db.DropTableIfExists(&StatusTransition{})
+	db.DropTableIfExists(&IdempotencyKey{})
+	db.DropTableIfExists(&ExchangeRate{})
+	db.DropTableIfExists(&Quote{})
+	db.DropTableIfExists(&FeeSchedule{})
+	db.DropTableIfExists(&Hold{})
+	db.DropTableIfExists(&Limit{})
+	db.DropTableIfExists(&Screening{})
+	db.DropTableIfExists(&Review{})
+	db.DropTableIfExists(&Approval{})
+	db.DropTableIfExists(&ScheduledPayment{})
+	db.DropTableIfExists(&Mandate{})
+	db.DropTableIfExists(&PaymentBatch{})
+	db.DropTableIfExists(&BatchItem{})
+	db.DropTableIfExists(&SchemaMigration{})
 	db.Close()
 }
 
@@ -105,7 +127,7 @@ func TestRealListAllAccounts(t *testing.T) {
 	}
 
 	item := respBody[1]
-	if item.Balance != 10.0 || item.Currency != "USD" {
+	if item.Balance != 1000 || item.Currency != "USD" {
 		t.Errorf("Wrong response, got %s", w.Body)
 	}
 }
@@ -133,7 +155,7 @@ func TestRealGetAllPayments(t *testing.T) {
 		t.Errorf("Expected %d items, got %d", itemsPerPage, len(respBody))
 	}
 	payment := respBody[0]
-	if payment.AccountID != 1 || payment.Amount != 1.0 || payment.AccountToID != 2 || payment.AccountFromID != 0 {
+	if payment.AccountID != 1 || payment.Amount != 100 || payment.AccountToID != 2 || payment.AccountFromID != 0 {
 		t.Errorf("Wrong response, got %s", w.Body)
 	}
 }
@@ -180,8 +202,8 @@ func TestRealSubmitSuccess(t *testing.T) {
 
 	engine.ServeHTTP(w, req)
 
-	if w.Code != http.StatusOK {
-		t.Errorf("Response code should be %d, was: %d (%s)", http.StatusOK, w.Code, w.Body)
+	if w.Code != http.StatusCreated {
+		t.Errorf("Response code should be %d, was: %d (%s)", http.StatusCreated, w.Code, w.Body)
 	}
 
 	var afterCount int
@@ -196,10 +218,10 @@ func TestRealSubmitSuccess(t *testing.T) {
 
 	testCases := []struct {
 		id     uint
-		amount float64
+		amount Amount
 	}{
-		{id: 1, amount: 50.0},
-		{id: 2, amount: 60.0},
+		{id: 1, amount: 5000},
+		{id: 2, amount: 6000},
 	}
 	for _, testCase := range testCases {
 		req, _ := http.NewRequest("GET", fmt.Sprintf("/v1/accounts?id=%d", testCase.id), nil)
@@ -229,12 +251,15 @@ func TestRealSubmitError(t *testing.T) {
 	defer functionalTearDown(db, engine)
 
 	testCases := []string{
-		`{"from_account":1, "amount":500.0, "to_account":2}`, // Not enough balance
-		`{"from_account":1, "amount":5.0, "to_account":1}`,   // Same destination
-		`{"to_account":1, "amount":5.0, "from_account":100}`, // Wrong account
-		`{"to_account":100, "amount":5.0, "from_account":1}`, // Wrong account
-		`{"from_account":1, "amount":5.0, "to_account":3}`,   // Different currencies
-		`{"to_account":1, "amount":5.0, "from_account":3}`,   // Different currencies
+		`{"from_account":1, "amount":500.0, "to_account":2}`,  // Not enough balance
+		`{"from_account":1, "amount":5.0, "to_account":1}`,    // Same destination
+		`{"to_account":1, "amount":5.0, "from_account":100}`,  // Wrong account
+		`{"to_account":100, "amount":5.0, "from_account":1}`,  // Wrong account
+		`{"from_account":1, "amount":5.0, "to_account":3}`,    // Different currencies
+		`{"to_account":1, "amount":5.0, "from_account":3}`,    // Different currencies
+		`{"from_account":1, "amount":0.001, "to_account":2}`,  // Less than a cent
+		`{"from_account":1, "amount":"0.00", "to_account":2}`, // Zero
+		`{"from_account":1, "amount":1e2, "to_account":2}`,    // Exponent notation
 	}
 
 	for _, testCase := range testCases {
@@ -247,3 +272,2552 @@ func TestRealSubmitError(t *testing.T) {
 		}
 	}
 }
+
+func TestRealCreateAccount(t *testing.T) {
+	db, engine, err := functionalSetUp()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer functionalTearDown(db, engine)
+
+	req, _ := http.NewRequest("POST", "/v1/accounts", bytes.NewBufferString(`{"owner":"carol", "currency":"usd", "balance":"25.05"}`))
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, req)
+
+	if w.Code != http.StatusCreated {
+		t.Errorf("Response code should be %d, was: %d (%s)", http.StatusCreated, w.Code, w.Body)
+	}
+	var respBody Account
+	if err := json.Unmarshal(w.Body.Bytes(), &respBody); err != nil {
+		t.Error(err)
+	}
+	if respBody.ID == 0 || respBody.Owner != "carol" || respBody.Currency != "USD" || respBody.Balance != 2505 {
+		t.Errorf("Wrong response, got %s", w.Body)
+	}
+
+	testCases := []string{
+		`{"currency":"USD"}`,                                // No owner
+		`{"owner":" ", "currency":"USD"}`,                   // Empty owner
+		`{"owner":"carol"}`,                                 // No currency
+		`{"owner":"carol", "currency":"DOLLAR"}`,            // Wrong currency
+		`{"owner":"carol", "currency":"USD", "balance":-1}`, // Negative balance
+	}
+	for _, testCase := range testCases {
+		req, _ := http.NewRequest("POST", "/v1/accounts", bytes.NewBufferString(testCase))
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, req)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Response code for %s should be %d, was: %d (%s)", testCase, http.StatusBadRequest, w.Code, w.Body)
+		}
+	}
+}
+
+func TestRealUpdateAccount(t *testing.T) {
+	db, engine, err := functionalSetUp()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer functionalTearDown(db, engine)
+
+	testCases := []struct {
+		id      uint
+		payload string
+		code    int
+	}{
+		{id: 2, payload: `{"owner":"robert"}`, code: http.StatusOK},
+		{id: 2, payload: `{"owner":"robert", "currency":"EUR"}`, code: http.StatusBadRequest},
+		{id: 2, payload: `{"owner":"robert", "balance":100}`, code: http.StatusBadRequest},
+		{id: 100, payload: `{"owner":"robert"}`, code: http.StatusBadRequest},
+	}
+	for _, testCase := range testCases {
+		req, _ := http.NewRequest("PATCH", fmt.Sprintf("/v1/accounts/%d", testCase.id), bytes.NewBufferString(testCase.payload))
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, req)
+
+		if w.Code != testCase.code {
+			t.Errorf("Response code for %s should be %d, was: %d (%s)", testCase.payload, testCase.code, w.Code, w.Body)
+		}
+	}
+
+	var account Account
+	if err := db.First(&account, 2).Error; err != nil {
+		t.Fatal(err.Error())
+	}
+	if account.Owner != "robert" || account.Balance != 1000 || account.Currency != "USD" {
+		t.Errorf("Wrong account after update: %+v", account)
+	}
+}
+
+func TestRealCloseAccount(t *testing.T) {
+	db, engine, err := functionalSetUp()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer functionalTearDown(db, engine)
+
+	// Empty account 4 first, so it can be closed
+	req, _ := http.NewRequest("POST", "/v1/payments", bytes.NewBufferString(`{"from_account":4, "amount":1.0, "to_account":5}`))
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Response code should be %d, was: %d (%s)", http.StatusCreated, w.Code, w.Body)
+	}
+
+	testCases := []struct {
+		id   uint
+		code int
+	}{
+		{id: 5, code: http.StatusBadRequest},   // Non-zero balance
+		{id: 4, code: http.StatusOK},           // Zero balance
+		{id: 4, code: http.StatusBadRequest},   // Already closed
+		{id: 100, code: http.StatusBadRequest}, // No such account
+	}
+	for _, testCase := range testCases {
+		req, _ := http.NewRequest("DELETE", fmt.Sprintf("/v1/accounts/%d", testCase.id), nil)
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, req)
+
+		if w.Code != testCase.code {
+			t.Errorf("Response code for account %d should be %d, was: %d (%s)", testCase.id, testCase.code, w.Code, w.Body)
+		}
+	}
+
+	// Closed account can't receive payments anymore
+	req, _ = http.NewRequest("POST", "/v1/payments", bytes.NewBufferString(`{"from_account":5, "amount":1.0, "to_account":4}`))
+	w = httptest.NewRecorder()
+	engine.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Response code should be %d, was: %d (%s)", http.StatusBadRequest, w.Code, w.Body)
+	}
+}
+
+func TestRealSubmitIdempotent(t *testing.T) {
+	db, engine, err := functionalSetUp()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer functionalTearDown(db, engine)
+
+	var dummy []Payment
+	var beforeCount int
+	if err := db.Find(&dummy).Count(&beforeCount).Error; err != nil {
+		t.Error(err.Error())
+	}
+
+	testCases := []struct {
+		key     string
+		user    string
+		payload string
+		code    int
+	}{
+		{key: "first", payload: `{"from_account":1, "amount":50.0, "to_account":2}`, code: http.StatusCreated},
+		{key: "first", payload: `{"to_account":2, "amount":50.0, "from_account":1}`, code: http.StatusCreated},             // Replay
+		{key: "first", payload: `{"from_account":1, "amount":40.0, "to_account":2}`, code: http.StatusUnprocessableEntity}, // Different body
+		{key: "first", user: "carol", payload: `{"from_account":1, "amount":40.0, "to_account":2}`, code: http.StatusCreated},
+		{key: "second", payload: `{"from_account":1, "amount":500.0, "to_account":2}`, code: http.StatusBadRequest}, // Not enough balance
+		{key: "second", payload: `{"from_account":1, "amount":500.0, "to_account":2}`, code: http.StatusBadRequest}, // Failure is replayed
+		{key: "second", payload: `{"from_account":1, "amount":5.0, "to_account":2}`, code: http.StatusUnprocessableEntity},
+	}
+	var failures []string
+	for _, testCase := range testCases {
+		req, _ := http.NewRequest("POST", "/v1/payments", bytes.NewBufferString(testCase.payload))
+		req.Header.Set(idempotencyHeader, testCase.key)
+		if testCase.user != "" {
+			req.Header.Set(apiUserHeader, testCase.user)
+		}
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, req)
+
+		if w.Code != testCase.code {
+			t.Errorf("Response code for %s should be %d, was: %d (%s)", testCase.payload, testCase.code, w.Code, w.Body)
+		}
+		if w.Code == http.StatusBadRequest {
+			failures = append(failures, w.Body.String())
+		}
+	}
+	if len(failures) != 2 || failures[0] != failures[1] {
+		t.Errorf("Failure should be replayed, got %v", failures)
+	}
+
+	var afterCount int
+	if err := db.Find(&dummy).Count(&afterCount).Error; err != nil {
+		t.Error(err.Error())
+	}
+	// Three transfers (one failed), each one is incoming and outgoing payment
+	if afterCount-beforeCount != 6 {
+		t.Errorf("Wrong payments count, %d new payments", afterCount-beforeCount)
+	}
+	var postedCount int
+	if err := db.Model(&Payment{}).Where("status = ?", statusPosted).Count(&postedCount).Error; err != nil {
+		t.Error(err.Error())
+	}
+	if postedCount != 4 {
+		t.Errorf("Wrong posted payments count %d", postedCount)
+	}
+
+	var account Account
+	if err := db.First(&account, 1).Error; err != nil {
+		t.Fatal(err.Error())
+	}
+	if account.Balance != 1000 {
+		t.Errorf("Wrong balance %d after retries", account.Balance)
+	}
+}
+
+func TestRealSubmitExactAmounts(t *testing.T) {
+	db, engine, err := functionalSetUp()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer functionalTearDown(db, engine)
+
+	// 0.1 is not representable as float64, ten of them should still add up
+	for i := 0; i < 10; i++ {
+		req, _ := http.NewRequest("POST", "/v1/payments", bytes.NewBufferString(`{"from_account":1, "amount":"0.1", "to_account":2}`))
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, req)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("Response code should be %d, was: %d (%s)", http.StatusCreated, w.Code, w.Body)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "/v1/accounts?id=1", nil)
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, req)
+
+	var respBody map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &respBody); err != nil {
+		t.Error(err)
+	}
+	if respBody["Balance"] != "99.00" {
+		t.Errorf("Wrong response, got %s", w.Body)
+	}
+}
+
+func TestRealMigrateMinorUnits(t *testing.T) {
+	db, engine, err := functionalSetUp()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer functionalTearDown(db, engine)
+
+	// Emulate data written by float64 version of the service
+	if err := db.Exec(`UPDATE accounts SET balance = 0.7 WHERE id = 1`).Error; err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := db.Exec(`UPDATE payments SET amount = 0.1, currency = '' WHERE account_id = 1`).Error; err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := db.Delete(&SchemaMigration{Name: "minor_units"}).Error; err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// Second run should not do anything
+	for i := 0; i < 2; i++ {
+		if err := runMigrations(db); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	var account Account
+	if err := db.First(&account, 1).Error; err != nil {
+		t.Fatal(err.Error())
+	}
+	if account.Balance != 70 {
+		t.Errorf("Wrong balance after migration: %d", account.Balance)
+	}
+	var payment Payment
+	if err := db.Where("account_id = ?", 1).First(&payment).Error; err != nil {
+		t.Fatal(err.Error())
+	}
+	if payment.Amount != 10 || payment.Currency != "USD" {
+		t.Errorf("Wrong payment after migration: %s", payment)
+	}
+}
+
+func TestRealMigrateMinorUnitsSchema(t *testing.T) {
+	file, err := ioutil.TempFile("", "baseline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+
+	// Emulate database created by float64 version of the service
+	baseline, err := gorm.Open("sqlite3", file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, statement := range []string{
+		`CREATE TABLE "accounts" ("id" integer primary key autoincrement,"created_at" datetime,"updated_at" datetime,"deleted_at" datetime,"owner" varchar(255),"balance" real,"currency" varchar(255) )`,
+		`CREATE TABLE "payments" ("id" integer primary key autoincrement,"created_at" datetime,"updated_at" datetime,"deleted_at" datetime,"account_id" integer,"amount" real,"direction" varchar(255),"account_to_id" integer,"account_from_id" integer )`,
+		`INSERT INTO accounts (created_at, owner, balance, currency) VALUES (CURRENT_TIMESTAMP, 'alice', 10000.0, 'USD'), (CURRENT_TIMESTAMP, 'bob', 0.7, 'USD')`,
+		// Currencies weren't validated
+		`INSERT INTO accounts (created_at, owner, balance, currency) VALUES (CURRENT_TIMESTAMP, 'carol', 100.0, 'usd'), (CURRENT_TIMESTAMP, 'dave', 100.0, 'SGD'), (CURRENT_TIMESTAMP, 'erin', 100.0, 'jpy')`,
+		`INSERT INTO payments (created_at, account_id, amount, direction, account_to_id, account_from_id) VALUES (CURRENT_TIMESTAMP, 1, 10000.0, 'incoming', 0, 2), (CURRENT_TIMESTAMP, 2, 10000.0, 'outgoing', 1, 0)`,
+	} {
+		if err := baseline.Exec(statement).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	baseline.Close()
+
+	db, err := setupDatabase("sqlite3", file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var accounts []Account
+	if err := db.Order("id").Find(&accounts).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(accounts) != 5 || accounts[0].Balance != 1000000 || accounts[1].Balance != 70 || accounts[0].OpeningBalance != 0 {
+		t.Errorf("Wrong accounts after migration: %+v", accounts)
+	}
+	for i, expected := range []struct {
+		currency string
+		balance  Decimal
+	}{{"USD", "100.00"}, {"SGD", "100.00"}, {"JPY", "100"}} {
+		if account := accounts[2+i]; account.Currency != expected.currency || account.Balance.Decimal(account.Currency) != expected.balance {
+			t.Errorf("Wrong account after migration: %+v", account)
+		}
+	}
+	var payments []Payment
+	if err := db.Order("id").Find(&payments).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(payments) != 2 || payments[0].Amount != 1000000 || payments[0].Currency != "USD" || payments[0].PostedAt == nil {
+		t.Errorf("Wrong payments after migration: %v", payments)
+	}
+	if !db.NewScope(nil).Dialect().HasIndex("payments", "idx_payments_account_posted_at") {
+		t.Error("Payments indexes should be recreated")
+	}
+	var balanceType, amountType string
+	if err := db.Raw(`SELECT (SELECT typeof(balance) FROM accounts LIMIT 1), (SELECT typeof(amount) FROM payments LIMIT 1)`).Row().Scan(&balanceType, &amountType); err != nil {
+		t.Fatal(err)
+	}
+	if balanceType != "integer" || amountType != "integer" {
+		t.Errorf("Money columns should be integer, got %s and %s", balanceType, amountType)
+	}
+}
+
+func TestRealSubmitConservesBalances(t *testing.T) {
+	db, engine, err := functionalSetUp()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer functionalTearDown(db, engine)
+	// Many requests are in flight at once on a pool of connections, but
+	// sqlite3 runs their transactions one at a time: `_txlock=immediate` takes
+	// the database lock when a transaction begins. So this test only checks
+	// balances and the journal add up after many interleaved requests with
+	// either concurrency control. It doesn't exercise row locks or version
+	// conflicts, see `TestSubmitLocksAccountsInOrder` and
+	// `TestSubmitOptimisticRetry` for them.
+	pool, err := gorm.Open("sqlite3", "test.db?_txlock=immediate&_busy_timeout=30000")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer pool.Close()
+	pool.DB().SetMaxOpenConns(8)
+
+	totalBalance := func() (total Amount) {
+		var accounts []Account
+		if err := db.Find(&accounts).Error; err != nil {
+			t.Fatal(err.Error())
+		}
+		for _, account := range accounts {
+			if account.Balance < 0 {
+				t.Errorf("Negative balance %d on account %d", account.Balance, account.ID)
+			}
+			total += account.Balance
+		}
+		return total
+	}
+	paymentsCount := func(status string) (count int) {
+		if err := db.Model(&Payment{}).Where("currency = ? AND status = ?", "EUR", status).Count(&count).Error; err != nil {
+			t.Fatal(err.Error())
+		}
+		return count
+	}
+
+	for _, concurrency := range []string{pessimisticConcurrency, optimisticConcurrency} {
+		opts := defaultOptions()
+		opts.Concurrency = concurrency
+		engine := setupRouter(pool, opts)
+		balanceBefore := totalBalance()
+		postedBefore, failedBefore := paymentsCount(statusPosted), paymentsCount(statusFailed)
+
+		// EUR accounts 4-13 with 1.00 each, transfers are bigger than that sometimes
+		const transfers = 300
+		codes := make(chan int, transfers)
+		var wg sync.WaitGroup
+		for i := 0; i < transfers; i++ {
+			from := 4 + rand.Intn(10)
+			to := 4 + (from-4+1+rand.Intn(9))%10
+			payload := fmt.Sprintf(`{"from_account":%d, "amount":"0.%02d", "to_account":%d}`, from, 1+rand.Intn(99), to)
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				req, _ := http.NewRequest("POST", "/v1/payments", bytes.NewBufferString(payload))
+				w := httptest.NewRecorder()
+				engine.ServeHTTP(w, req)
+				codes <- w.Code
+			}()
+		}
+		wg.Wait()
+		close(codes)
+
+		succeeded := 0
+		for code := range codes {
+			if code == http.StatusCreated {
+				succeeded++
+			} else if code != http.StatusBadRequest {
+				t.Errorf("Unexpected response code %d", code)
+			}
+		}
+		if succeeded == 0 {
+			t.Errorf("No %s transfer succeeded", concurrency)
+		}
+
+		if after := totalBalance(); after != balanceBefore {
+			t.Errorf("Total balance is not conserved with %s concurrency: %d before, %d after", concurrency, balanceBefore, after)
+		}
+		if count := paymentsCount(statusPosted) - postedBefore; count != 2*succeeded {
+			t.Errorf("Expected %d posted payments for %d transfers, got %d", 2*succeeded, succeeded, count)
+		}
+		if count := paymentsCount(statusFailed) - failedBefore; count != 2*(transfers-succeeded) {
+			t.Errorf("Expected %d failed payments for %d transfers, got %d", 2*(transfers-succeeded), transfers-succeeded, count)
+		}
+	}
+}
+
+func TestRealReconciliation(t *testing.T) {
+	db, engine, err := functionalSetUp()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer functionalTearDown(db, engine)
+
+	// Test data is not consistent with the journal, start with a clean slate
+	if err := db.Exec(`UPDATE accounts SET opening_balance = balance`).Error; err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := db.Exec(`DELETE FROM payments`).Error; err != nil {
+		t.Fatal(err.Error())
+	}
+
+	payloads := []struct {
+		payload string
+		code    int
+	}{
+		{payload: `{"from_account":1, "amount":"10.00", "to_account":2}`, code: http.StatusCreated},
+		{payload: `{"from_account":2, "amount":"2.50", "to_account":1}`, code: http.StatusCreated},
+		{payload: `{"from_account":2, "amount":"100.00", "to_account":1}`, code: http.StatusBadRequest},
+	}
+	for _, payload := range payloads {
+		req, _ := http.NewRequest("POST", "/v1/payments", bytes.NewBufferString(payload.payload))
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, req)
+		if w.Code != payload.code {
+			t.Fatalf("Response code should be %d, was: %d (%s)", payload.code, w.Code, w.Body)
+		}
+	}
+
+	var transfers []Transfer
+	if err := db.Preload("Payments").Find(&transfers).Error; err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(transfers) != 3 {
+		t.Fatalf("Expected 3 transfers, got %d", len(transfers))
+	}
+	for _, transfer := range transfers {
+		if err := transfer.Validate(); err != nil {
+			t.Errorf("Transfer %d is not valid: %s", transfer.ID, err)
+		}
+	}
+
+	getDiscrepancies := func() (res []map[string]interface{}) {
+		req, _ := http.NewRequest("GET", "/v1/reconciliation", nil)
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Response code should be %d, was: %d (%s)", http.StatusOK, w.Code, w.Body)
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	if res := getDiscrepancies(); len(res) != 0 {
+		t.Errorf("Expected no discrepancies, got %v", res)
+	}
+
+	// Balance changed behind the journal's back
+	if err := db.Exec(`UPDATE accounts SET balance = balance + 1 WHERE id = 2`).Error; err != nil {
+		t.Fatal(err.Error())
+	}
+	res := getDiscrepancies()
+	if len(res) != 1 || res[0]["account"] != 2.0 || res[0]["balance"] != "17.51" || res[0]["journal_balance"] != "17.50" {
+		t.Errorf("Unexpected discrepancies %v", res)
+	}
+}
+
+func TestRealPaymentStatuses(t *testing.T) {
+	db, engine, err := functionalSetUp()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer functionalTearDown(db, engine)
+
+	req, _ := http.NewRequest("POST", "/v1/payments", bytes.NewBufferString(`{"from_account":1, "amount":"500.00", "to_account":2}`))
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Response code should be %d, was: %d (%s)", http.StatusBadRequest, w.Code, w.Body)
+	}
+	var failure struct {
+		Error    string
+		Transfer uint
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &failure); err != nil {
+		t.Fatal(err)
+	}
+
+	var transfer Transfer
+	if err := db.Preload("Payments").Preload("Transitions").First(&transfer, failure.Transfer).Error; err != nil {
+		t.Fatal(err.Error())
+	}
+	if transfer.Status != statusFailed || transfer.Reason != "Not enough balance" || transfer.Reason != failure.Error {
+		t.Errorf("Unexpected failed transfer %+v", transfer)
+	}
+	if len(transfer.Transitions) != 2 || transfer.Transitions[1].FromStatus != statusPending ||
+		transfer.Transitions[1].ToStatus != statusFailed || transfer.Transitions[1].CreatedAt.IsZero() {
+		t.Errorf("Unexpected status history %+v", transfer.Transitions)
+	}
+
+	testCases := []struct {
+		query string
+		code  int
+		count int
+	}{
+		{query: "status=failed", code: http.StatusOK, count: 2},
+		{query: "status=failed&account_id=2", code: http.StatusOK, count: 1},
+		{query: "status=reversed", code: http.StatusOK, count: 0},
+		{query: "status=lost", code: http.StatusBadRequest},
+	}
+	for _, testCase := range testCases {
+		req, _ := http.NewRequest("GET", "/v1/payments?"+testCase.query, nil)
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, req)
+
+		if w.Code != testCase.code {
+			t.Errorf("Response code for %s should be %d, was: %d (%s)", testCase.query, testCase.code, w.Code, w.Body)
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		var respBody []Payment
+		if err := json.Unmarshal(w.Body.Bytes(), &respBody); err != nil {
+			t.Error(err)
+		}
+		if len(respBody) != testCase.count {
+			t.Errorf("Expected %d payments for %s, got %s", testCase.count, testCase.query, w.Body)
+		}
+		for _, payment := range respBody {
+			if payment.Status != statusFailed || payment.TransferID != failure.Transfer {
+				t.Errorf("Unexpected payment %s", payment)
+			}
+		}
+	}
+
+	// Payments to unknown accounts fail without legs, transfer is still found
+	req, _ = http.NewRequest("POST", "/v1/payments", bytes.NewBufferString(`{"from_account":1, "amount":"1.00", "to_account":1000}`))
+	w = httptest.NewRecorder()
+	engine.ServeHTTP(w, req)
+	if err := json.Unmarshal(w.Body.Bytes(), &failure); err != nil || failure.Transfer == 0 {
+		t.Fatalf("Unexpected response %s", w.Body)
+	}
+	req, _ = http.NewRequest("GET", fmt.Sprintf("/v1/transfers/%d", failure.Transfer), nil)
+	w = httptest.NewRecorder()
+	engine.ServeHTTP(w, req)
+	transfer = Transfer{}
+	if err := json.Unmarshal(w.Body.Bytes(), &transfer); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Unexpected response %s", w.Body)
+	}
+	if transfer.ID != failure.Transfer || transfer.Status != statusFailed || transfer.Reason != "No account with ID=1000" ||
+		len(transfer.Payments) != 0 || len(transfer.Transitions) != 2 {
+		t.Errorf("Unexpected transfer %s", w.Body)
+	}
+	req, _ = http.NewRequest("GET", "/v1/transfers/1000", nil)
+	w = httptest.NewRecorder()
+	engine.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Response code should be %d, was: %d (%s)", http.StatusBadRequest, w.Code, w.Body)
+	}
+}
+
+func TestRealReversePayment(t *testing.T) {
+	db, engine, err := functionalSetUp()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer functionalTearDown(db, engine)
+
+	submit := func(payload string) Transfer {
+		req, _ := http.NewRequest("POST", "/v1/payments", bytes.NewBufferString(payload))
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, req)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("Response code should be %d, was: %d (%s)", http.StatusCreated, w.Code, w.Body)
+		}
+		var transfer Transfer
+		if err := db.Preload("Payments").Last(&transfer).Error; err != nil {
+			t.Fatal(err.Error())
+		}
+		return transfer
+	}
+	original := submit(`{"from_account":1, "amount":"50.00", "to_account":2}`)
+
+	testCases := []struct {
+		payment                uint
+		payload                string
+		code                   int
+		sourceAfter, destAfter Amount
+		status                 string
+	}{
+		{payment: original.Payments[0].ID, payload: `{"amount":"20.00"}`, code: http.StatusCreated,
+			sourceAfter: 7000, destAfter: 4000, status: statusPosted},
+		{payment: original.Payments[0].ID, payload: `{"amount":"30.01"}`, code: http.StatusBadRequest,
+			sourceAfter: 7000, destAfter: 4000, status: statusPosted},
+		{payment: original.Payments[0].ID, payload: `{"amount":"-1"}`, code: http.StatusBadRequest,
+			sourceAfter: 7000, destAfter: 4000, status: statusPosted},
+		{payment: original.Payments[1].ID, code: http.StatusCreated,
+			sourceAfter: 10000, destAfter: 1000, status: statusReversed},
+		{payment: original.Payments[1].ID, code: http.StatusBadRequest,
+			sourceAfter: 10000, destAfter: 1000, status: statusReversed},
+		{payment: 1000, code: http.StatusBadRequest,
+			sourceAfter: 10000, destAfter: 1000, status: statusReversed},
+	}
+	var refunds []Transfer
+	for i, testCase := range testCases {
+		url := fmt.Sprintf("/v1/payments/%d/reverse", testCase.payment)
+		req, _ := http.NewRequest("POST", url, bytes.NewBufferString(testCase.payload))
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, req)
+
+		if w.Code != testCase.code {
+			t.Errorf("Response code for refund #%d should be %d, was: %d (%s)", i, testCase.code, w.Code, w.Body)
+		}
+		if w.Code == http.StatusCreated {
+			var refund Transfer
+			if err := json.Unmarshal(w.Body.Bytes(), &refund); err != nil {
+				t.Fatal(err)
+			}
+			if refund.ReversalOfID != original.ID || refund.Status != statusPosted || refund.Validate() != nil {
+				t.Errorf("Unexpected refund %s", w.Body)
+			}
+			refunds = append(refunds, refund)
+		}
+
+		var source, dest Account
+		db.First(&source, 1)
+		db.First(&dest, 2)
+		if source.Balance != testCase.sourceAfter || dest.Balance != testCase.destAfter {
+			t.Errorf("Unexpected balances %s and %s after refund #%d", source.Balance.Decimal("USD"), dest.Balance.Decimal("USD"), i)
+		}
+		var transfer Transfer
+		db.Preload("Payments").First(&transfer, original.ID)
+		if transfer.Status != testCase.status || transfer.Payments[0].Status != testCase.status {
+			t.Errorf("Unexpected original transfer status %s after refund #%d", transfer.Status, i)
+		}
+	}
+
+	// Refunds themselves can't be refunded
+	url := fmt.Sprintf("/v1/payments/%d/reverse", refunds[0].Payments[0].ID)
+	req, _ := http.NewRequest("POST", url, nil)
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Response code should be %d, was: %d (%s)", http.StatusBadRequest, w.Code, w.Body)
+	}
+
+	// Money already left destination account
+	original = submit(`{"from_account":1, "amount":"5.00", "to_account":2}`)
+	submit(`{"from_account":2, "amount":"15.00", "to_account":1}`)
+	url = fmt.Sprintf("/v1/payments/%d/reverse", original.Payments[0].ID)
+	req, _ = http.NewRequest("POST", url, nil)
+	w = httptest.NewRecorder()
+	engine.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Response code should be %d, was: %d (%s)", http.StatusBadRequest, w.Code, w.Body)
+	}
+	var failed Transfer
+	if err := db.Where("reversal_of_id = ? AND status = ?", original.ID, statusFailed).First(&failed).Error; err != nil {
+		t.Errorf("Failed refund is not recorded: %s", err)
+	}
+}
+
+func TestRealGetPayment(t *testing.T) {
+	db, engine, err := functionalSetUp()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer functionalTearDown(db, engine)
+
+	submit := func() (transfer Transfer) {
+		req, _ := http.NewRequest("POST", "/v1/payments", bytes.NewBufferString(`{"from_account":1, "amount":"50.00", "to_account":2}`))
+		req.Header.Set(idempotencyHeader, "lookup")
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, req)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("Response code should be %d, was: %d (%s)", http.StatusCreated, w.Code, w.Body)
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &transfer); err != nil {
+			t.Fatal(err)
+		}
+		return transfer
+	}
+	created := submit()
+	if created.ID == 0 || created.Status != statusPosted || len(created.Payments) != 2 {
+		t.Fatalf("Unexpected transfer %+v", created)
+	}
+	if replayed := submit(); replayed.ID != created.ID {
+		t.Errorf("Replayed transfer ID=%d, expected ID=%d", replayed.ID, created.ID)
+	}
+
+	for _, leg := range created.Payments {
+		if leg.ID == 0 || leg.TransferID != created.ID || leg.Amount != 5000 {
+			t.Errorf("Unexpected leg %s", leg)
+		}
+		req, _ := http.NewRequest("GET", fmt.Sprintf("/v1/payments/%d", leg.ID), nil)
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Response code should be %d, was: %d (%s)", http.StatusOK, w.Code, w.Body)
+		}
+		var transfer Transfer
+		if err := json.Unmarshal(w.Body.Bytes(), &transfer); err != nil {
+			t.Fatal(err)
+		}
+		if transfer.ID != created.ID || len(transfer.Payments) != 2 || len(transfer.Transitions) != 2 ||
+			transfer.Payments[0].Direction != outgoing || transfer.Payments[1].Direction != incoming {
+			t.Errorf("Unexpected transfer %s", w.Body)
+		}
+	}
+
+	// Test data payments don't belong to any transfer
+	req, _ := http.NewRequest("GET", "/v1/payments/1", nil)
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, req)
+	var legacy Transfer
+	if err := json.Unmarshal(w.Body.Bytes(), &legacy); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK || legacy.ID != 0 || len(legacy.Payments) != 1 || legacy.Payments[0].ID != 1 {
+		t.Errorf("Unexpected response %d (%s)", w.Code, w.Body)
+	}
+
+	req, _ = http.NewRequest("GET", "/v1/payments/1000", nil)
+	w = httptest.NewRecorder()
+	engine.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Response code should be %d, was: %d (%s)", http.StatusBadRequest, w.Code, w.Body)
+	}
+}
+
+func TestRealExchangeRates(t *testing.T) {
+	db, engine, err := functionalSetUp()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer functionalTearDown(db, engine)
+
+	testCases := []struct {
+		payload string
+		code    int
+	}{
+		{payload: `[{"from":"usd", "to":"PHP", "rate":"51.237"}, {"from":"PHP", "to":"USD", "rate":0.0195, "valid_from":"2018-01-01T00:00:00Z"}]`, code: http.StatusCreated},
+		{payload: `[{"from":"USD", "to":"PHP", "rate":"50", "valid_from":"2018-01-01T00:00:00Z", "valid_until":"2018-02-01T00:00:00Z"}]`, code: http.StatusCreated},
+		{payload: `[]`, code: http.StatusBadRequest},
+		{payload: `[{"from":"USD", "to":"XXX", "rate":"1.5"}]`, code: http.StatusBadRequest},
+		{payload: `[{"from":"USD", "to":"USD", "rate":"1.5"}]`, code: http.StatusBadRequest},
+		{payload: `[{"from":"USD", "to":"EUR", "rate":"0"}]`, code: http.StatusBadRequest},
+		{payload: `[{"from":"USD", "to":"EUR", "rate":"1e3"}]`, code: http.StatusBadRequest},
+		{payload: `[{"from":"USD", "to":"EUR", "rate":"0.9", "valid_from":"2018-02-01T00:00:00Z", "valid_until":"2018-01-01T00:00:00Z"}]`, code: http.StatusBadRequest},
+		// All or nothing
+		{payload: `[{"from":"USD", "to":"EUR", "rate":"0.9"}, {"from":"USD", "to":"EUR", "rate":"-0.9"}]`, code: http.StatusBadRequest},
+	}
+	for _, testCase := range testCases {
+		req, _ := http.NewRequest("POST", "/v1/admin/rates", bytes.NewBufferString(testCase.payload))
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, req)
+
+		if w.Code != testCase.code {
+			t.Errorf("Response code for %s should be %d, was: %d (%s)", testCase.payload, testCase.code, w.Code, w.Body)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "/v1/admin/rates?from=usd", nil)
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, req)
+	var rates []ExchangeRate
+	if err := json.Unmarshal(w.Body.Bytes(), &rates); err != nil {
+		t.Fatal(err)
+	}
+	if len(rates) != 2 || rates[0].Rate != "51.237" || rates[0].ToCurrency != "PHP" || rates[0].ValidUntil != nil ||
+		rates[1].ValidUntil == nil {
+		t.Errorf("Unexpected rates %s", w.Body)
+	}
+
+	// Expired rate is never used, the latest valid one is
+	rate, err := findRate(db, "USD", "PHP", time.Now())
+	if err != nil || rate.Rate != "51.237" {
+		t.Errorf("Unexpected rate %+v (%v)", rate, err)
+	}
+	if rate, err = findRate(db, "USD", "PHP", time.Date(2018, 1, 15, 0, 0, 0, 0, time.UTC)); err != nil || rate.Rate != "50" {
+		t.Errorf("Unexpected rate %+v (%v)", rate, err)
+	}
+	if _, err = findRate(db, "USD", "EUR", time.Now()); err == nil {
+		t.Error("Rate should not exist")
+	}
+}
+
+func TestRealSubmitCrossCurrency(t *testing.T) {
+	db, engine, err := functionalSetUp()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer functionalTearDown(db, engine)
+
+	post := func(url string, payload string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", url, bytes.NewBufferString(payload))
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, req)
+		return w
+	}
+	// FX accounts 15 and 16, PHP one provides liquidity
+	for _, payload := range []string{
+		`{"owner":"system:fx", "currency":"USD"}`,
+		`{"owner":"system:fx", "currency":"PHP", "balance":"600.00"}`,
+	} {
+		if w := post("/v1/accounts", payload); w.Code != http.StatusCreated {
+			t.Fatalf("Response code should be %d, was: %d (%s)", http.StatusCreated, w.Code, w.Body)
+		}
+	}
+	if w := post("/v1/admin/rates", `[{"from":"USD", "to":"PHP", "rate":"51.237"}]`); w.Code != http.StatusCreated {
+		t.Fatalf("Response code should be %d, was: %d (%s)", http.StatusCreated, w.Code, w.Body)
+	}
+
+	balances := func() (res []Amount) {
+		for _, id := range []uint{1, 3, 15, 16} {
+			var account Account
+			if err := db.First(&account, id).Error; err != nil {
+				t.Fatal(err.Error())
+			}
+			res = append(res, account.Balance)
+		}
+		return res
+	}
+
+	w := post("/v1/payments", `{"from_account":1, "amount":"10.01", "to_account":3}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Response code should be %d, was: %d (%s)", http.StatusCreated, w.Code, w.Body)
+	}
+	var transfer struct {
+		ID       uint
+		Payments []map[string]interface{}
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &transfer); err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		account  float64
+		amount   string
+		currency string
+	}{
+		{account: 1, amount: "10.01", currency: "USD"},
+		{account: 15, amount: "10.01", currency: "USD"},
+		{account: 16, amount: "512.88", currency: "PHP"},
+		{account: 3, amount: "512.88", currency: "PHP"},
+	}
+	if len(transfer.Payments) != len(expected) {
+		t.Fatalf("Unexpected transfer %s", w.Body)
+	}
+	for i, leg := range transfer.Payments {
+		if leg["account"] != expected[i].account || leg["amount"] != expected[i].amount || leg["currency"] != expected[i].currency ||
+			leg["rate"] != "51.237" || leg["source_amount"] != "10.01" || leg["destination_amount"] != "512.88" {
+			t.Errorf("Unexpected leg %v", leg)
+		}
+	}
+	if res := balances(); res[0] != 8999 || res[1] != 58288 || res[2] != 1001 || res[3] != 8712 {
+		t.Errorf("Unexpected balances %v", res)
+	}
+
+	// Not enough PHP liquidity and no PHP to USD rate
+	for _, payload := range []string{
+		`{"from_account":1, "amount":"5.00", "to_account":3}`,
+		`{"from_account":3, "amount":"5.00", "to_account":1}`,
+	} {
+		if w := post("/v1/payments", payload); w.Code != http.StatusBadRequest {
+			t.Errorf("Response code should be %d, was: %d (%s)", http.StatusBadRequest, w.Code, w.Body)
+		}
+	}
+	if res := balances(); res[0] != 8999 || res[1] != 58288 || res[2] != 1001 || res[3] != 8712 {
+		t.Errorf("Unexpected balances %v", res)
+	}
+
+	// Cross-currency payment is only refunded in full, at the same rate
+	var leg Payment
+	db.Where("transfer_id = ?", transfer.ID).First(&leg)
+	if w := post(fmt.Sprintf("/v1/payments/%d/reverse", leg.ID), `{"amount":"5.00"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Response code should be %d, was: %d (%s)", http.StatusBadRequest, w.Code, w.Body)
+	}
+	if w := post(fmt.Sprintf("/v1/payments/%d/reverse", leg.ID), ``); w.Code != http.StatusCreated {
+		t.Errorf("Response code should be %d, was: %d (%s)", http.StatusCreated, w.Code, w.Body)
+	}
+	if res := balances(); res[0] != 10000 || res[1] != 7000 || res[2] != 0 || res[3] != 60000 {
+		t.Errorf("Unexpected balances %v", res)
+	}
+}
+
+func TestRealQuotes(t *testing.T) {
+	db, engine, err := functionalSetUp()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer functionalTearDown(db, engine)
+
+	post := func(url string, payload string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", url, bytes.NewBufferString(payload))
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, req)
+		return w
+	}
+	for _, payload := range []string{
+		`{"owner":"system:fx", "currency":"USD"}`,
+		`{"owner":"system:fx", "currency":"PHP", "balance":"10000.00"}`,
+	} {
+		if w := post("/v1/accounts", payload); w.Code != http.StatusCreated {
+			t.Fatalf("Response code should be %d, was: %d (%s)", http.StatusCreated, w.Code, w.Body)
+		}
+	}
+	if w := post("/v1/admin/rates", `[{"from":"USD", "to":"PHP", "rate":"51.237"}]`); w.Code != http.StatusCreated {
+		t.Fatalf("Response code should be %d, was: %d (%s)", http.StatusCreated, w.Code, w.Body)
+	}
+
+	quote := func(payload string) (res map[string]interface{}) {
+		w := post("/v1/quotes", payload)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("Response code should be %d, was: %d (%s)", http.StatusCreated, w.Code, w.Body)
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	fxQuote := quote(`{"from_account":1, "amount":"10.01", "to_account":3}`)
+	if fxQuote["rate"] != "51.237" || fxQuote["amount"] != "10.01" || fxQuote["destination_amount"] != "512.88" ||
+		fxQuote["destination_currency"] != "PHP" || fxQuote["fee"] != "0.00" || fxQuote["expires_at"] == nil {
+		t.Errorf("Unexpected quote %v", fxQuote)
+	}
+	sameQuote := quote(`{"from_account":1, "amount":"10.00", "to_account":2}`)
+	if _, ok := sameQuote["rate"]; ok || sameQuote["destination_amount"] != "10.00" {
+		t.Errorf("Unexpected quote %v", sameQuote)
+	}
+	expiredQuote := quote(`{"from_account":1, "amount":"1.00", "to_account":3}`)
+	if err := db.Model(&Quote{}).Where("id = ?", expiredQuote["ID"]).Update("expires_at", time.Now().UTC().Add(-time.Second)).Error; err != nil {
+		t.Fatal(err.Error())
+	}
+	if w := post("/v1/quotes", `{"from_account":3, "amount":"1.00", "to_account":1}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Response code should be %d, was: %d (%s)", http.StatusBadRequest, w.Code, w.Body)
+	}
+
+	// Rate changes, but quoted payment gets quoted rate
+	if w := post("/v1/admin/rates", `[{"from":"USD", "to":"PHP", "rate":"60"}]`); w.Code != http.StatusCreated {
+		t.Fatalf("Response code should be %d, was: %d (%s)", http.StatusCreated, w.Code, w.Body)
+	}
+	testCases := []struct {
+		payload string
+		code    int
+	}{
+		{payload: fmt.Sprintf(`{"from_account":1, "amount":"10.00", "to_account":3, "quote":%v}`, fxQuote["ID"]), code: http.StatusBadRequest},
+		{payload: fmt.Sprintf(`{"from_account":2, "amount":"10.01", "to_account":3, "quote":%v}`, fxQuote["ID"]), code: http.StatusBadRequest},
+		{payload: fmt.Sprintf(`{"from_account":1, "amount":"10.01", "to_account":3, "quote":%v}`, fxQuote["ID"]), code: http.StatusCreated},
+		{payload: fmt.Sprintf(`{"from_account":1, "amount":"10.01", "to_account":3, "quote":%v}`, fxQuote["ID"]), code: http.StatusBadRequest},
+		{payload: fmt.Sprintf(`{"from_account":1, "amount":"1.00", "to_account":3, "quote":%v}`, expiredQuote["ID"]), code: http.StatusBadRequest},
+		{payload: fmt.Sprintf(`{"from_account":1, "amount":"10.00", "to_account":2, "quote":%v}`, sameQuote["ID"]), code: http.StatusCreated},
+		{payload: `{"from_account":1, "amount":"10.00", "to_account":2, "quote":1000}`, code: http.StatusBadRequest},
+		{payload: `{"from_account":1, "amount":"1.00", "to_account":3}`, code: http.StatusCreated},
+	}
+	for _, testCase := range testCases {
+		if w := post("/v1/payments", testCase.payload); w.Code != testCase.code {
+			t.Errorf("Response code for %s should be %d, was: %d (%s)", testCase.payload, testCase.code, w.Code, w.Body)
+		}
+	}
+
+	var dest Account
+	db.First(&dest, 3)
+	// Quoted 512.88 PHP and 60.00 PHP at the current rate
+	if dest.Balance != 7000+51288+6000 {
+		t.Errorf("Unexpected balance %s", dest.Balance.Decimal(dest.Currency))
+	}
+	var used Quote
+	db.First(&used, fxQuote["ID"])
+	if used.TransferID == 0 {
+		t.Errorf("Quote is not marked as used")
+	}
+}
+
+func TestRealFees(t *testing.T) {
+	db, engine, err := functionalSetUp()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer functionalTearDown(db, engine)
+
+	request := func(method string, url string, payload string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, bytes.NewBufferString(payload))
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, req)
+		return w
+	}
+	// Revenue account 15
+	if w := request("POST", "/v1/accounts", `{"owner":"system:revenue", "currency":"USD"}`); w.Code != http.StatusCreated {
+		t.Fatalf("Response code should be %d, was: %d (%s)", http.StatusCreated, w.Code, w.Body)
+	}
+	if w := request("PATCH", "/v1/accounts/2", `{"owner":"bob", "tier":"premium"}`); w.Code != http.StatusOK {
+		t.Fatalf("Response code should be %d, was: %d (%s)", http.StatusOK, w.Code, w.Body)
+	}
+
+	schedules := []struct {
+		payload string
+		code    int
+	}{
+		{payload: `[{"currency":"USD", "flat":"0.30", "percent":"2.9", "min":"0.50"}, {"currency":"USD", "from_amount":"50.00", "percent":"1", "max":"5.00"}]`, code: http.StatusCreated},
+		{payload: `[{"currency":"USD", "tier":"premium"}]`, code: http.StatusCreated},
+		{payload: `[{"currency":"EUR", "flat":"1.00"}]`, code: http.StatusCreated},
+		{payload: `[]`, code: http.StatusBadRequest},
+		{payload: `[{"currency":"XXX", "flat":"1.00"}]`, code: http.StatusBadRequest},
+		{payload: `[{"currency":"USD", "flat":"-1.00"}]`, code: http.StatusBadRequest},
+		{payload: `[{"currency":"USD", "percent":"-1"}]`, code: http.StatusBadRequest},
+		{payload: `[{"currency":"USD", "flat":"0.001"}]`, code: http.StatusBadRequest},
+		{payload: `[{"currency":"USD", "min":"2.00", "max":"1.00"}]`, code: http.StatusBadRequest},
+	}
+	for _, schedule := range schedules {
+		if w := request("POST", "/v1/admin/fees", schedule.payload); w.Code != schedule.code {
+			t.Errorf("Response code for %s should be %d, was: %d (%s)", schedule.payload, schedule.code, w.Code, w.Body)
+		}
+	}
+	var schedule FeeSchedule
+	db.Where("currency = ?", "EUR").First(&schedule)
+	if w := request("DELETE", fmt.Sprintf("/v1/admin/fees/%d", schedule.ID), ``); w.Code != http.StatusOK {
+		t.Errorf("Response code should be %d, was: %d (%s)", http.StatusOK, w.Code, w.Body)
+	}
+	w := request("GET", "/v1/admin/fees", ``)
+	var listed []map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &listed); err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 3 || listed[0]["flat"] != "0.30" || listed[0]["percent"] != "2.9" || listed[1]["max"] != "5.00" {
+		t.Errorf("Unexpected fee schedules %s", w.Body)
+	}
+
+	w = request("POST", "/v1/quotes", `{"from_account":1, "amount":"10.00", "to_account":2}`)
+	var quote map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &quote); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusCreated || quote["fee"] != "0.59" {
+		t.Errorf("Unexpected quote %s", w.Body)
+	}
+
+	testCases := []struct {
+		payload              string
+		code                 int
+		fee                  string
+		aliceAfter, bobAfter Amount
+		revenueAfter         Amount
+	}{
+		{payload: `{"from_account":1, "amount":"10.00", "to_account":2}`, code: http.StatusCreated, fee: "0.59",
+			aliceAfter: 8941, bobAfter: 2000, revenueAfter: 59},
+		{payload: `{"from_account":1, "amount":"5.00", "to_account":2}`, code: http.StatusCreated, fee: "0.50",
+			aliceAfter: 8391, bobAfter: 2500, revenueAfter: 109},
+		{payload: `{"from_account":1, "amount":"60.00", "to_account":2}`, code: http.StatusCreated, fee: "0.60",
+			aliceAfter: 2331, bobAfter: 8500, revenueAfter: 169},
+		// Premium tier schedule has no fees
+		{payload: `{"from_account":2, "amount":"1.00", "to_account":1}`, code: http.StatusCreated, fee: "0.00",
+			aliceAfter: 2431, bobAfter: 8400, revenueAfter: 169},
+		// Fee makes it 25.00
+		{payload: `{"from_account":1, "amount":"24.00", "to_account":2}`, code: http.StatusBadRequest,
+			aliceAfter: 2431, bobAfter: 8400, revenueAfter: 169},
+	}
+	var firstLeg uint
+	for _, testCase := range testCases {
+		w := request("POST", "/v1/payments", testCase.payload)
+		if w.Code != testCase.code {
+			t.Errorf("Response code for %s should be %d, was: %d (%s)", testCase.payload, testCase.code, w.Code, w.Body)
+		}
+		if w.Code == http.StatusCreated {
+			var transfer Transfer
+			if err := json.Unmarshal(w.Body.Bytes(), &transfer); err != nil {
+				t.Fatal(err)
+			}
+			for _, leg := range transfer.Payments {
+				if leg.Kind == "" && leg.Fee.Decimal("USD") != Decimal(testCase.fee) || leg.Kind == feeKind && leg.Amount.Decimal("USD") != Decimal(testCase.fee) {
+					t.Errorf("Unexpected leg %s of %s", leg, w.Body)
+				}
+			}
+			if firstLeg == 0 {
+				firstLeg = transfer.Payments[0].ID
+			}
+		}
+
+		var alice, bob, revenue Account
+		db.First(&alice, 1)
+		db.First(&bob, 2)
+		db.First(&revenue, 15)
+		if alice.Balance != testCase.aliceAfter || bob.Balance != testCase.bobAfter || revenue.Balance != testCase.revenueAfter {
+			t.Errorf("Unexpected balances %d, %d, %d after %s", alice.Balance, bob.Balance, revenue.Balance, testCase.payload)
+		}
+	}
+
+	w = request("GET", "/v1/payments?account_id=15", ``)
+	var payments []Payment
+	if err := json.Unmarshal(w.Body.Bytes(), &payments); err != nil {
+		t.Fatal(err)
+	}
+	if len(payments) != 3 || payments[0].Kind != feeKind || payments[0].Amount != 59 {
+		t.Errorf("Unexpected revenue account payments %s", w.Body)
+	}
+
+	// Fee is not refunded
+	if w := request("POST", fmt.Sprintf("/v1/payments/%d/reverse", firstLeg), `{"amount":"5.00"}`); w.Code != http.StatusCreated {
+		t.Errorf("Response code should be %d, was: %d (%s)", http.StatusCreated, w.Code, w.Body)
+	}
+	if w := request("POST", fmt.Sprintf("/v1/payments/%d/reverse", firstLeg), `{"amount":"5.01"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Response code should be %d, was: %d (%s)", http.StatusBadRequest, w.Code, w.Body)
+	}
+	var revenue Account
+	db.First(&revenue, 15)
+	if revenue.Balance != 169 {
+		t.Errorf("Unexpected revenue balance %d", revenue.Balance)
+	}
+}
+
+func TestRealHolds(t *testing.T) {
+	db, engine, err := functionalSetUp()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer functionalTearDown(db, engine)
+
+	post := func(url string, payload string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", url, bytes.NewBufferString(payload))
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, req)
+		return w
+	}
+	hold := func(payload string) (res map[string]interface{}) {
+		w := post("/v1/holds", payload)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("Response code should be %d, was: %d (%s)", http.StatusCreated, w.Code, w.Body)
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	checkAlice := func(balance, available string) {
+		req, _ := http.NewRequest("GET", "/v1/accounts?id=1", nil)
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, req)
+		var res map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		if res["Balance"] != balance || res["available_balance"] != available {
+			t.Errorf("Unexpected balances %v and %v, expected %s and %s", res["Balance"], res["available_balance"], balance, available)
+		}
+	}
+
+	captured := hold(`{"from_account":1, "amount":"60.00", "to_account":2}`)
+	if captured["status"] != holdActive || captured["amount"] != "60.00" || captured["currency"] != "USD" || captured["expires_at"] == nil {
+		t.Errorf("Unexpected hold %v", captured)
+	}
+	checkAlice("100.00", "40.00")
+
+	// Held funds can't be spent or held again
+	for url, payload := range map[string]string{
+		"/v1/payments": `{"from_account":1, "amount":"50.00", "to_account":2}`,
+		"/v1/holds":    `{"from_account":1, "amount":"50.00", "to_account":2}`,
+	} {
+		if w := post(url, payload); w.Code != http.StatusBadRequest {
+			t.Errorf("Response code for %s should be %d, was: %d (%s)", url, http.StatusBadRequest, w.Code, w.Body)
+		}
+	}
+
+	testCases := []struct {
+		url     string
+		payload string
+		code    int
+	}{
+		{url: fmt.Sprintf("/v1/holds/%v/capture", captured["ID"]), payload: `{"amount":"60.01"}`, code: http.StatusBadRequest},
+		{url: fmt.Sprintf("/v1/holds/%v/capture", captured["ID"]), payload: `{"amount":"25.00"}`, code: http.StatusCreated},
+		{url: fmt.Sprintf("/v1/holds/%v/capture", captured["ID"]), payload: ``, code: http.StatusBadRequest},
+		{url: fmt.Sprintf("/v1/holds/%v/void", captured["ID"]), payload: ``, code: http.StatusBadRequest},
+		{url: "/v1/holds/1000/capture", payload: ``, code: http.StatusBadRequest},
+	}
+	for _, testCase := range testCases {
+		if w := post(testCase.url, testCase.payload); w.Code != testCase.code {
+			t.Errorf("Response code for %s should be %d, was: %d (%s)", testCase.url, testCase.code, w.Code, w.Body)
+		}
+	}
+	// The rest of captured hold is released
+	checkAlice("75.00", "75.00")
+	var bob Account
+	db.First(&bob, 2)
+	if bob.Balance != 1000+2500 {
+		t.Errorf("Unexpected balance %d", bob.Balance)
+	}
+	var capturedHold Hold
+	db.First(&capturedHold, captured["ID"])
+	if capturedHold.Status != holdCaptured || capturedHold.TransferID == 0 {
+		t.Errorf("Unexpected hold %+v", capturedHold)
+	}
+
+	voided := hold(`{"from_account":1, "amount":"30.00", "to_account":2}`)
+	checkAlice("75.00", "45.00")
+	if w := post(fmt.Sprintf("/v1/holds/%v/void", voided["ID"]), ``); w.Code != http.StatusOK {
+		t.Errorf("Response code should be %d, was: %d (%s)", http.StatusOK, w.Code, w.Body)
+	}
+	checkAlice("75.00", "75.00")
+
+	expired := hold(`{"from_account":1, "amount":"10.00", "to_account":2}`)
+	if err := db.Model(&Hold{}).Where("id = ?", expired["ID"]).Update("expires_at", time.Now().UTC().Add(-time.Second)).Error; err != nil {
+		t.Fatal(err.Error())
+	}
+	if w := post(fmt.Sprintf("/v1/holds/%v/capture", expired["ID"]), ``); w.Code != http.StatusBadRequest {
+		t.Errorf("Response code should be %d, was: %d (%s)", http.StatusBadRequest, w.Code, w.Body)
+	}
+	checkAlice("75.00", "65.00")
+	if n, err := expireHolds(db, defaultOptions(), time.Now()); n != 1 || err != nil {
+		t.Errorf("Unexpected expiry result %d, %v", n, err)
+	}
+	checkAlice("75.00", "75.00")
+
+	req, _ := http.NewRequest("GET", "/v1/holds?account_id=1", nil)
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, req)
+	var holds []map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &holds); err != nil {
+		t.Fatal(err)
+	}
+	if len(holds) != 3 || holds[0]["status"] != holdCaptured || holds[0]["amount"] != "60.00" ||
+		holds[1]["status"] != holdVoided || holds[2]["status"] != holdExpired {
+		t.Errorf("Unexpected holds %s", w.Body)
+	}
+
+	// Captured payment flagged by screening stays on hold
+	rules := &ScreeningRules{ReviewScore: 50, Rules: []ScreeningRule{{Name: "any", Type: amountRule, Currency: "USD", Amount: "0.01", Score: 50}}}
+	if err := rules.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	opts := defaultOptions()
+	opts.Screener = rules
+	engine = setupRouter(db, opts)
+	flagged := hold(`{"from_account":1, "amount":"20.00", "to_account":2}`)
+	checkAlice("75.00", "55.00")
+	if w := post(fmt.Sprintf("/v1/holds/%v/capture", flagged["ID"]), ``); w.Code != http.StatusBadRequest {
+		t.Errorf("Response code should be %d, was: %d (%s)", http.StatusBadRequest, w.Code, w.Body)
+	}
+	checkAlice("75.00", "55.00")
+	var flaggedHold Hold
+	db.First(&flaggedHold, uint(flagged["ID"].(float64)))
+	if flaggedHold.Status != holdActive || flaggedHold.TransferID != 0 {
+		t.Errorf("Unexpected hold %+v", flaggedHold)
+	}
+}
+
+func TestRealOverdraftLimit(t *testing.T) {
+	db, engine, err := functionalSetUp()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer functionalTearDown(db, engine)
+
+	request := func(method, url string, payload string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, bytes.NewBufferString(payload))
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, req)
+		return w
+	}
+	for _, payload := range []string{
+		`{"owner":"credit", "currency":"USD", "overdraft_limit":"-1.00"}`,
+		`{"owner":"credit", "currency":"USD", "overdraft_limit":"1.001"}`,
+	} {
+		if w := request("POST", "/v1/accounts", payload); w.Code != http.StatusBadRequest {
+			t.Errorf("Response code for %s should be %d, was: %d (%s)", payload, http.StatusBadRequest, w.Code, w.Body)
+		}
+	}
+	w := request("POST", "/v1/accounts", `{"owner":"credit", "currency":"USD", "overdraft_limit":"50.00"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Response code should be %d, was: %d (%s)", http.StatusCreated, w.Code, w.Body)
+	}
+	var created map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	if created["overdraft_limit"] != "50.00" || created["available_balance"] != "50.00" {
+		t.Errorf("Unexpected account %s", w.Body)
+	}
+
+	testCases := []struct {
+		method  string
+		url     string
+		payload string
+		code    int
+	}{
+		{method: "POST", url: "/v1/payments", payload: `{"from_account":15, "amount":"50.01", "to_account":2}`, code: http.StatusBadRequest},
+		{method: "POST", url: "/v1/payments", payload: `{"from_account":15, "amount":"30.00", "to_account":2}`, code: http.StatusCreated},
+		{method: "PATCH", url: "/v1/accounts/15", payload: `{"owner":"credit", "overdraft_limit":"29.99"}`, code: http.StatusBadRequest},
+		{method: "PATCH", url: "/v1/accounts/15", payload: `{"owner":"credit", "overdraft_limit":"-1"}`, code: http.StatusBadRequest},
+		{method: "PATCH", url: "/v1/accounts/15", payload: `{"owner":"credit", "overdraft_limit":"40.00"}`, code: http.StatusOK},
+		{method: "POST", url: "/v1/payments", payload: `{"from_account":15, "amount":"10.00", "to_account":2}`, code: http.StatusCreated},
+		{method: "POST", url: "/v1/payments", payload: `{"from_account":15, "amount":"0.01", "to_account":2}`, code: http.StatusBadRequest},
+		{method: "DELETE", url: "/v1/accounts/15", payload: ``, code: http.StatusBadRequest},
+	}
+	for _, testCase := range testCases {
+		if w := request(testCase.method, testCase.url, testCase.payload); w.Code != testCase.code {
+			t.Errorf("Response code for %s %s should be %d, was: %d (%s)", testCase.url, testCase.payload, testCase.code, w.Code, w.Body)
+		}
+	}
+
+	var account Account
+	db.First(&account, 15)
+	if account.Balance != -4000 || account.OverdraftLimit != 4000 || account.Available() != 0 {
+		t.Errorf("Unexpected account %+v", account)
+	}
+}
+
+func TestRealLimits(t *testing.T) {
+	db, engine, err := functionalSetUp()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer functionalTearDown(db, engine)
+
+	request := func(method, url string, payload string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, bytes.NewBufferString(payload))
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, req)
+		return w
+	}
+	for _, payload := range []string{
+		`[]`,
+		`[{"max_amount":"1.00", "currency":"USD"}]`,
+		`[{"account":1, "owner":"alice", "max_amount":"1.00"}]`,
+		`[{"account":100, "max_amount":"1.00"}]`,
+		`[{"account":1, "currency":"EUR", "max_amount":"1.00"}]`,
+		`[{"owner":"alice", "max_amount":"1.00"}]`,
+		`[{"account":1, "max_amount":"-1.00"}]`,
+		`[{"account":1}]`,
+		`[{"account":1, "max_amount":"1.00"}, {"account":1, "hourly_count":-1}]`,
+	} {
+		if w := request("POST", "/v1/admin/limits", payload); w.Code != http.StatusBadRequest {
+			t.Errorf("Response code for %s should be %d, was: %d (%s)", payload, http.StatusBadRequest, w.Code, w.Body)
+		}
+	}
+	w := request("POST", "/v1/admin/limits", `[
+		{"account":1, "max_amount":"50.00", "daily_amount":"80.00"},
+		{"owner":"bob", "currency":"usd", "hourly_count":2}
+	]`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Response code should be %d, was: %d (%s)", http.StatusCreated, w.Code, w.Body)
+	}
+	var limits []map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &limits); err != nil {
+		t.Fatal(err)
+	}
+	if len(limits) != 2 || limits[0]["currency"] != "USD" || limits[0]["max_amount"] != "50.00" || limits[1]["currency"] != "USD" {
+		t.Errorf("Unexpected limits %s", w.Body)
+	}
+
+	testCases := []struct {
+		payload string
+		code    int
+	}{
+		{payload: `{"from_account":1, "amount":"50.01", "to_account":2}`, code: http.StatusBadRequest},
+		{payload: `{"from_account":1, "amount":"50.00", "to_account":2}`, code: http.StatusCreated},
+		{payload: `{"from_account":1, "amount":"30.00", "to_account":2}`, code: http.StatusCreated},
+		{payload: `{"from_account":1, "amount":"0.01", "to_account":2}`, code: http.StatusBadRequest},
+		{payload: `{"from_account":2, "amount":"1.00", "to_account":1}`, code: http.StatusCreated},
+		{payload: `{"from_account":2, "amount":"1.00", "to_account":1}`, code: http.StatusCreated},
+		{payload: `{"from_account":2, "amount":"1.00", "to_account":1}`, code: http.StatusBadRequest},
+	}
+	for _, testCase := range testCases {
+		w := request("POST", "/v1/payments", testCase.payload)
+		if w.Code != testCase.code {
+			t.Errorf("Response code for %s should be %d, was: %d (%s)", testCase.payload, testCase.code, w.Code, w.Body)
+			continue
+		}
+		var res map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		if w.Code == http.StatusBadRequest && (res["code"] != limitExceededCode || res["transfer"] == nil) {
+			t.Errorf("Unexpected response %s", w.Body)
+		}
+	}
+
+	w = request("GET", "/v1/admin/limits?owner=bob", ``)
+	if err := json.Unmarshal(w.Body.Bytes(), &limits); err != nil {
+		t.Fatal(err)
+	}
+	if len(limits) != 1 {
+		t.Fatalf("Unexpected limits %s", w.Body)
+	}
+	if w := request("DELETE", fmt.Sprintf("/v1/admin/limits/%v", limits[0]["ID"]), ``); w.Code != http.StatusOK {
+		t.Errorf("Response code should be %d, was: %d (%s)", http.StatusOK, w.Code, w.Body)
+	}
+	if w := request("POST", "/v1/payments", `{"from_account":2, "amount":"1.00", "to_account":1}`); w.Code != http.StatusCreated {
+		t.Errorf("Response code should be %d, was: %d (%s)", http.StatusCreated, w.Code, w.Body)
+	}
+	// Other errors have no code
+	w = request("POST", "/v1/payments", `{"from_account":2, "amount":"1000.00", "to_account":1}`)
+	if w.Code != http.StatusBadRequest || strings.Contains(w.Body.String(), limitExceededCode) {
+		t.Errorf("Unexpected response %d (%s)", w.Code, w.Body)
+	}
+}
+
+func TestRealScreening(t *testing.T) {
+	db, engine, err := functionalSetUp()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer functionalTearDown(db, engine)
+
+	rules := &ScreeningRules{
+		ReviewScore: 50,
+		RejectScore: 100,
+		Rules: []ScreeningRule{
+			{Name: "large", Type: amountRule, Currency: "USD", Amount: "50.00", Score: 60},
+			{Name: "round", Type: roundAmountRule, Currency: "USD", Amount: "10.00", Score: 10},
+			{Name: "new", Type: newDestinationRule, Score: 20},
+			{Name: "rapid", Type: rapidSuccessionRule, Count: 2, Window: "1h", Score: 50},
+		},
+	}
+	if err := rules.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	opts := defaultOptions()
+	opts.Screener = rules
+	engine = setupRouter(db, opts)
+
+	testCases := []struct {
+		payload string
+		code    int
+		status  string
+		score   int
+	}{
+		{payload: `{"from_account":1, "amount":"1.01", "to_account":2}`, code: http.StatusCreated, status: statusPosted, score: 20},
+		{payload: `{"from_account":1, "amount":"1.02", "to_account":2}`, code: http.StatusCreated, status: statusPosted, score: 0},
+		{payload: `{"from_account":1, "amount":"1.03", "to_account":2}`, code: http.StatusCreated, status: statusReview, score: 50},
+		{payload: `{"from_account":1, "amount":"60.00", "to_account":2}`, code: http.StatusBadRequest, status: statusFailed, score: 120},
+	}
+	for _, testCase := range testCases {
+		req, _ := http.NewRequest("POST", "/v1/payments", bytes.NewBufferString(testCase.payload))
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, req)
+		if w.Code != testCase.code {
+			t.Errorf("Response code for %s should be %d, was: %d (%s)", testCase.payload, testCase.code, w.Code, w.Body)
+			continue
+		}
+
+		var transfer Transfer
+		if testCase.code == http.StatusCreated {
+			if err := json.Unmarshal(w.Body.Bytes(), &transfer); err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			var res map[string]interface{}
+			if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+				t.Fatal(err)
+			}
+			transfer.ID = uint(res["transfer"].(float64))
+		}
+		// Decision is kept with the transfer
+		db.Preload("Payments").Preload("Screenings").First(&transfer, transfer.ID)
+		if transfer.Status != testCase.status || len(transfer.Screenings) != 1 || transfer.Screenings[0].Score != testCase.score {
+			t.Errorf("Unexpected transfer %+v for %s", transfer, testCase.payload)
+		}
+	}
+
+	// Transfer parked for review doesn't change balances
+	var alice, bob Account
+	db.First(&alice, 1)
+	db.First(&bob, 2)
+	if alice.Balance != 10000-101-102 || bob.Balance != 1000+101+102 {
+		t.Errorf("Unexpected balances %d, %d", alice.Balance, bob.Balance)
+	}
+	req, _ := http.NewRequest("GET", "/v1/payments?status=review", nil)
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, req)
+	var payments []Payment
+	if err := json.Unmarshal(w.Body.Bytes(), &payments); err != nil {
+		t.Fatal(err)
+	}
+	if len(payments) != 2 || payments[0].Amount != 103 {
+		t.Errorf("Unexpected payments for review %s", w.Body)
+	}
+}
+
+func TestRealScreeningSplits(t *testing.T) {
+	db, engine, err := functionalSetUp()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer functionalTearDown(db, engine)
+
+	carol := Account{Owner: "carol", Currency: "USD"}
+	if err := db.Create(&carol).Error; err != nil {
+		t.Fatal(err)
+	}
+	rules := &ScreeningRules{
+		ReviewScore: 100,
+		Rules:       []ScreeningRule{{Name: "new", Type: newDestinationRule, Score: 20}},
+	}
+	if err := rules.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	opts := defaultOptions()
+	opts.Screener = rules
+	engine = setupRouter(db, opts)
+
+	// Each split destination is checked, split payments count as paid before
+	testCases := []struct {
+		payload string
+		score   int
+	}{
+		{payload: `{"from_account":1, "splits":[{"to_account":2, "amount":"1.00"}]}`, score: 20},
+		{payload: fmt.Sprintf(`{"from_account":1, "splits":[{"to_account":2, "amount":"1.00"}, {"to_account":%d, "amount":"1.00"}]}`, carol.ID), score: 20},
+		{payload: fmt.Sprintf(`{"from_account":1, "splits":[{"to_account":2, "amount":"1.00"}, {"to_account":%d, "amount":"1.00"}]}`, carol.ID), score: 0},
+		{payload: fmt.Sprintf(`{"from_account":1, "amount":"1.00", "to_account":%d}`, carol.ID), score: 0},
+		{payload: fmt.Sprintf(`{"from_account":%d, "amount":"1.00", "to_account":2}`, carol.ID), score: 20},
+	}
+	for _, testCase := range testCases {
+		req, _ := http.NewRequest("POST", "/v1/payments", bytes.NewBufferString(testCase.payload))
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, req)
+		var transfer Transfer
+		if err := json.Unmarshal(w.Body.Bytes(), &transfer); err != nil || w.Code != http.StatusCreated {
+			t.Errorf("Unexpected response for %s: %d (%s)", testCase.payload, w.Code, w.Body)
+			continue
+		}
+		db.Preload("Screenings").First(&transfer, transfer.ID)
+		if len(transfer.Screenings) != 1 || transfer.Screenings[0].Score != testCase.score {
+			t.Errorf("Unexpected screenings %+v for %s", transfer.Screenings, testCase.payload)
+		}
+	}
+}
+
+func TestRealReviews(t *testing.T) {
+	db, engine, err := functionalSetUp()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer functionalTearDown(db, engine)
+
+	rules := &ScreeningRules{
+		ReviewScore: 50,
+		Rules:       []ScreeningRule{{Name: "large", Type: amountRule, Currency: "USD", Amount: "50.00", Score: 60}},
+	}
+	if err := rules.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	opts := defaultOptions()
+	opts.Screener = rules
+	engine = setupRouter(db, opts)
+
+	request := func(method, url, user, payload string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, bytes.NewBufferString(payload))
+		if user != "" {
+			req.Header.Set(apiUserHeader, user)
+		}
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, req)
+		return w
+	}
+	var parked []uint
+	for _, payload := range []string{
+		`{"from_account":1, "amount":"60.00", "to_account":2}`,
+		`{"from_account":1, "amount":"70.00", "to_account":2}`,
+	} {
+		w := request("POST", "/v1/payments", "", payload)
+		var transfer Transfer
+		if err := json.Unmarshal(w.Body.Bytes(), &transfer); err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != http.StatusCreated || transfer.Status != statusReview {
+			t.Fatalf("Payment should be parked for review, got %d (%s)", w.Code, w.Body)
+		}
+		parked = append(parked, transfer.ID)
+	}
+
+	var queue []Transfer
+	if err := json.Unmarshal(request("GET", "/v1/reviews", "", ``).Body.Bytes(), &queue); err != nil {
+		t.Fatal(err)
+	}
+	if len(queue) != 2 || queue[0].ID != parked[0] || len(queue[0].Payments) != 2 || len(queue[0].Screenings) != 1 {
+		t.Errorf("Unexpected review queue %+v", queue)
+	}
+
+	testCases := []struct {
+		url     string
+		user    string
+		payload string
+		code    int
+	}{
+		{url: fmt.Sprintf("/v1/reviews/%d/approve", parked[0]), code: http.StatusBadRequest},
+		{url: fmt.Sprintf("/v1/reviews/%d/approve", parked[0]), user: "carol", payload: `{"note":"Known customer"}`, code: http.StatusOK},
+		{url: fmt.Sprintf("/v1/reviews/%d/approve", parked[0]), user: "carol", code: http.StatusBadRequest},
+		// Not enough balance any more
+		{url: fmt.Sprintf("/v1/reviews/%d/approve", parked[1]), user: "carol", code: http.StatusBadRequest},
+		{url: fmt.Sprintf("/v1/reviews/%d/reject", parked[1]), user: "dave", payload: `{"note":"Insufficient funds"}`, code: http.StatusOK},
+		{url: "/v1/reviews/1000/reject", user: "dave", code: http.StatusBadRequest},
+	}
+	for _, testCase := range testCases {
+		if w := request("POST", testCase.url, testCase.user, testCase.payload); w.Code != testCase.code {
+			t.Errorf("Response code for %s should be %d, was: %d (%s)", testCase.url, testCase.code, w.Code, w.Body)
+		}
+	}
+
+	var alice, bob Account
+	db.First(&alice, 1)
+	db.First(&bob, 2)
+	if alice.Balance != 10000-6000 || bob.Balance != 1000+6000 {
+		t.Errorf("Unexpected balances %d, %d", alice.Balance, bob.Balance)
+	}
+	for i, expected := range []struct {
+		status   string
+		reviewer string
+		note     string
+	}{
+		{status: statusPosted, reviewer: "carol", note: "Known customer"},
+		{status: statusFailed, reviewer: "dave", note: "Insufficient funds"},
+	} {
+		var transfer Transfer
+		db.Preload("Payments").Preload("Reviews").First(&transfer, parked[i])
+		if transfer.Status != expected.status || transfer.Payments[0].Status != expected.status || len(transfer.Reviews) != 1 ||
+			transfer.Reviews[0].Reviewer != expected.reviewer || transfer.Reviews[0].Note != expected.note {
+			t.Errorf("Unexpected reviewed transfer %+v", transfer)
+		}
+	}
+	if err := json.Unmarshal(request("GET", "/v1/reviews", "", ``).Body.Bytes(), &queue); err != nil {
+		t.Fatal(err)
+	}
+	if len(queue) != 0 {
+		t.Errorf("Review queue should be empty, was %+v", queue)
+	}
+
+	// Parked payments fit into the limit one by one, but not together
+	if err := db.Create(&Limit{AccountID: 2, Currency: "USD", DailyAmount: 10000}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Model(&Account{}).Where("id = ?", 2).Update("balance", 20000).Error; err != nil {
+		t.Fatal(err)
+	}
+	parked = nil
+	for i := 0; i < 2; i++ {
+		w := request("POST", "/v1/payments", "", `{"from_account":2, "amount":"60.00", "to_account":1}`)
+		var transfer Transfer
+		if err := json.Unmarshal(w.Body.Bytes(), &transfer); err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != http.StatusCreated || transfer.Status != statusReview {
+			t.Fatalf("Payment should be parked for review, got %d (%s)", w.Code, w.Body)
+		}
+		parked = append(parked, transfer.ID)
+	}
+	if w := request("POST", fmt.Sprintf("/v1/reviews/%d/approve", parked[0]), "carol", ``); w.Code != http.StatusOK {
+		t.Errorf("Response code should be %d, was: %d (%s)", http.StatusOK, w.Code, w.Body)
+	}
+	if w := request("POST", fmt.Sprintf("/v1/reviews/%d/approve", parked[1]), "carol", ``); w.Code != http.StatusBadRequest {
+		t.Errorf("Response code should be %d, was: %d (%s)", http.StatusBadRequest, w.Code, w.Body)
+	}
+	var transfer Transfer
+	db.First(&transfer, parked[1])
+	if transfer.Status != statusReview {
+		t.Errorf("Payment exceeding limit should stay parked, got %+v", transfer)
+	}
+}
+
+func TestRealApprovals(t *testing.T) {
+	db, engine, err := functionalSetUp()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer functionalTearDown(db, engine)
+
+	opts := defaultOptions()
+	opts.ApprovalThresholds = map[string]Amount{"USD": 5000}
+	engine = setupRouter(db, opts)
+
+	request := func(method, url, user, payload string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, bytes.NewBufferString(payload))
+		if user != "" {
+			req.Header.Set(apiUserHeader, user)
+		}
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, req)
+		return w
+	}
+	if w := request("POST", "/v1/payments", "", `{"from_account":1, "amount":"50.01", "to_account":2}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Response code should be %d, was: %d (%s)", http.StatusBadRequest, w.Code, w.Body)
+	}
+	if w := request("POST", "/v1/payments", "", `{"from_account":1, "amount":"5.00", "to_account":2}`); w.Code != http.StatusCreated {
+		t.Errorf("Response code should be %d, was: %d (%s)", http.StatusCreated, w.Code, w.Body)
+	}
+	var approvals []uint
+	for _, amount := range []string{"90.00", "60.00", "50.01"} {
+		w := request("POST", "/v1/payments", "alice", fmt.Sprintf(`{"from_account":1, "amount":"%s", "to_account":2}`, amount))
+		var transfer Transfer
+		if err := json.Unmarshal(w.Body.Bytes(), &transfer); err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != http.StatusCreated || transfer.Status != statusApproval || len(transfer.Approvals) != 1 || transfer.Approvals[0].Maker != "alice" {
+			t.Fatalf("Payment should be parked for approval, got %d (%s)", w.Code, w.Body)
+		}
+		approvals = append(approvals, transfer.Approvals[0].ID)
+	}
+
+	var pending []map[string]interface{}
+	if err := json.Unmarshal(request("GET", "/v1/approvals?status=pending", "", ``).Body.Bytes(), &pending); err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 3 || pending[0]["amount"] != "90.00" || pending[0]["maker"] != "alice" {
+		t.Errorf("Unexpected approvals %v", pending)
+	}
+	if err := db.Model(&Approval{}).Where("id = ?", approvals[2]).Update("expires_at", time.Now().UTC().Add(-time.Second)).Error; err != nil {
+		t.Fatal(err.Error())
+	}
+
+	testCases := []struct {
+		url     string
+		user    string
+		payload string
+		code    int
+	}{
+		{url: fmt.Sprintf("/v1/approvals/%d/approve", approvals[1]), code: http.StatusBadRequest},
+		{url: fmt.Sprintf("/v1/approvals/%d/approve", approvals[1]), user: "alice", code: http.StatusBadRequest},
+		// Users are not authenticated (see `apiUser`): nothing tells apart
+		// bob from the maker claiming to be bob
+		{url: fmt.Sprintf("/v1/approvals/%d/approve", approvals[1]), user: "bob", payload: `{"note":"Rent"}`, code: http.StatusOK},
+		// Not enough balance any more
+		{url: fmt.Sprintf("/v1/approvals/%d/approve", approvals[0]), user: "bob", code: http.StatusBadRequest},
+		{url: fmt.Sprintf("/v1/approvals/%d/decline", approvals[1]), user: "bob", code: http.StatusBadRequest},
+		{url: fmt.Sprintf("/v1/approvals/%d/decline", approvals[0]), user: "alice", code: http.StatusOK},
+		{url: fmt.Sprintf("/v1/approvals/%d/approve", approvals[2]), user: "bob", code: http.StatusBadRequest},
+		{url: "/v1/approvals/1000/approve", user: "bob", code: http.StatusBadRequest},
+	}
+	for _, testCase := range testCases {
+		if w := request("POST", testCase.url, testCase.user, testCase.payload); w.Code != testCase.code {
+			t.Errorf("Response code for %s by %q should be %d, was: %d (%s)", testCase.url, testCase.user, testCase.code, w.Code, w.Body)
+		}
+	}
+	if n, err := expireApprovals(db, opts, time.Now()); n != 1 || err != nil {
+		t.Errorf("Unexpected expiry result %d, %v", n, err)
+	}
+
+	var alice Account
+	db.First(&alice, 1)
+	if alice.Balance != 10000-500-6000 {
+		t.Errorf("Unexpected balance %d", alice.Balance)
+	}
+	for i, expected := range []struct {
+		approval string
+		transfer string
+		checker  string
+	}{
+		{approval: approvalDeclined, transfer: statusFailed, checker: "alice"},
+		{approval: approvalApproved, transfer: statusPosted, checker: "bob"},
+		{approval: approvalExpired, transfer: statusFailed},
+	} {
+		var approval Approval
+		var transfer Transfer
+		db.First(&approval, approvals[i])
+		db.Preload("Reviews").First(&transfer, approval.TransferID)
+		if approval.Status != expected.approval || approval.Checker != expected.checker || transfer.Status != expected.transfer {
+			t.Errorf("Unexpected approval %+v of transfer %+v", approval, transfer)
+		}
+		if expected.checker != "" && (len(transfer.Reviews) != 1 || transfer.Reviews[0].Reviewer != expected.checker) {
+			t.Errorf("Unexpected reviews %+v", transfer.Reviews)
+		}
+	}
+}
+
+func TestRealScheduledPayments(t *testing.T) {
+	db, engine, err := functionalSetUp()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer functionalTearDown(db, engine)
+
+	request := func(method, url, key, payload string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, bytes.NewBufferString(payload))
+		if key != "" {
+			req.Header.Set(idempotencyHeader, key)
+		}
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, req)
+		return w
+	}
+	// Execution times in other zones are due at the same instant
+	now := time.Now()
+	at := func(d time.Duration) string {
+		return now.Add(d).In(time.FixedZone("", 9*60*60)).Format(time.RFC3339)
+	}
+
+	for _, payload := range []string{
+		fmt.Sprintf(`{"from_account":1, "amount":"10.00", "to_account":2, "execute_at":"%s"}`, at(-time.Hour)),
+		fmt.Sprintf(`{"from_account":1, "amount":"10.001", "to_account":2, "execute_at":"%s"}`, at(time.Hour)),
+		fmt.Sprintf(`{"from_account":1, "amount":"10.00", "to_account":1000, "execute_at":"%s"}`, at(time.Hour)),
+		fmt.Sprintf(`{"from_account":1, "amount":"10.00", "to_account":2, "quote":1, "execute_at":"%s"}`, at(time.Hour)),
+	} {
+		if w := request("POST", "/v1/payments", "", payload); w.Code != http.StatusBadRequest {
+			t.Errorf("Response code for %s should be %d, was: %d (%s)", payload, http.StatusBadRequest, w.Code, w.Body)
+		}
+	}
+	if w := request("POST", "/v1/holds", "", fmt.Sprintf(`{"from_account":1, "amount":"10.00", "to_account":2, "execute_at":"%s"}`, at(time.Hour))); w.Code != http.StatusBadRequest {
+		t.Errorf("Holds can't be scheduled, got %d (%s)", w.Code, w.Body)
+	}
+
+	var scheduled []ScheduledPayment
+	for i, amount := range []string{"30.00", "90.00", "10.00", "5.00"} {
+		execute := at(time.Hour)
+		if i == 3 {
+			execute = at(2 * time.Hour)
+		}
+		payload := fmt.Sprintf(`{"from_account":1, "amount":"%s", "to_account":2, "execute_at":"%s"}`, amount, execute)
+		// Retry of the same request is replayed
+		var payment ScheduledPayment
+		for attempt := 0; attempt < 2; attempt++ {
+			w := request("POST", "/v1/payments", fmt.Sprintf("schedule-%d", i), payload)
+			if err := json.Unmarshal(w.Body.Bytes(), &payment); err != nil {
+				t.Fatal(err)
+			}
+			if w.Code != http.StatusCreated || payment.Status != scheduleScheduled || payment.Amount.Decimal("USD") != Decimal(amount) {
+				t.Fatalf("Payment should be scheduled, got %d (%s)", w.Code, w.Body)
+			}
+		}
+		scheduled = append(scheduled, payment)
+	}
+
+	testCases := []struct {
+		url  string
+		code int
+	}{
+		{url: fmt.Sprintf("/v1/scheduled-payments/%d/cancel", scheduled[2].ID), code: http.StatusOK},
+		{url: fmt.Sprintf("/v1/scheduled-payments/%d/cancel", scheduled[2].ID), code: http.StatusBadRequest},
+		{url: "/v1/scheduled-payments/1000/cancel", code: http.StatusBadRequest},
+	}
+	for _, testCase := range testCases {
+		if w := request("POST", testCase.url, "", ``); w.Code != testCase.code {
+			t.Errorf("Response code for %s should be %d, was: %d (%s)", testCase.url, testCase.code, w.Code, w.Body)
+		}
+	}
+
+	var listed []map[string]interface{}
+	if err := json.Unmarshal(request("GET", "/v1/scheduled-payments?status=scheduled&account_id=1", "", ``).Body.Bytes(), &listed); err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 3 || listed[0]["amount"] != "30.00" || listed[2]["amount"] != "5.00" {
+		t.Errorf("Unexpected scheduled payments %v", listed)
+	}
+
+	opts := defaultOptions()
+	if n, err := executeScheduledPayments(db, opts, now); n != 0 || err != nil {
+		t.Errorf("Unexpected execution result %d, %v", n, err)
+	}
+	// The first payment leaves not enough balance for the second one
+	if n, err := executeScheduledPayments(db, opts, now.Add(90*time.Minute)); n != 2 || err != nil {
+		t.Errorf("Unexpected execution result %d, %v", n, err)
+	}
+	// Other replica doesn't execute them again
+	if claimed, err := executeScheduledPayment(db, opts, scheduled[0].ID); claimed || err != nil {
+		t.Errorf("Payment should not be executed twice, got %v, %v", claimed, err)
+	}
+	if w := request("POST", fmt.Sprintf("/v1/scheduled-payments/%d/cancel", scheduled[0].ID), "", ``); w.Code != http.StatusBadRequest {
+		t.Errorf("Executed payment can't be canceled, got %d (%s)", w.Code, w.Body)
+	}
+	if n, err := executeScheduledPayments(db, opts, now.Add(3*time.Hour)); n != 1 || err != nil {
+		t.Errorf("Unexpected execution result %d, %v", n, err)
+	}
+
+	var alice Account
+	db.First(&alice, 1)
+	if alice.Balance != 10000-3000-500 {
+		t.Errorf("Unexpected balance %d", alice.Balance)
+	}
+	for i, expected := range []struct {
+		status   string
+		transfer string
+		reason   string
+	}{
+		{status: scheduleExecuted, transfer: statusPosted},
+		{status: scheduleFailed, transfer: statusFailed, reason: "Not enough balance"},
+		{status: scheduleCanceled},
+		{status: scheduleExecuted, transfer: statusPosted},
+	} {
+		var payment ScheduledPayment
+		var transfer Transfer
+		db.First(&payment, scheduled[i].ID)
+		if payment.TransferID != 0 {
+			db.First(&transfer, payment.TransferID)
+		}
+		if payment.Status != expected.status || payment.Reason != expected.reason || transfer.Status != expected.transfer {
+			t.Errorf("Unexpected scheduled payment %+v of transfer %+v", payment, transfer)
+		}
+	}
+}
+
+func TestRealMandates(t *testing.T) {
+	db, engine, err := functionalSetUp()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer functionalTearDown(db, engine)
+
+	request := func(method, url, payload string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, bytes.NewBufferString(payload))
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, req)
+		return w
+	}
+	for _, payload := range []string{
+		`{"from_account":1, "amount":"10.00", "to_account":1, "schedule":"daily"}`,
+		`{"from_account":1, "amount":"10.00", "to_account":1000, "schedule":"daily"}`,
+		`{"from_account":1, "amount":"10.00", "to_account":2, "schedule":"yearly"}`,
+		`{"from_account":1, "amount":"10.00", "to_account":2, "schedule":"0 0 30 2 *"}`,
+		`{"from_account":1, "amount":"10.00", "to_account":2, "schedule":"daily", "on_insufficient_funds":"retry"}`,
+		`{"from_account":1, "amount":"10.00", "to_account":2, "schedule":"daily", "on_insufficient_funds":"ignore"}`,
+	} {
+		if w := request("POST", "/v1/mandates", payload); w.Code != http.StatusBadRequest {
+			t.Errorf("Response code for %s should be %d, was: %d (%s)", payload, http.StatusBadRequest, w.Code, w.Body)
+		}
+	}
+
+	var mandates []Mandate
+	for _, payload := range []string{
+		`{"from_account":1, "amount":"70.00", "to_account":2, "schedule":"daily", "on_insufficient_funds":"retry", "retries":1}`,
+		`{"from_account":1, "amount":"50.00", "to_account":2, "schedule":"weekly", "on_insufficient_funds":"suspend"}`,
+		`{"from_account":1, "amount":"5.00", "to_account":2, "schedule":"0 0 1 1 *"}`,
+	} {
+		w := request("POST", "/v1/mandates", payload)
+		var mandate Mandate
+		if err := json.Unmarshal(w.Body.Bytes(), &mandate); err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != http.StatusCreated || mandate.Status != mandateActive {
+			t.Fatalf("Mandate should be created, got %d (%s)", w.Code, w.Body)
+		}
+		mandates = append(mandates, mandate)
+	}
+
+	opts := defaultOptions()
+	// Run times are compared the same in any zone
+	now := time.Now().In(time.FixedZone("", -5*60*60))
+	// The first mandate leaves not enough balance for the second one
+	if n, err := executeMandates(db, opts, now); n != 2 || err != nil {
+		t.Errorf("Unexpected execution result %d, %v", n, err)
+	}
+	// Other replica doesn't pay them again
+	if claimed, err := executeMandate(db, opts, mandates[0].ID, now); claimed || err != nil {
+		t.Errorf("Occurrence should not be paid twice, got %v, %v", claimed, err)
+	}
+	// Not enough balance for the next occurrence of the first one, it's retried
+	tomorrow := now.Add(24*time.Hour + time.Minute)
+	if n, err := executeMandates(db, opts, tomorrow); n != 1 || err != nil {
+		t.Errorf("Unexpected execution result %d, %v", n, err)
+	}
+	var retried Mandate
+	db.First(&retried, mandates[0].ID)
+	if retried.Attempts != 1 || !retried.NextRunAt.Equal(tomorrow.Add(opts.MandateRetryInterval)) {
+		t.Errorf("Unexpected mandate %+v", retried)
+	}
+
+	testCases := []struct {
+		url    string
+		code   int
+		status string
+	}{
+		{url: fmt.Sprintf("/v1/mandates/%d/pause", mandates[0].ID), code: http.StatusOK, status: mandatePaused},
+		{url: fmt.Sprintf("/v1/mandates/%d/pause", mandates[0].ID), code: http.StatusBadRequest},
+		{url: fmt.Sprintf("/v1/mandates/%d/resume", mandates[0].ID), code: http.StatusOK, status: mandateActive},
+		{url: fmt.Sprintf("/v1/mandates/%d/resume", mandates[1].ID), code: http.StatusOK, status: mandateActive},
+		{url: fmt.Sprintf("/v1/mandates/%d/cancel", mandates[2].ID), code: http.StatusOK, status: mandateCanceled},
+		{url: fmt.Sprintf("/v1/mandates/%d/resume", mandates[2].ID), code: http.StatusBadRequest},
+		{url: "/v1/mandates/1000/pause", code: http.StatusBadRequest},
+	}
+	for _, testCase := range testCases {
+		w := request("POST", testCase.url, ``)
+		if w.Code != testCase.code {
+			t.Errorf("Response code for %s should be %d, was: %d (%s)", testCase.url, testCase.code, w.Code, w.Body)
+			continue
+		}
+		var mandate Mandate
+		if testCase.code == http.StatusOK && (json.Unmarshal(w.Body.Bytes(), &mandate) != nil || mandate.Status != testCase.status) {
+			t.Errorf("Unexpected mandate %s", w.Body)
+		}
+	}
+
+	var active []map[string]interface{}
+	if err := json.Unmarshal(request("GET", "/v1/mandates?status=active&account_id=1", ``).Body.Bytes(), &active); err != nil {
+		t.Fatal(err)
+	}
+	if len(active) != 2 || active[0]["amount"] != "70.00" || active[1]["attempts"] != 0.0 {
+		t.Errorf("Unexpected mandates %v", active)
+	}
+
+	var alice Account
+	db.First(&alice, 1)
+	if alice.Balance != 10000-7000 {
+		t.Errorf("Unexpected balance %d", alice.Balance)
+	}
+	for i, expected := range [][]string{{statusPosted, statusFailed}, {statusFailed}, {}} {
+		var payments []Payment
+		if err := json.Unmarshal(request("GET", fmt.Sprintf("/v1/payments?mandate_id=%d", mandates[i].ID), ``).Body.Bytes(), &payments); err != nil {
+			t.Fatal(err)
+		}
+		if len(payments) != 2*len(expected) {
+			t.Errorf("Unexpected payments of mandate %d: %+v", mandates[i].ID, payments)
+			continue
+		}
+		for j, status := range expected {
+			if payments[2*j].Status != status || payments[2*j].Amount != mandates[i].Amount {
+				t.Errorf("Unexpected payment %+v of mandate %d", payments[2*j], mandates[i].ID)
+			}
+		}
+	}
+}
+
+func TestRealPaymentBatches(t *testing.T) {
+	db, engine, err := functionalSetUp()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer functionalTearDown(db, engine)
+
+	request := func(method, url, payload string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, bytes.NewBufferString(payload))
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, req)
+		return w
+	}
+	for _, payload := range []string{
+		`{"mode":"some", "payments":[{"from_account":1, "amount":"10.00", "to_account":2}]}`,
+		`{"mode":"best_effort", "payments":[]}`,
+		`{"mode":"best_effort", "payments":[{"from_account":1, "amount":"10.00", "to_account":2}, {"from_account":1, "amount":"10.00", "to_account":1}]}`,
+		`{"mode":"best_effort", "payments":[{"from_account":1, "amount":"-10.00", "to_account":2}]}`,
+		`{"mode":"best_effort", "payments":[{"from_account":1, "to_account":2}]}`,
+		`{"mode":"all_or_nothing", "payments":[{"from_account":1, "amount":"10.00", "to_account":2, "quote":1}]}`,
+	} {
+		if w := request("POST", "/v1/payment-batches", payload); w.Code != http.StatusBadRequest {
+			t.Errorf("Response code for %s should be %d, was: %d (%s)", payload, http.StatusBadRequest, w.Code, w.Body)
+		}
+	}
+
+	testCases := []struct {
+		payload string
+		code    int
+		status  string
+		items   []string
+		errors  []string
+		balance Amount
+	}{
+		{
+			payload: `{"mode":"all_or_nothing", "payments":[{"from_account":1, "amount":"30.00", "to_account":2}, {"from_account":1, "amount":"80.00", "to_account":2}]}`,
+			code:    http.StatusBadRequest,
+			status:  batchFailed,
+			items:   []string{statusFailed, statusFailed},
+			errors:  []string{"Payment #1 of the batch is not possible", "Not enough balance"},
+			balance: 10000,
+		},
+		{
+			payload: `{"mode":"all_or_nothing", "payments":[{"from_account":1, "amount":"30.00", "to_account":2}, {"from_account":2, "amount":"5.00", "to_account":1}]}`,
+			code:    http.StatusCreated,
+			status:  batchCompleted,
+			items:   []string{statusPosted, statusPosted},
+			errors:  []string{"", ""},
+			balance: 10000 - 3000 + 500,
+		},
+		{
+			payload: `{"mode":"best_effort", "payments":[{"from_account":1, "amount":"50.00", "to_account":2}, {"from_account":1, "amount":"50.00", "to_account":2}, {"from_account":1, "amount":"1.00", "to_account":1000}]}`,
+			code:    http.StatusCreated,
+			status:  batchPartial,
+			items:   []string{statusPosted, statusFailed, statusFailed},
+			errors:  []string{"", "Not enough balance", "No account with ID=1000"},
+			balance: 10000 - 3000 + 500 - 5000,
+		},
+	}
+	for _, testCase := range testCases {
+		w := request("POST", "/v1/payment-batches", testCase.payload)
+		if w.Code != testCase.code {
+			t.Errorf("Response code for %s should be %d, was: %d (%s)", testCase.payload, testCase.code, w.Code, w.Body)
+			continue
+		}
+		var res struct {
+			ID    uint `json:"ID"`
+			Batch uint `json:"batch"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		if res.ID == 0 {
+			res.ID = res.Batch
+		}
+
+		var batch PaymentBatch
+		if err := json.Unmarshal(request("GET", fmt.Sprintf("/v1/payment-batches/%d", res.ID), ``).Body.Bytes(), &batch); err != nil {
+			t.Fatal(err)
+		}
+		if batch.Mode == "" || batch.Status != testCase.status || len(batch.Items) != len(testCase.items) {
+			t.Errorf("Unexpected batch %+v for %s", batch, testCase.payload)
+			continue
+		}
+		for i, item := range batch.Items {
+			if item.Position != i || item.Status != testCase.items[i] || item.Error != testCase.errors[i] {
+				t.Errorf("Unexpected item %+v of batch %d", item, batch.ID)
+			}
+			// Items which are not possible are recorded as failed payments
+			var transfer Transfer
+			if item.Error != "Payment #1 of the batch is not possible" && (db.First(&transfer, item.TransferID).Error != nil || transfer.Status != item.Status) {
+				t.Errorf("Unexpected transfer %+v of item %+v", transfer, item)
+			}
+		}
+
+		var alice Account
+		db.First(&alice, 1)
+		if alice.Balance != testCase.balance {
+			t.Errorf("Unexpected balance %d after %s", alice.Balance, testCase.payload)
+		}
+	}
+	if w := request("GET", "/v1/payment-batches/1000", ``); w.Code != http.StatusBadRequest {
+		t.Errorf("Response code should be %d, was: %d (%s)", http.StatusBadRequest, w.Code, w.Body)
+	}
+}
+
+func TestRealSplitPayments(t *testing.T) {
+	db, engine, err := functionalSetUp()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer functionalTearDown(db, engine)
+
+	carol := Account{Owner: "carol", Currency: "USD"}
+	if err := db.Create(&carol).Error; err != nil {
+		t.Fatal(err)
+	}
+	request := func(method, url, payload string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, bytes.NewBufferString(payload))
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, req)
+		return w
+	}
+	for _, payload := range []string{
+		`{"from_account":1, "amount":"10.00", "splits":[{"to_account":2, "amount":"10.00"}]}`,
+		`{"from_account":1, "splits":[{"to_account":1, "amount":"10.00"}]}`,
+		`{"from_account":1, "splits":[{"to_account":2, "amount":"-10.00"}]}`,
+		`{"from_account":1, "splits":[{"to_account":2}]}`,
+		`{"from_account":1}`,
+		// Split payments are not converted
+		`{"from_account":1, "splits":[{"to_account":2, "amount":"10.00"}, {"to_account":4, "amount":"10.00"}]}`,
+		`{"from_account":1, "splits":[{"to_account":2, "amount":"60.00"}, {"to_account":2, "amount":"50.00"}]}`,
+		`{"from_account":1, "splits":[{"to_account":2, "amount":"10.00"}], "quote":1}`,
+	} {
+		if w := request("POST", "/v1/payments", payload); w.Code != http.StatusBadRequest {
+			t.Errorf("Response code for %s should be %d, was: %d (%s)", payload, http.StatusBadRequest, w.Code, w.Body)
+		}
+	}
+	if w := request("POST", "/v1/quotes", `{"from_account":1, "splits":[{"to_account":2, "amount":"10.00"}]}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Split payments can't be quoted, got %d (%s)", w.Code, w.Body)
+	}
+
+	payload := fmt.Sprintf(`{"from_account":1, "splits":[{"to_account":2, "amount":"20.00"}, {"to_account":%d, "amount":"30.00"}]}`, carol.ID)
+	w := request("POST", "/v1/payments", payload)
+	var transfer Transfer
+	if err := json.Unmarshal(w.Body.Bytes(), &transfer); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusCreated || transfer.Status != statusPosted || len(transfer.Payments) != 3 {
+		t.Fatalf("Split payment should be made, got %d (%s)", w.Code, w.Body)
+	}
+	balances := func() (res []Amount) {
+		for _, id := range []uint{1, 2, carol.ID} {
+			var account Account
+			db.First(&account, id)
+			res = append(res, account.Balance)
+		}
+		return res
+	}
+	if b := balances(); b[0] != 10000-5000 || b[1] != 1000+2000 || b[2] != 3000 {
+		t.Errorf("Unexpected balances %v", b)
+	}
+
+	// Any leg shows the whole transfer
+	var shown Transfer
+	if err := json.Unmarshal(request("GET", fmt.Sprintf("/v1/payments/%d", transfer.Payments[2].ID), ``).Body.Bytes(), &shown); err != nil {
+		t.Fatal(err)
+	}
+	if shown.ID != transfer.ID || len(shown.Payments) != 3 {
+		t.Errorf("Unexpected transfer %+v", shown)
+	}
+
+	reverse := fmt.Sprintf("/v1/payments/%d/reverse", transfer.Payments[0].ID)
+	if w := request("POST", reverse, `{"amount":"10.00"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Split payment can't be refunded partially, got %d (%s)", w.Code, w.Body)
+	}
+	if w := request("POST", reverse, ``); w.Code != http.StatusCreated {
+		t.Errorf("Response code should be %d, was: %d (%s)", http.StatusCreated, w.Code, w.Body)
+	}
+	if b := balances(); b[0] != 10000 || b[1] != 1000 || b[2] != 0 {
+		t.Errorf("Unexpected balances %v", b)
+	}
+}
+
+func TestRealStatements(t *testing.T) {
+	db, engine, err := functionalSetUp()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer functionalTearDown(db, engine)
+
+	opts := defaultOptions()
+	opts.ApprovalThresholds = map[string]Amount{"USD": 5000}
+	engine = setupRouter(db, opts)
+
+	carol := Account{Owner: "carol", Balance: 20000, OpeningBalance: 20000, Currency: "USD"}
+	dave := Account{Owner: "dave", Currency: "USD"}
+	for _, account := range []*Account{&carol, &dave} {
+		if err := db.Create(account).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	request := func(method, url, user, payload string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, bytes.NewBufferString(payload))
+		if user != "" {
+			req.Header.Set(apiUserHeader, user)
+		}
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, req)
+		return w
+	}
+	pay := func(from, to uint, amount string) (transfer Transfer) {
+		w := request("POST", "/v1/payments", "carol", fmt.Sprintf(`{"from_account":%d, "to_account":%d, "amount":"%s"}`, from, to, amount))
+		if w.Code != http.StatusCreated {
+			t.Fatalf("Response code should be %d, was: %d (%s)", http.StatusCreated, w.Code, w.Body)
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &transfer); err != nil {
+			t.Fatal(err)
+		}
+		return transfer
+	}
+	pay(carol.ID, dave.ID, "10.00")
+	parked := pay(carol.ID, dave.ID, "60.00")
+	time.Sleep(10 * time.Millisecond)
+	middle := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	pay(dave.ID, carol.ID, "3.00")
+	// Parked payment belongs to the period it's posted in
+	if w := request("POST", fmt.Sprintf("/v1/approvals/%d/approve", parked.Approvals[0].ID), "bob", ``); w.Code != http.StatusOK {
+		t.Fatalf("Response code should be %d, was: %d (%s)", http.StatusOK, w.Code, w.Body)
+	}
+
+	url := fmt.Sprintf("/v1/accounts/%d/statement", carol.ID)
+	for _, query := range []string{
+		"?format=xml",
+		"?from=yesterday",
+		"?to=2018-02-30",
+		"?from=" + middle.UTC().Format(time.RFC3339Nano) + "&to=" + middle.UTC().Format(time.RFC3339Nano),
+		"?limit=0",
+		"?limit=1001",
+		"?cursor=first",
+		"?cursor=100",
+	} {
+		if w := request("GET", url+query, "", ``); w.Code != http.StatusBadRequest {
+			t.Errorf("Response code for %s should be %d, was: %d (%s)", query, http.StatusBadRequest, w.Code, w.Body)
+		}
+	}
+	if w := request("GET", "/v1/accounts/100/statement", "", ``); w.Code != http.StatusBadRequest {
+		t.Errorf("Response code should be %d, was: %d (%s)", http.StatusBadRequest, w.Code, w.Body)
+	}
+
+	testCases := []struct {
+		query            string
+		opening, closing Decimal
+		balances         []Decimal
+	}{
+		{query: "", opening: "200.00", closing: "133.00", balances: []Decimal{"190.00", "193.00", "133.00"}},
+		{query: "?from=2000-01-01", opening: "200.00", closing: "133.00", balances: []Decimal{"190.00", "193.00", "133.00"}},
+		{query: "?from=" + middle.UTC().Format(time.RFC3339Nano), opening: "190.00", closing: "133.00", balances: []Decimal{"193.00", "133.00"}},
+		{query: "?to=" + middle.UTC().Format(time.RFC3339Nano), opening: "200.00", closing: "190.00", balances: []Decimal{"190.00"}},
+		{query: "?to=2000-01-01", opening: "200.00", closing: "200.00"},
+	}
+	for _, testCase := range testCases {
+		w := request("GET", url+testCase.query, "", ``)
+		var statement struct {
+			OpeningBalance Decimal `json:"opening_balance"`
+			ClosingBalance Decimal `json:"closing_balance"`
+			Movements      []struct {
+				Balance Decimal `json:"balance"`
+			} `json:"movements"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &statement); err != nil {
+			t.Fatal(err)
+		}
+		var balances []Decimal
+		for _, movement := range statement.Movements {
+			balances = append(balances, movement.Balance)
+		}
+		if w.Code != http.StatusOK || statement.OpeningBalance != testCase.opening || statement.ClosingBalance != testCase.closing ||
+			fmt.Sprint(balances) != fmt.Sprint(testCase.balances) {
+			t.Errorf("Unexpected statement for %q: %d (%s)", testCase.query, w.Code, w.Body)
+		}
+	}
+
+	// Pages follow each other, balances carry over
+	var pages []string
+	query := "?limit=2"
+	for page := 0; query != ""; page++ {
+		if page > 3 {
+			t.Fatalf("Statement pagination doesn't end: %v", pages)
+		}
+		w := request("GET", url+query, "", ``)
+		var statement struct {
+			OpeningBalance Decimal `json:"opening_balance"`
+			ClosingBalance Decimal `json:"closing_balance"`
+			Movements      []struct {
+				Balance Decimal `json:"balance"`
+			} `json:"movements"`
+			NextCursor uint `json:"next_cursor"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &statement); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("Unexpected statement page: %d (%s)", w.Code, w.Body)
+		}
+		var balances []Decimal
+		for _, movement := range statement.Movements {
+			balances = append(balances, movement.Balance)
+		}
+		pages = append(pages, fmt.Sprintf("%s %v %s", statement.OpeningBalance, balances, statement.ClosingBalance))
+		query = ""
+		if statement.NextCursor != 0 {
+			query = fmt.Sprintf("?limit=2&cursor=%d", statement.NextCursor)
+		}
+	}
+	if fmt.Sprint(pages) != "[200.00 [190.00 193.00] 193.00 193.00 [133.00] 133.00]" {
+		t.Errorf("Unexpected statement pages: %v", pages)
+	}
+	w := request("GET", url+"?format=csv&limit=1", "", ``)
+	if w.Code != http.StatusOK || w.Header().Get(nextCursorHeader) == "" || len(strings.Split(strings.TrimSpace(w.Body.String()), "\n")) != 4 {
+		t.Errorf("Unexpected CSV statement page: %d %v (%s)", w.Code, w.Header(), w.Body)
+	}
+
+	// Statement is consistent with the balance
+	if err := db.First(&carol, carol.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if carol.Balance != 13300 {
+		t.Errorf("Unexpected balance %s", carol.Balance.Decimal(carol.Currency))
+	}
+
+	w = request("GET", url+"?format=csv", "", ``)
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/csv") || len(lines) != 6 ||
+		!strings.HasPrefix(lines[1], ",opening,") || !strings.HasSuffix(lines[5], ",closing,,,,,133.00,USD") {
+		t.Errorf("Unexpected CSV statement: %d (%s)", w.Code, w.Body)
+	}
+}
+
+func TestRealBalanceAsOf(t *testing.T) {
+	db, engine, err := functionalSetUp()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer functionalTearDown(db, engine)
+
+	if !db.NewScope(nil).Dialect().HasIndex("payments", "idx_payments_account_posted_at") {
+		t.Error("Payments should be indexed by account and posting time")
+	}
+	carol := Account{Owner: "carol", Balance: 20000, OpeningBalance: 20000, Currency: "USD"}
+	if err := db.Create(&carol).Error; err != nil {
+		t.Fatal(err)
+	}
+	request := func(url string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", url, nil)
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, req)
+		return w
+	}
+	var times []time.Time
+	for _, payload := range []string{
+		`{"from_account":%d, "to_account":2, "amount":"10.00"}`,
+		`{"from_account":2, "to_account":%d, "amount":"3.00"}`,
+		`{"from_account":%d, "to_account":2, "amount":"300.00"}`,
+		`{"from_account":%d, "to_account":2, "amount":"50.00"}`,
+	} {
+		time.Sleep(10 * time.Millisecond)
+		times = append(times, time.Now())
+		req, _ := http.NewRequest("POST", "/v1/payments", bytes.NewBufferString(fmt.Sprintf(payload, carol.ID)))
+		engine.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	url := fmt.Sprintf("/v1/accounts/%d/balance", carol.ID)
+	for _, query := range []string{"?as_of=31.03.2018", "?as_of=2000-01-01"} {
+		if w := request(url + query); w.Code != http.StatusBadRequest {
+			t.Errorf("Response code for %s should be %d, was: %d (%s)", query, http.StatusBadRequest, w.Code, w.Body)
+		}
+	}
+	if w := request("/v1/accounts/100/balance"); w.Code != http.StatusBadRequest {
+		t.Errorf("Response code should be %d, was: %d (%s)", http.StatusBadRequest, w.Code, w.Body)
+	}
+
+	testCases := []struct {
+		at      time.Time
+		balance Amount
+	}{
+		{at: times[0], balance: 20000},
+		{at: times[1], balance: 19000},
+		{at: times[2], balance: 19300},
+		// Failed payments don't count
+		{at: times[3], balance: 19300},
+		{at: time.Now(), balance: 14300},
+	}
+	for _, testCase := range testCases {
+		w := request(url + "?as_of=" + testCase.at.UTC().Format(time.RFC3339Nano))
+		var res struct {
+			Balance Decimal `json:"balance"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != http.StatusOK || res.Balance != testCase.balance.Decimal("USD") {
+			t.Errorf("Unexpected balance as of %s: %d (%s)", testCase.at, w.Code, w.Body)
+		}
+
+		// Summing forward from the opening balance and back from the
+		// current one agree
+		account := carol
+		if err := db.First(&account, carol.ID).Error; err != nil {
+			t.Fatal(err)
+		}
+		for _, created := range []time.Time{testCase.at, time.Date(1900, time.January, 1, 0, 0, 0, 0, time.UTC)} {
+			account.CreatedAt = created
+			if balance, err := balanceAt(db, account, testCase.at); err != nil || balance != testCase.balance {
+				t.Errorf("Unexpected balance %d as of %s (%v)", balance, testCase.at, err)
+			}
+		}
+	}
+	if w := request(url); !strings.Contains(w.Body.String(), `"balance":"143.00"`) {
+		t.Errorf("Unexpected current balance: %d (%s)", w.Code, w.Body)
+	}
+}
+
+func TestRealPaymentFilters(t *testing.T) {
+	db, engine, err := functionalSetUp()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer functionalTearDown(db, engine)
+
+	time.Sleep(10 * time.Millisecond)
+	since := time.Now()
+	for _, payload := range []string{
+		`{"from_account":1, "to_account":2, "amount":"5.00"}`,
+		`{"from_account":2, "to_account":1, "amount":"15.00"}`,
+		`{"from_account":1, "to_account":2, "amount":"12.50"}`,
+	} {
+		req, _ := http.NewRequest("POST", "/v1/payments", bytes.NewBufferString(payload))
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, req)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("Response code should be %d, was: %d (%s)", http.StatusCreated, w.Code, w.Body)
+		}
+	}
+
+	testCases := []struct {
+		query   string
+		code    int
+		amounts []Decimal
+	}{
+		{query: "direction=incoming", code: http.StatusOK, amounts: []Decimal{"15.00"}},
+		{query: "direction=outgoing&status=posted", code: http.StatusOK, amounts: []Decimal{"5.00", "12.50"}},
+		{query: "direction=sideways", code: http.StatusBadRequest},
+		{query: "min_amount=5&sort=amount", code: http.StatusOK, amounts: []Decimal{"5.00", "12.50", "15.00"}},
+		{query: "min_amount=5&max_amount=12.5&sort=-amount", code: http.StatusOK, amounts: []Decimal{"12.50", "5.00"}},
+		{query: "max_amount=1.001", code: http.StatusBadRequest},
+		{query: "max_amount=ten", code: http.StatusBadRequest},
+		{query: "counterparty=2&min_amount=12.50&sort=amount", code: http.StatusOK, amounts: []Decimal{"12.50", "15.00"}},
+		{query: "counterparty=3", code: http.StatusOK},
+		{query: "counterparty=bob", code: http.StatusBadRequest},
+		{query: "from=" + since.UTC().Format(time.RFC3339Nano) + "&sort=-created_at", code: http.StatusOK, amounts: []Decimal{"12.50", "15.00", "5.00"}},
+		{query: "to=" + since.UTC().Format(time.RFC3339Nano) + "&max_amount=1", code: http.StatusOK,
+			amounts: []Decimal{"1.00", "1.00", "1.00", "1.00", "1.00", "1.00", "1.00"}},
+		{query: "from=now", code: http.StatusBadRequest},
+		{query: "sort=id", code: http.StatusBadRequest},
+		{query: "sort=amount+DESC", code: http.StatusBadRequest},
+		{query: "sort=amount%3BDROP+TABLE+payments", code: http.StatusBadRequest},
+	}
+	for _, testCase := range testCases {
+		req, _ := http.NewRequest("GET", "/v1/payments?account_id=1&"+testCase.query, nil)
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, req)
+		if w.Code != testCase.code {
+			t.Errorf("Response code for %s should be %d, was: %d (%s)", testCase.query, testCase.code, w.Code, w.Body)
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		var payments []Payment
+		if err := json.Unmarshal(w.Body.Bytes(), &payments); err != nil {
+			t.Fatal(err)
+		}
+		var amounts []Decimal
+		for _, payment := range payments {
+			amounts = append(amounts, payment.Amount.Decimal(payment.Currency))
+		}
+		if fmt.Sprint(amounts) != fmt.Sprint(testCase.amounts) {
+			t.Errorf("Expected payments of %v for %s, got %s", testCase.amounts, testCase.query, w.Body)
+		}
+	}
+
+	// Amount range needs a currency
+	for query, code := range map[string]int{
+		"min_amount=5":                http.StatusBadRequest,
+		"min_amount=5&currency=USD":   http.StatusOK,
+		"min_amount=5&currency=XYZ":   http.StatusBadRequest,
+		"account_id=100&max_amount=5": http.StatusBadRequest,
+	} {
+		req, _ := http.NewRequest("GET", "/v1/payments?"+query, nil)
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, req)
+		if w.Code != code {
+			t.Errorf("Response code for %s should be %d, was: %d (%s)", query, code, w.Code, w.Body)
+		}
+	}
+
+	// Currency is case insensitive
+	var upper, lower []Payment
+	for query, payments := range map[string]*[]Payment{"currency=USD": &upper, "currency=usd": &lower} {
+		req, _ := http.NewRequest("GET", "/v1/payments?min_amount=5&"+query, nil)
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, req)
+		if err := json.Unmarshal(w.Body.Bytes(), payments); err != nil {
+			t.Fatalf("Unexpected response for %s: %s", query, w.Body)
+		}
+	}
+	if len(upper) == 0 || len(lower) != len(upper) {
+		t.Errorf("Unexpected payments %v for lowercase currency, expected %v", lower, upper)
+	}
+}
@@ -1,10 +1,18 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/jinzhu/gorm"
@@ -16,6 +24,35 @@ const (
 	defaultPage  = 0
 )
 
+// Statements are paginated by movements, see `GetStatement`
+const (
+	defaultStatementLimit = 100
+	maxStatementLimit     = 1000
+	nextCursorHeader      = "X-Next-Cursor"
+)
+
+// Idempotency-Key header lets clients safely retry POST /payments requests
+const (
+	idempotencyHeader    = "Idempotency-Key"
+	maxIdempotencyKeyLen = 255
+)
+
+// X-API-User header identifies API user making the request, e.g. reviewer
+const apiUserHeader = "X-API-User"
+
+// apiUser returns API user making the request, empty if unknown.
+// Header is looked up canonically, unlike with `c.GetHeader`.
+// The service doesn't authenticate requests, so the header is only as
+// trustworthy as whatever sets it: unless an authenticating proxy in front
+// of the service sets it (replacing the one sent by client), any client may
+// act as any user and separation of duties is advisory only.
+func apiUser(c *gin.Context) string {
+	return strings.TrimSpace(c.Request.Header.Get(apiUserHeader))
+}
+
+// limitExceededCode is error code of payments rejected by limits, see `Limit`
+const limitExceededCode = "limit_exceeded"
+
 // extractOffsetFromQuery extracts offset and count from query parameters
 // It waits for page argument and translate it into offset
 func extractOffsetFromQuery(c *gin.Context) (int, error) {
@@ -72,95 +109,1662 @@ func GetAccount(c *gin.Context, db *gorm.DB) {
 	}
 }
 
-// GetPayments is a handler for /payments endpoint.
-// It lists all payments by default or only those related to specified in a
-// querty strin `account_id`.
-// Writes results in JSON format.
-func GetPayments(c *gin.Context, db *gorm.DB) {
-	accountID, filterByAccount := c.GetQuery("account_id")
-	query := db
-	if filterByAccount {
-		query = db.Where("account_id = ?", accountID)
-	}
+// accountPayload is a payload for POST /accounts and PATCH /accounts/:id endpoints.
+// Balance is an opening balance and is only accepted on account creation.
+// Tier and OverdraftLimit are optional and are left intact on update unless
+// specified.
+type accountPayload struct {
+	Owner          string   `json:"owner" binding:"required"`
+	Currency       string   `json:"currency"`
+	Balance        Decimal  `json:"balance"`
+	Tier           *string  `json:"tier"`
+	OverdraftLimit *Decimal `json:"overdraft_limit"`
+}
 
-	var payments []Payment
-	if err := getObjects(c, query, &payments); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+// overdraftLimit returns overdraft limit from payload in account currency,
+// zero unless specified.
+// Returns error if limit is malformed or negative.
+func (p accountPayload) overdraftLimit(currency string) (Amount, error) {
+	if p.OverdraftLimit == nil {
+		return 0, nil
+	}
+	limit, err := p.OverdraftLimit.Amount(currency)
+	if err == nil && limit < 0 {
+		err = errors.New("Overdraft limit can't be negative")
 	}
+	return limit, err
 }
 
-// validatePaymentPayoload validates payload for /payment POST endpoint.
-// See `Payment`` struct for details. Also checks source and destination IDs.
+// validateAccountPayload validates payload for /accounts POST and PATCH endpoints.
+// Currency is only required (and allowed) for a new account.
 // Returns nil on success and error otherwise.
-func validatePaymentPayload(c *gin.Context, payment *Payment) error {
-	if err := c.BindJSON(payment); err != nil {
+func validateAccountPayload(c *gin.Context, payload *accountPayload, create bool) error {
+	if err := c.BindJSON(payload); err != nil {
 		return err
 	}
-	if payment.AccountFromID == payment.AccountToID {
-		return errors.New("Source and destination accounts are the same")
+	payload.Owner = strings.TrimSpace(payload.Owner)
+	if payload.Owner == "" {
+		return errors.New("Owner can't be empty")
+	}
+	if payload.Tier != nil {
+		*payload.Tier = strings.TrimSpace(*payload.Tier)
+	}
+	if !create {
+		if payload.Currency != "" || payload.Balance != "" {
+			return errors.New("Only owner, tier and overdraft limit can be changed")
+		}
+		return nil
+	}
+	payload.Currency = strings.ToUpper(payload.Currency)
+	if !supportedCurrency(payload.Currency) {
+		return fmt.Errorf("Unsupported currency %q", payload.Currency)
 	}
 	return nil
 }
 
-// saveObjects is helper function to write objects to a database
-// Returns nil on success, error otherwise
-func saveObjects(db *gorm.DB, objs []interface{}) error {
-	for _, obj := range objs {
-		if err := db.Save(obj).Error; err != nil {
+// CreateAccount is a handler for POST /accounts endpoint.
+// Expects owner, currency and optional opening balance. Writes created account
+// in JSON format.
+func CreateAccount(c *gin.Context, db *gorm.DB) {
+	var payload accountPayload
+	if err := validateAccountPayload(c, &payload, true); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	balance, err := payload.Balance.Amount(payload.Currency)
+	if err == nil && balance < 0 {
+		err = errors.New("Opening balance can't be negative")
+	}
+	var limit Amount
+	if err == nil {
+		limit, err = payload.overdraftLimit(payload.Currency)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	account := Account{
+		Owner:          payload.Owner,
+		Currency:       payload.Currency,
+		Balance:        balance,
+		OpeningBalance: balance,
+		OverdraftLimit: limit,
+	}
+	if payload.Tier != nil {
+		account.Tier = *payload.Tier
+	}
+	if err := db.Create(&account).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, account)
+}
+
+// UpdateAccount is a handler for PATCH /accounts/:id endpoint.
+// Only account owner, tier and overdraft limit can be changed, balance is
+// changed by payments only. Overdraft limit can't be lowered below what's
+// already used.
+func UpdateAccount(c *gin.Context, db *gorm.DB) {
+	var payload accountPayload
+	if err := validateAccountPayload(c, &payload, false); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var account Account
+	if err := inTransaction(db, func(txn *gorm.DB) error {
+		if err := forUpdate(txn).First(&account, c.Param("id")).Error; err != nil {
+			return fmt.Errorf("No account with ID=%s", c.Param("id"))
+		}
+		updates := map[string]interface{}{"owner": payload.Owner}
+		if payload.Tier != nil {
+			updates["tier"] = *payload.Tier
+		}
+		if payload.OverdraftLimit == nil {
+			return txn.Model(&account).Updates(updates).Error
+		}
+
+		limit, err := payload.overdraftLimit(account.Currency)
+		if err != nil {
+			return err
+		}
+		account.OverdraftLimit = limit
+		if account.Available() < 0 {
+			return errors.New("Overdraft limit is below the used one")
+		}
+		updates["overdraft_limit"] = limit
+		if err := txn.Model(&account).Updates(updates).Error; err != nil {
+			return err
+		}
+		// Version bump makes concurrent optimistic transfers checked against
+		// the old limit fail
+		return saveAccount(txn, &account)
+	}); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, account)
+}
+
+// CloseAccount is a handler for DELETE /accounts/:id endpoint.
+// Account is soft deleted so its payments history is kept, but it can no longer
+// take part in transfers. Accounts with non-zero balance can't be closed.
+func CloseAccount(c *gin.Context, db *gorm.DB) {
+	if err := inTransaction(db, func(txn *gorm.DB) error {
+		var account Account
+		if err := forUpdate(txn).First(&account, c.Param("id")).Error; err != nil {
+			return fmt.Errorf("No account with ID=%s", c.Param("id"))
+		}
+		if account.Balance != 0 {
+			return errors.New("Account balance is not zero")
+		}
+		// Version bump makes concurrent optimistic transfers to the account fail
+		if err := saveAccount(txn, &account); err != nil {
 			return err
 		}
+		return txn.Delete(&account).Error
+	}); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{})
+}
+
+// Statement formats, see `GetStatement`
+const (
+	formatJSON = "json"
+	formatCSV  = "csv"
+)
+
+// queryTime parses optional query parameter with name as RFC 3339 time or
+// a date, which means midnight UTC. Returns zero time if it's absent, error
+// if it's not valid.
+func queryTime(c *gin.Context, name string) (time.Time, error) {
+	value := c.Query(name)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("Invalid %s %q, expected RFC 3339 time or date", name, value)
+}
+
+// GetStatement is a handler for /accounts/:id/statement endpoint.
+// Writes statement of account (see `Statement`) for period between `from`
+// and `to` query parameters, both optional: since the account was opened and
+// until now by default. Statements of closed accounts are available too.
+// Movements are paginated: at most `limit` of them following `cursor` one
+// (the last movement of the previous page) are written, see `accountStatement`.
+// Writes results in JSON format, or in CSV if `format` query parameter is
+// `csv`, then the next cursor is in X-Next-Cursor header.
+func GetStatement(c *gin.Context, db *gorm.DB) {
+	format := c.DefaultQuery("format", formatJSON)
+	if format != formatJSON && format != formatCSV {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Unknown format %q", format)})
+		return
+	}
+	from, err := queryTime(c, "from")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	to, err := queryTime(c, "to")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if to.IsZero() {
+		to = time.Now().UTC()
+	}
+	if !from.Before(to) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Statement period should end after it starts"})
+		return
+	}
+	limit, err := strconv.ParseUint(c.DefaultQuery("limit", strconv.Itoa(defaultStatementLimit)), 10, 64)
+	if err != nil || limit == 0 || limit > maxStatementLimit {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Limit should be between 1 and %d", maxStatementLimit)})
+		return
+	}
+	cursor, err := strconv.ParseUint(c.DefaultQuery("cursor", "0"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid cursor %q", c.Query("cursor"))})
+		return
+	}
+
+	var statement Statement
+	if err := inTransaction(db, func(txn *gorm.DB) error {
+		var account Account
+		if err := txn.Unscoped().First(&account, c.Param("id")).Error; err != nil {
+			return fmt.Errorf("No account with ID=%s", c.Param("id"))
+		}
+		statement, err = accountStatement(txn, account, from, to, uint(cursor), int(limit))
+		return err
+	}); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if format == formatJSON {
+		c.JSON(http.StatusOK, statement)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := csv.NewWriter(&buf).WriteAll(statement.CSV()); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if statement.NextCursor != 0 {
+		c.Header(nextCursorHeader, strconv.FormatUint(uint64(statement.NextCursor), 10))
+	}
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=statement-%d.csv", statement.AccountID))
+	c.Data(http.StatusOK, "text/csv; charset=utf-8", buf.Bytes())
+}
+
+// GetBalance is a handler for /accounts/:id/balance endpoint.
+// Writes balance of account at time in `as_of` query parameter (RFC 3339 time
+// or date, now by default) computed from payments history, see `balanceAt`.
+// Balances of closed accounts are available too, but not balances before the
+// account was opened.
+func GetBalance(c *gin.Context, db *gorm.DB) {
+	at, err := queryTime(c, "as_of")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if at.IsZero() {
+		at = time.Now().UTC()
+	}
+
+	var account Account
+	var balance Amount
+	if err := inTransaction(db, func(txn *gorm.DB) error {
+		if err := txn.Unscoped().First(&account, c.Param("id")).Error; err != nil {
+			return fmt.Errorf("No account with ID=%s", c.Param("id"))
+		}
+		if at.Before(account.CreatedAt) {
+			return fmt.Errorf("Account was opened at %s", account.CreatedAt.UTC().Format(time.RFC3339))
+		}
+		balance, err = balanceAt(txn, account, at)
+		return err
+	}); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"account":  account.ID,
+		"currency": account.Currency,
+		"as_of":    at.UTC(),
+		"balance":  balance.Decimal(account.Currency),
+	})
+}
+
+// GetDiscrepancies is a handler for /reconciliation endpoint.
+// It reconciles account balances against the journal and lists accounts
+// whose balances don't match. Allows for pagination (see extractOffsetFromQuery()).
+// Writes results in JSON format.
+func GetDiscrepancies(c *gin.Context, db *gorm.DB) {
+	offset, err := extractOffsetFromQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	discrepancies, err := findDiscrepancies(db, offset)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	res := make([]gin.H, 0, len(discrepancies))
+	for _, d := range discrepancies {
+		res = append(res, gin.H{
+			"account":         d.AccountID,
+			"currency":        d.Currency,
+			"balance":         d.Balance.Decimal(d.Currency),
+			"journal_balance": d.JournalBalance.Decimal(d.Currency),
+		})
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+// GetRates is a handler for /admin/rates endpoint.
+// It lists all exchange rates by default or only those converting `from`
+// and/or `to` currencies specified in a query string. Allows for pagination
+// (see extractOffsetFromQuery()).
+// Writes results in JSON format.
+func GetRates(c *gin.Context, db *gorm.DB) {
+	query := db.Order("id")
+	if from, ok := c.GetQuery("from"); ok {
+		query = query.Where("from_currency = ?", strings.ToUpper(from))
+	}
+	if to, ok := c.GetQuery("to"); ok {
+		query = query.Where("to_currency = ?", strings.ToUpper(to))
+	}
+
+	var rates []ExchangeRate
+	if err := getObjects(c, query, &rates); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	}
+}
+
+// rateRequest is an exchange rate in payload for POST /admin/rates endpoint.
+// Rate is valid since it's loaded unless ValidFrom is specified.
+type rateRequest struct {
+	From       string     `json:"from"`
+	To         string     `json:"to"`
+	Rate       Decimal    `json:"rate"`
+	ValidFrom  *time.Time `json:"valid_from"`
+	ValidUntil *time.Time `json:"valid_until"`
+}
+
+// validateRatesPayload validates payload for /admin/rates POST endpoint, which
+// is a list of rates (see `rateRequest`).
+// Returns nil on success and error otherwise.
+func validateRatesPayload(c *gin.Context, rates *[]rateRequest) error {
+	if err := c.BindJSON(rates); err != nil {
+		return err
+	}
+	if len(*rates) == 0 {
+		return errors.New("No rates to load")
+	}
+	now := time.Now().UTC()
+	for i := range *rates {
+		rate := &(*rates)[i]
+		rate.From, rate.To = strings.ToUpper(rate.From), strings.ToUpper(rate.To)
+		if !supportedCurrency(rate.From) || !supportedCurrency(rate.To) {
+			return fmt.Errorf("Rate #%d: unsupported currency", i)
+		}
+		if rate.From == rate.To {
+			return fmt.Errorf("Rate #%d: currencies are the same", i)
+		}
+		if !rate.Rate.Positive() {
+			return fmt.Errorf("Rate #%d: rate should be positive", i)
+		}
+		if rate.ValidFrom == nil {
+			rate.ValidFrom = &now
+		}
+		if rate.ValidUntil != nil && !rate.ValidUntil.After(*rate.ValidFrom) {
+			return fmt.Errorf("Rate #%d: rate should be valid until after it's valid from", i)
+		}
+		validFrom := rate.ValidFrom.UTC()
+		rate.ValidFrom = &validFrom
+		if rate.ValidUntil != nil {
+			validUntil := rate.ValidUntil.UTC()
+			rate.ValidUntil = &validUntil
+		}
 	}
 	return nil
 }
 
-// Submit is a handler for POST /payment endpoint.
-// It's the only write endpoint. Database transaction is used to guarantee integrity.
-// For non-sqlite database engines it uses database `check` constraint to ensure
-// positive balance (second check for concurrent transactions).
-func Submit(c *gin.Context, db *gorm.DB) {
-	var payment Payment
-	var sourceAccount, destAccount Account
+// LoadRates is a handler for POST /admin/rates endpoint.
+// It loads list of exchange rates, either all of them or none.
+// Writes loaded rates in JSON format.
+func LoadRates(c *gin.Context, db *gorm.DB) {
+	var payload []rateRequest
+	if err := validateRatesPayload(c, &payload); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
-	if err := validatePaymentPayload(c, &payment); err != nil {
+	rates := make([]ExchangeRate, 0, len(payload))
+	if err := inTransaction(db, func(txn *gorm.DB) error {
+		for _, rate := range payload {
+			loaded := ExchangeRate{
+				FromCurrency: rate.From,
+				ToCurrency:   rate.To,
+				Rate:         rate.Rate,
+				ValidFrom:    *rate.ValidFrom,
+				ValidUntil:   rate.ValidUntil,
+			}
+			if err := txn.Create(&loaded).Error; err != nil {
+				return err
+			}
+			rates = append(rates, loaded)
+		}
+		return nil
+	}); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	c.JSON(http.StatusCreated, rates)
+}
 
-	txn := db.Begin()
-	if err := func() error {
-		sourceID, destID := payment.AccountFromID, payment.AccountToID
-		if err := db.First(&sourceAccount, sourceID).Error; err != nil {
-			return fmt.Errorf("No account with ID=%d", sourceID)
+// GetFees is a handler for /admin/fees endpoint.
+// It lists all fee schedules by default or only those of `currency`
+// specified in a query string. Allows for pagination (see extractOffsetFromQuery()).
+// Writes results in JSON format.
+func GetFees(c *gin.Context, db *gorm.DB) {
+	query := db.Order("id")
+	if currency, ok := c.GetQuery("currency"); ok {
+		query = query.Where("currency = ?", strings.ToUpper(currency))
+	}
+
+	var schedules []FeeSchedule
+	if err := getObjects(c, query, &schedules); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	}
+}
+
+// feeRequest is a fee schedule in payload for POST /admin/fees endpoint,
+// see `FeeSchedule`.
+type feeRequest struct {
+	Currency   string  `json:"currency"`
+	Tier       string  `json:"tier"`
+	FromAmount Decimal `json:"from_amount"`
+	Flat       Decimal `json:"flat"`
+	Percent    Decimal `json:"percent"`
+	Min        Decimal `json:"min"`
+	Max        Decimal `json:"max"`
+}
+
+// Schedule converts request into fee schedule.
+// Returns error if amounts are not valid, nil otherwise.
+func (r feeRequest) Schedule() (schedule FeeSchedule, err error) {
+	schedule = FeeSchedule{
+		Currency: strings.ToUpper(r.Currency),
+		Tier:     strings.TrimSpace(r.Tier),
+		Percent:  r.Percent,
+	}
+	if !supportedCurrency(schedule.Currency) {
+		return schedule, fmt.Errorf("Unsupported currency %q", r.Currency)
+	}
+	for _, amount := range []struct {
+		value Decimal
+		out   *Amount
+	}{
+		{r.FromAmount, &schedule.FromAmount},
+		{r.Flat, &schedule.Flat},
+		{r.Min, &schedule.Min},
+		{r.Max, &schedule.Max},
+	} {
+		if *amount.out, err = amount.value.Amount(schedule.Currency); err != nil {
+			return schedule, err
 		}
-		if err := db.First(&destAccount, destID).Error; err != nil {
-			return fmt.Errorf("No account with ID=%d", destID)
+		if *amount.out < 0 {
+			return schedule, errors.New("Amounts can't be negative")
 		}
+	}
+	if strings.HasPrefix(string(r.Percent), "-") {
+		return schedule, errors.New("Percent can't be negative")
+	}
+	if schedule.Max > 0 && schedule.Max < schedule.Min {
+		return schedule, errors.New("Max fee is less than min fee")
+	}
+	return schedule, nil
+}
 
-		if err := payment.Transfer(&sourceAccount, &destAccount); err != nil {
-			return err
+// LoadFees is a handler for POST /admin/fees endpoint.
+// It loads list of fee schedules (see `feeRequest`), either all of them or none.
+// Writes loaded schedules in JSON format.
+func LoadFees(c *gin.Context, db *gorm.DB) {
+	var payload []feeRequest
+	if err := c.BindJSON(&payload); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(payload) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No fee schedules to load"})
+		return
+	}
+
+	schedules := make([]FeeSchedule, 0, len(payload))
+	for i, request := range payload {
+		schedule, err := request.Schedule()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Fee schedule #%d: %s", i, err)})
+			return
+		}
+		schedules = append(schedules, schedule)
+	}
+	if err := inTransaction(db, func(txn *gorm.DB) error {
+		for i := range schedules {
+			if err := txn.Create(&schedules[i]).Error; err != nil {
+				return err
+			}
 		}
-		fromPayment, toPayment := payment.Outgoing(), payment.Incoming()
+		return nil
+	}); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, schedules)
+}
 
-		if err := saveObjects(db, []interface{}{
-			&sourceAccount,
-			&destAccount,
-			&fromPayment,
-			&toPayment,
-		}); err != nil {
-			return err
+// DeleteFee is a handler for DELETE /admin/fees/:id endpoint.
+// Deleted fee schedule no longer applies to payments.
+func DeleteFee(c *gin.Context, db *gorm.DB) {
+	var schedule FeeSchedule
+	if err := db.First(&schedule, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("No fee schedule with ID=%s", c.Param("id"))})
+		return
+	}
+	if err := db.Delete(&schedule).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{})
+}
+
+// GetLimits is a handler for GET /admin/limits endpoint.
+// It lists payment limits, optionally filtered by `account_id` and `owner`
+// query parameters. Allows for pagination.
+// Writes results in JSON format.
+func GetLimits(c *gin.Context, db *gorm.DB) {
+	query := db.Order("id")
+	if accountID, ok := c.GetQuery("account_id"); ok {
+		query = query.Where("account_id = ?", accountID)
+	}
+	if owner, ok := c.GetQuery("owner"); ok {
+		query = query.Where("owner = ?", owner)
+	}
+
+	var limits []Limit
+	if err := getObjects(c, query, &limits); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	}
+}
+
+// limitRequest is a limit in payload for POST /admin/limits endpoint, see
+// `Limit`. It's either limit of account or limit of owner accounts in
+// currency.
+type limitRequest struct {
+	AccountID     uint    `json:"account"`
+	Owner         string  `json:"owner"`
+	Currency      string  `json:"currency"`
+	MaxAmount     Decimal `json:"max_amount"`
+	DailyAmount   Decimal `json:"daily_amount"`
+	MonthlyAmount Decimal `json:"monthly_amount"`
+	HourlyCount   int     `json:"hourly_count"`
+}
+
+// Limit converts request into limit. Account limit gets currency of
+// the account.
+// Returns error if request is not valid, nil otherwise.
+func (r limitRequest) Limit(db *gorm.DB) (limit Limit, err error) {
+	limit = Limit{
+		AccountID:   r.AccountID,
+		Owner:       strings.TrimSpace(r.Owner),
+		Currency:    strings.ToUpper(r.Currency),
+		HourlyCount: r.HourlyCount,
+	}
+	if (limit.AccountID == 0) == (limit.Owner == "") {
+		return limit, errors.New("Either account or owner should be set")
+	}
+	if limit.AccountID != 0 {
+		var account Account
+		if err := db.First(&account, limit.AccountID).Error; err != nil {
+			return limit, fmt.Errorf("No account with ID=%d", limit.AccountID)
+		}
+		if limit.Currency != "" && limit.Currency != account.Currency {
+			return limit, errors.New("Different currencies")
+		}
+		limit.Currency = account.Currency
+	}
+	if !supportedCurrency(limit.Currency) {
+		return limit, fmt.Errorf("Unsupported currency %q", r.Currency)
+	}
+	for _, amount := range []struct {
+		value Decimal
+		out   *Amount
+	}{
+		{r.MaxAmount, &limit.MaxAmount},
+		{r.DailyAmount, &limit.DailyAmount},
+		{r.MonthlyAmount, &limit.MonthlyAmount},
+	} {
+		if *amount.out, err = amount.value.Amount(limit.Currency); err != nil {
+			return limit, err
+		}
+		if *amount.out < 0 {
+			return limit, errors.New("Amounts can't be negative")
 		}
+	}
+	if limit.HourlyCount < 0 {
+		return limit, errors.New("Hourly count can't be negative")
+	}
+	if limit.MaxAmount == 0 && limit.DailyAmount == 0 && limit.MonthlyAmount == 0 && limit.HourlyCount == 0 {
+		return limit, errors.New("Limit doesn't restrict anything")
+	}
+	return limit, nil
+}
+
+// LoadLimits is a handler for POST /admin/limits endpoint.
+// It loads list of payment limits (see `limitRequest`), either all of them
+// or none. All limits of account and its owner apply to payments.
+// Writes loaded limits in JSON format.
+func LoadLimits(c *gin.Context, db *gorm.DB) {
+	var payload []limitRequest
+	if err := c.BindJSON(&payload); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(payload) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No limits to load"})
+		return
+	}
 
+	limits := make([]Limit, 0, len(payload))
+	for i, request := range payload {
+		limit, err := request.Limit(db)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Limit #%d: %s", i, err)})
+			return
+		}
+		limits = append(limits, limit)
+	}
+	if err := inTransaction(db, func(txn *gorm.DB) error {
+		for i := range limits {
+			if err := txn.Create(&limits[i]).Error; err != nil {
+				return err
+			}
+		}
 		return nil
-	}(); err != nil {
-		txn.Rollback()
+	}); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-	} else {
-		// We still can fail here: transaction can fail even if previous
-		// programmatic balance check succeeds.
-		if err := txn.Commit().Error; err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		} else {
-			c.JSON(http.StatusOK, gin.H{})
+		return
+	}
+	c.JSON(http.StatusCreated, limits)
+}
+
+// DeleteLimit is a handler for DELETE /admin/limits/:id endpoint.
+// Deleted limit no longer applies to payments.
+func DeleteLimit(c *gin.Context, db *gorm.DB) {
+	var limit Limit
+	if err := db.First(&limit, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("No limit with ID=%s", c.Param("id"))})
+		return
+	}
+	if err := db.Delete(&limit).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{})
+}
+
+// paymentSorts maps `sort` query parameter of payments listing to order of
+// payments, so only whitelisted columns get into queries. Leading `-` means
+// descending order.
+var paymentSorts = map[string]string{
+	"created_at":  "payments.created_at, payments.id",
+	"-created_at": "payments.created_at DESC, payments.id DESC",
+	"amount":      "payments.amount, payments.id",
+	"-amount":     "payments.amount DESC, payments.id DESC",
+}
+
+// filterPayments applies filters and sort order of payments listing from
+// query parameters to query, see `GetPayments`.
+// Returns error if a parameter is not valid.
+func filterPayments(c *gin.Context, db *gorm.DB) (*gorm.DB, error) {
+	query := db
+	accountID, filterByAccount := c.GetQuery("account_id")
+	if filterByAccount {
+		query = query.Where("payments.account_id = ?", accountID)
+	}
+	if status, ok := c.GetQuery("status"); ok {
+		if !knownStatus(status) {
+			return nil, fmt.Errorf("Unknown status %q", status)
 		}
+		query = query.Where("payments.status = ?", status)
+	}
+	if mandateID, ok := c.GetQuery("mandate_id"); ok {
+		query = query.Where("payments.transfer_id IN (SELECT id FROM transfers WHERE mandate_id = ?)", mandateID)
+	}
+	if direction, ok := c.GetQuery("direction"); ok {
+		if direction != incoming && direction != outgoing {
+			return nil, fmt.Errorf("Unknown direction %q", direction)
+		}
+		query = query.Where("payments.direction = ?", direction)
+	}
+	if value, ok := c.GetQuery("counterparty"); ok {
+		counterparty, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid counterparty %q", value)
+		}
+		query = query.Where("payments.account_to_id = ? OR payments.account_from_id = ?", counterparty, counterparty)
+	}
+
+	for _, bound := range []struct {
+		name, condition string
+	}{
+		{"from", "payments.created_at >= ?"},
+		{"to", "payments.created_at < ?"},
+	} {
+		at, err := queryTime(c, bound.name)
+		if err != nil {
+			return nil, err
+		}
+		if !at.IsZero() {
+			query = query.Where(bound.condition, at.UTC())
+		}
+	}
+
+	minAmount, filterByMin := c.GetQuery("min_amount")
+	maxAmount, filterByMax := c.GetQuery("max_amount")
+	if filterByMin || filterByMax {
+		// Amounts are in minor units of payment currency
+		currency, ok := c.GetQuery("currency")
+		if ok {
+			currency = strings.ToUpper(currency)
+			if !supportedCurrency(currency) {
+				return nil, fmt.Errorf("Unsupported currency %q", currency)
+			}
+		} else if filterByAccount {
+			var account Account
+			if err := db.Unscoped().First(&account, accountID).Error; err != nil {
+				return nil, fmt.Errorf("No account with ID=%s", accountID)
+			}
+			currency = account.Currency
+		}
+		if currency == "" {
+			return nil, errors.New("Amount range needs currency or account_id")
+		}
+		query = query.Where("payments.currency = ?", currency)
+		for _, bound := range []struct {
+			value     string
+			ok        bool
+			condition string
+		}{
+			{minAmount, filterByMin, "payments.amount >= ?"},
+			{maxAmount, filterByMax, "payments.amount <= ?"},
+		} {
+			if !bound.ok {
+				continue
+			}
+			amount, err := Decimal(bound.value).Amount(currency)
+			if err != nil {
+				return nil, err
+			}
+			query = query.Where(bound.condition, amount)
+		}
+	}
+
+	if value, ok := c.GetQuery("sort"); ok {
+		order, known := paymentSorts[value]
+		if !known {
+			return nil, fmt.Errorf("Unknown sort order %q", value)
+		}
+		query = query.Order(order)
+	}
+	return query, nil
+}
+
+// GetPayments is a handler for /payments endpoint.
+// It lists all payments by default or only those matching filters in a query
+// string: `account_id`, `status`, `mandate_id`, `direction`, `counterparty`
+// account, creation time between `from` and `to`, amount between `min_amount`
+// and `max_amount` (in `currency` or of `account_id` account). Payments are
+// ordered by `sort` query parameter, see `paymentSorts`.
+// Writes results in JSON format.
+func GetPayments(c *gin.Context, db *gorm.DB) {
+	query, err := filterPayments(c, db)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var payments []Payment
+	if err := getObjects(c, query, &payments); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	}
+}
+
+// validatePaymentPayoload validates payload for /payment POST endpoint.
+// See `PaymentRequest` struct for details. Also checks source and destination IDs.
+// Returns nil on success and error otherwise.
+func validatePaymentPayload(c *gin.Context, payment *PaymentRequest) error {
+	if err := c.BindJSON(payment); err != nil {
+		return err
+	}
+	if len(payment.Splits) > 0 {
+		return validateSplits(payment)
+	}
+	if payment.AccountToID == 0 || payment.Amount == "" {
+		return errors.New("to_account and amount are required")
+	}
+	if payment.AccountFromID == payment.AccountToID {
+		return errors.New("Source and destination accounts are the same")
+	}
+	if !payment.Amount.Positive() {
+		return errors.New("Amount should be positive")
+	}
+	return nil
+}
+
+// validateSplits validates destinations of split payment, see `Split`.
+// Returns nil on success and error otherwise.
+func validateSplits(payment *PaymentRequest) error {
+	if payment.AccountToID != 0 || payment.Amount != "" {
+		return errors.New("Split payment can't have to_account and amount")
+	}
+	if len(payment.Splits) > maxSplits {
+		return fmt.Errorf("Split payment can have up to %d splits", maxSplits)
+	}
+	for i, split := range payment.Splits {
+		switch {
+		case split.AccountToID == 0 || split.Amount == "":
+			return fmt.Errorf("Split #%d: to_account and amount are required", i)
+		case split.AccountToID == payment.AccountFromID:
+			return fmt.Errorf("Split #%d: Source and destination accounts are the same", i)
+		case !split.Amount.Positive():
+			return fmt.Errorf("Split #%d: Amount should be positive", i)
+		}
+	}
+	return nil
+}
+
+// inTransaction runs fn inside a database transaction. Transaction is rolled
+// back if fn fails and committed otherwise.
+// Returns fn or commit error, nil on success.
+func inTransaction(db *gorm.DB, fn func(txn *gorm.DB) error) error {
+	txn := db.Begin()
+	if err := txn.Error; err != nil {
+		return err
+	}
+	if err := fn(txn); err != nil {
+		txn.Rollback()
+		return err
+	}
+	return txn.Commit().Error
+}
+
+// requestHash returns a fingerprint of a decoded request payload. It's used to
+// detect that an idempotency key is reused for a different request.
+func requestHash(payload interface{}) (string, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// replayIdempotentRequest looks up stored response for idempotency key of
+// the requester and writes it into http response.
+// Returns true if response was written (either replayed or rejected because
+// of different request fingerprint), false if key is not known yet.
+func replayIdempotentRequest(c *gin.Context, db *gorm.DB, key IdempotencyKey) bool {
+	if key.Key == "" {
+		return false
+	}
+	var stored IdempotencyKey
+	if err := db.Where(map[string]interface{}{"requester": key.Requester, "key": key.Key}).First(&stored).Error; err != nil {
+		return false
+	}
+	if stored.RequestHash != key.RequestHash {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error": fmt.Sprintf("%s was already used for a different request", idempotencyHeader),
+		})
+	} else {
+		c.Data(stored.ResponseCode, "application/json; charset=utf-8", []byte(stored.ResponseBody))
+	}
+	return true
+}
+
+// saveIdempotentResponse stores response with code of request made with
+// idempotency key (if any), see `replayIdempotentRequest`. Successful
+// response is stored within the transaction making the payment.
+func saveIdempotentResponse(txn *gorm.DB, key IdempotencyKey, code int, response interface{}) error {
+	if key.Key == "" {
+		return nil
+	}
+	body, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+	key.ResponseCode, key.ResponseBody = code, string(body)
+	return txn.Create(&key).Error
+}
+
+// schedulePaymentRequest schedules payment requested from POST /payments with
+// `execute_at`, see `ScheduledPayment`. Idempotency key is handled the same
+// way as for immediate payments.
+// Writes created scheduled payment in JSON format.
+func schedulePaymentRequest(c *gin.Context, db *gorm.DB, request PaymentRequest, key IdempotencyKey) {
+	scheduled, err := schedulePayment(db, request)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := inTransaction(db, func(txn *gorm.DB) error {
+		if err := txn.Create(&scheduled).Error; err != nil {
+			return err
+		}
+		return saveIdempotentResponse(txn, key, http.StatusCreated, scheduled)
+	}); err != nil {
+		if replayIdempotentRequest(c, db, key) {
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, scheduled)
+}
+
+// GetPayment is a handler for /payments/:id endpoint.
+// It looks up transfer of the payment with `id` and writes it in JSON format,
+// with both its legs and status history.
+func GetPayment(c *gin.Context, db *gorm.DB) {
+	var payment Payment
+	if err := db.First(&payment, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("No payment with ID=%s", c.Param("id"))})
+		return
+	}
+	// Payments made before the journal don't belong to any transfer
+	transfer := Transfer{Status: payment.Status, Payments: []Payment{payment}}
+	if payment.TransferID != 0 {
+		if err := db.Preload("Payments").Preload("Transitions").Preload("Screenings").Preload("Reviews").Preload("Approvals").First(&transfer, payment.TransferID).Error; err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("No transfer with ID=%d", payment.TransferID)})
+			return
+		}
+	}
+	c.JSON(http.StatusOK, transfer)
+}
+
+// GetTransfer is a handler for /transfers/:id endpoint.
+// It writes transfer with `id` in JSON format, with both its legs (if any)
+// and status history. Transfers rejected before they got legs (e.g. to
+// unknown account) can only be looked up this way.
+func GetTransfer(c *gin.Context, db *gorm.DB) {
+	var transfer Transfer
+	if err := db.Preload("Payments").Preload("Transitions").Preload("Screenings").Preload("Reviews").Preload("Approvals").First(&transfer, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("No transfer with ID=%s", c.Param("id"))})
+		return
+	}
+	c.JSON(http.StatusOK, transfer)
+}
+
+// Submit is a handler for POST /payment endpoint.
+// Database transaction is used to guarantee integrity. Concurrent transfers
+// from the same account are either serialized by row locks or retried
+// on version conflict (see `Options.Concurrency`). For non-sqlite database
+// engines it also uses database `check` constraint to ensure positive balance.
+// If `Idempotency-Key` header is present, response is stored along with the
+// payments in the same transaction (or with the failed transfer if payment is
+// not possible) and replayed for retries of the same request by the same
+// API user, see `IdempotencyKey`.
+// X-API-User header identifies maker of payments which need approval, see
+// `Approval`. Payment with `execute_at` is scheduled to be made later instead,
+// see `ScheduledPayment`.
+// Writes created transfer with both its legs (or scheduled payment) in JSON
+// format.
+func Submit(c *gin.Context, db *gorm.DB, opts Options) {
+	var request PaymentRequest
+
+	if err := validatePaymentPayload(c, &request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	request.Maker = apiUser(c)
+
+	key := IdempotencyKey{Requester: request.Maker, Key: c.GetHeader(idempotencyHeader)}
+	if len(key.Key) > maxIdempotencyKeyLen {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%s is too long", idempotencyHeader)})
+		return
+	}
+	hash, err := requestHash(request)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	key.RequestHash = hash
+	if replayIdempotentRequest(c, db, key) {
+		return
+	}
+	if request.ExecuteAt != nil {
+		schedulePaymentRequest(c, db, request, key)
+		return
+	}
+
+	// attempt keeps transfer legs (if it got that far) to record failure,
+	// it's the created transfer on success
+	var attempt Transfer
+	transfer := func(txn *gorm.DB) (err error) {
+		if attempt, err = makeTransfer(txn, opts, request); err != nil {
+			return err
+		}
+		return saveIdempotentResponse(txn, key, http.StatusCreated, attempt)
+	}
+
+	// We still can fail on commit: transaction can fail even if previous
+	// programmatic balance check succeeds.
+	if err := runTransfer(db, opts, transfer); err != nil {
+		// Concurrent request with the same key could win the race,
+		// its response is replayed then.
+		if replayIdempotentRequest(c, db, key) {
+			return
+		}
+		res := failureResponse(db, attempt, err)
+		// Failure is stored too, so retries don't make the payment after
+		// all, unless it's worth retrying
+		if err != errVersionConflict {
+			if err := saveIdempotentResponse(db, key, http.StatusBadRequest, res); err != nil && replayIdempotentRequest(c, db, key) {
+				return
+			}
+		}
+		c.JSON(http.StatusBadRequest, res)
+		return
+	}
+	c.JSON(http.StatusCreated, attempt)
+}
+
+// failureResponse records rejected transfer attempt as failed (see
+// `recordFailure`) and returns error response with failed transfer ID.
+// Limit violations are marked with limitExceededCode.
+func failureResponse(db *gorm.DB, attempt Transfer, err error) gin.H {
+	res := gin.H{"error": err.Error()}
+	if _, ok := err.(limitError); ok {
+		res["code"] = limitExceededCode
+	}
+	if failed, ferr := recordFailure(db, attempt, err.Error()); ferr != nil {
+		log.Printf("Can't record failed payment: %s", ferr)
+	} else {
+		res["transfer"] = failed.ID
+	}
+	return res
+}
+
+// CreateQuote is a handler for POST /quotes endpoint.
+// Expects the same payload as POST /payments endpoint (see `PaymentRequest`).
+// Quote locks exchange rate and fee of the payment for a while
+// (see `Options.QuoteTTL`), payment made with the quote gets exactly them.
+// Writes created quote in JSON format.
+func CreateQuote(c *gin.Context, db *gorm.DB, opts Options) {
+	var request PaymentRequest
+	if err := validatePaymentPayload(c, &request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if request.QuoteID != 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Quote can't be made for a quote"})
+		return
+	}
+	if request.ExecuteAt != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Quotes can't be made for scheduled payments"})
+		return
+	}
+	if len(request.Splits) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Quotes can't be made for split payments"})
+		return
+	}
+
+	quote, err := makeQuote(db, opts, request)
+	if err == nil {
+		err = db.Create(&quote).Error
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, quote)
+}
+
+// ReversalRequest is an optional payload for POST /payments/:id/reverse endpoint.
+// Without amount the whole amount left to refund is refunded.
+type ReversalRequest struct {
+	Amount Decimal `json:"amount"`
+}
+
+// ReversePayment is a handler for POST /payments/:id/reverse endpoint.
+// It refunds transfer of the payment with `id` by a compensating transfer
+// linked to it, fully or partially. Refunds can't exceed transfer amount and
+// destination account should have enough balance for the refund. Once fully
+// refunded transfer becomes reversed.
+// Writes refund transfer in JSON format.
+func ReversePayment(c *gin.Context, db *gorm.DB, opts Options) {
+	var request ReversalRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.BindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if request.Amount != "" && !request.Amount.Positive() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Amount should be positive"})
+		return
+	}
+
+	// attempt keeps refund legs (if it got that far) to record failure
+	var attempt Transfer
+	reverse := func(txn *gorm.DB) error {
+		attempt = Transfer{}
+		var payment Payment
+		if err := txn.First(&payment, c.Param("id")).Error; err != nil {
+			return fmt.Errorf("No payment with ID=%s", c.Param("id"))
+		}
+		if payment.TransferID == 0 {
+			return errors.New("Payments made before the journal can't be refunded")
+		}
+		// Lock on transfer serializes concurrent refunds of it
+		var original Transfer
+		if err := forUpdate(txn).Preload("Payments").First(&original, payment.TransferID).Error; err != nil {
+			return fmt.Errorf("No transfer with ID=%d", payment.TransferID)
+		}
+
+		refunded, err := refundedAmount(txn, original.ID)
+		if err != nil {
+			return err
+		}
+		total, currency := original.Total()
+		amount := total - refunded
+		if request.Amount != "" {
+			if amount, err = request.Amount.Amount(currency); err != nil {
+				return err
+			}
+		}
+		if attempt, err = original.Reversal(amount, refunded); err != nil {
+			return err
+		}
+
+		ids := make([]uint, 0, len(attempt.Payments))
+		for _, leg := range attempt.Payments {
+			ids = append(ids, leg.AccountID)
+		}
+		accounts, err := loadAccounts(txn, opts, ids...)
+		if err != nil {
+			return err
+		}
+		if err := attempt.Apply(accounts); err != nil {
+			return err
+		}
+		if err := postTransfer(txn, &attempt, accounts); err != nil {
+			return err
+		}
+
+		if refunded+amount < total {
+			return nil
+		}
+		if err := original.SetStatus(statusReversed, fmt.Sprintf("Refunded by transfer ID=%d", attempt.ID)); err != nil {
+			return err
+		}
+		return saveStatus(txn, &original)
+	}
+
+	if err := runTransfer(db, opts, reverse); err != nil {
+		// Nothing to record unless refund got to the legs
+		if len(attempt.Payments) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusBadRequest, failureResponse(db, attempt, err))
+		}
+		return
+	}
+	c.JSON(http.StatusCreated, attempt)
+}
+
+// GetHolds is a handler for GET /holds endpoint.
+// It lists holds, optionally filtered by `account_id` (source account) and
+// `status` query parameters. Allows for pagination.
+// Writes results in JSON format.
+func GetHolds(c *gin.Context, db *gorm.DB) {
+	query := db.Order("id")
+	if accountID, ok := c.GetQuery("account_id"); ok {
+		query = query.Where("account_from_id = ?", accountID)
+	}
+	if status, ok := c.GetQuery("status"); ok {
+		query = query.Where("status = ?", status)
+	}
+
+	var holds []Hold
+	if err := getObjects(c, query, &holds); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	}
+}
+
+// CreateHold is a handler for POST /holds endpoint.
+// Expects the same payload as POST /payments endpoint (see `PaymentRequest`).
+// Hold reserves the amount of the source account, so it's not available for
+// other payments, until it's captured, voided or expires
+// (see `Options.HoldTTL`).
+// Writes created hold in JSON format.
+func CreateHold(c *gin.Context, db *gorm.DB, opts Options) {
+	var request PaymentRequest
+	if err := validatePaymentPayload(c, &request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if request.QuoteID != 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Quotes can't be used for holds"})
+		return
+	}
+	if request.ExecuteAt != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Holds can't be scheduled"})
+		return
+	}
+	if len(request.Splits) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Holds can't be split"})
+		return
+	}
+
+	var hold Hold
+	err := runTransfer(db, opts, func(txn *gorm.DB) (err error) {
+		if hold, err = placeHold(txn, opts, request); err != nil {
+			return err
+		}
+		return txn.Create(&hold).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, hold)
+}
+
+// CaptureRequest is an optional payload for POST /holds/:id/capture endpoint.
+// Without amount the whole held amount is captured.
+type CaptureRequest struct {
+	Amount Decimal `json:"amount"`
+}
+
+// CaptureHold is a handler for POST /holds/:id/capture endpoint.
+// It turns hold with `id` into a payment of the whole or part of the held
+// amount, the rest is released. Payment is made like POST /payments does.
+// Writes created transfer in JSON format.
+func CaptureHold(c *gin.Context, db *gorm.DB, opts Options) {
+	var request CaptureRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.BindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if request.Amount != "" && !request.Amount.Positive() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Amount should be positive"})
+		return
+	}
+
+	// attempt keeps payment legs (if it got that far) to record failure
+	var attempt Transfer
+	capture := func(txn *gorm.DB) (err error) {
+		attempt = Transfer{}
+		hold, err := loadHold(txn, c.Param("id"))
+		if err != nil {
+			return err
+		}
+		var amount Amount
+		if request.Amount != "" {
+			if amount, err = request.Amount.Amount(hold.Currency); err != nil {
+				return err
+			}
+		}
+		attempt, err = captureHold(txn, opts, hold, amount)
+		return err
+	}
+
+	if err := runTransfer(db, opts, capture); err != nil {
+		// Nothing to record unless capture got to the legs
+		if len(attempt.Payments) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusBadRequest, failureResponse(db, attempt, err))
+		}
+		return
+	}
+	c.JSON(http.StatusCreated, attempt)
+}
+
+// VoidHold is a handler for POST /holds/:id/void endpoint.
+// It releases funds reserved by active hold with `id` without payment.
+// Writes voided hold in JSON format.
+func VoidHold(c *gin.Context, db *gorm.DB, opts Options) {
+	var hold *Hold
+	err := runTransfer(db, opts, func(txn *gorm.DB) (err error) {
+		if hold, err = loadHold(txn, c.Param("id")); err != nil {
+			return err
+		}
+		return releaseHold(txn, opts, hold, holdVoided)
+	})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, hold)
+}
+
+// GetReviews is a handler for GET /reviews endpoint.
+// It lists transfers parked for review, oldest first, with their legs and
+// screening decisions. Allows for pagination.
+// Writes results in JSON format.
+func GetReviews(c *gin.Context, db *gorm.DB) {
+	query := db.Preload("Payments").Preload("Screenings").Where("status = ?", statusReview).Order("id")
+	var transfers []Transfer
+	if err := getObjects(c, query, &transfers); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	}
+}
+
+// ReviewRequest is an optional payload for POST /reviews/:id/approve and
+// POST /reviews/:id/reject endpoints.
+type ReviewRequest struct {
+	Note string `json:"note"`
+}
+
+// ReviewPayment is a handler for POST /reviews/:id/approve and
+// POST /reviews/:id/reject endpoints.
+// It approves (posts, checking balances again) or rejects transfer with `id`
+// parked for review. Reviewer is API user from X-API-User header.
+// Writes reviewed transfer in JSON format.
+func ReviewPayment(c *gin.Context, db *gorm.DB, opts Options, decision string) {
+	reviewer := apiUser(c)
+	if reviewer == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%s header is required", apiUserHeader)})
+		return
+	}
+	var request ReviewRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.BindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	var transfer Transfer
+	if err := runTransfer(db, opts, func(txn *gorm.DB) error {
+		transfer = Transfer{}
+		// Lock on transfer serializes concurrent reviews of it
+		if err := forUpdate(txn).Preload("Payments").Preload("Screenings").First(&transfer, c.Param("id")).Error; err != nil {
+			return fmt.Errorf("No transfer with ID=%s", c.Param("id"))
+		}
+		return reviewTransfer(txn, opts, &transfer, statusReview, Review{
+			Reviewer: reviewer,
+			Decision: decision,
+			Note:     strings.TrimSpace(request.Note),
+		})
+	}); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, transfer)
+}
+
+// GetApprovals is a handler for GET /approvals endpoint.
+// It lists approval requests of large payments, oldest first, optionally
+// filtered by `status` query parameter. Allows for pagination.
+// Writes results in JSON format.
+func GetApprovals(c *gin.Context, db *gorm.DB) {
+	query := db.Order("id")
+	if status, ok := c.GetQuery("status"); ok {
+		query = query.Where("status = ?", status)
+	}
+
+	var approvals []Approval
+	if err := getObjects(c, query, &approvals); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	}
+}
+
+// DecideApproval is a handler for POST /approvals/:id/approve and
+// POST /approvals/:id/decline endpoints.
+// It approves (posts, checking balances again) or declines transfer of
+// pending approval with `id`. Checker is API user from X-API-User header,
+// who must not be the maker of the payment to approve it. Neither identity
+// is authenticated by the service, see `apiUser`. Optional payload
+// is the same as for reviews (see `ReviewRequest`).
+// Writes decided transfer in JSON format.
+func DecideApproval(c *gin.Context, db *gorm.DB, opts Options, decision string) {
+	checker := apiUser(c)
+	if checker == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%s header is required", apiUserHeader)})
+		return
+	}
+	var request ReviewRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.BindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	var transfer Transfer
+	if err := runTransfer(db, opts, func(txn *gorm.DB) error {
+		approval, err := loadApproval(txn, c.Param("id"))
+		if err != nil {
+			return err
+		}
+		transfer, err = decideApproval(txn, opts, approval, checker, decision, strings.TrimSpace(request.Note))
+		return err
+	}); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, transfer)
+}
+
+// GetScheduledPayments is a handler for GET /scheduled-payments endpoint.
+// It lists scheduled payments in order of their execution time, optionally
+// filtered by `account_id` (source account) and `status` query parameters.
+// Allows for pagination.
+// Writes results in JSON format.
+func GetScheduledPayments(c *gin.Context, db *gorm.DB) {
+	query := db.Order("execute_at, id")
+	if accountID, ok := c.GetQuery("account_id"); ok {
+		query = query.Where("account_from_id = ?", accountID)
+	}
+	if status, ok := c.GetQuery("status"); ok {
+		query = query.Where("status = ?", status)
+	}
+
+	var scheduled []ScheduledPayment
+	if err := getObjects(c, query, &scheduled); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	}
+}
+
+// CancelScheduledPayment is a handler for POST /scheduled-payments/:id/cancel
+// endpoint. It cancels scheduled payment with `id` unless it's executed
+// already.
+// Writes canceled scheduled payment in JSON format.
+func CancelScheduledPayment(c *gin.Context, db *gorm.DB) {
+	var scheduled ScheduledPayment
+	if err := db.First(&scheduled, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("No scheduled payment with ID=%s", c.Param("id"))})
+		return
+	}
+	canceled, err := claimScheduledPayment(db, scheduled.ID, scheduleCanceled, "")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// Reload to report concurrent execution as well
+	if err := db.First(&scheduled, scheduled.ID).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !canceled {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Scheduled payment is %s", scheduled.Status)})
+		return
+	}
+	c.JSON(http.StatusOK, scheduled)
+}
+
+// GetMandates is a handler for GET /mandates endpoint.
+// It lists mandates, optionally filtered by `account_id` (source account)
+// and `status` query parameters. Allows for pagination.
+// Writes results in JSON format.
+func GetMandates(c *gin.Context, db *gorm.DB) {
+	query := db.Order("id")
+	if accountID, ok := c.GetQuery("account_id"); ok {
+		query = query.Where("account_from_id = ?", accountID)
+	}
+	if status, ok := c.GetQuery("status"); ok {
+		query = query.Where("status = ?", status)
+	}
+
+	var mandates []Mandate
+	if err := getObjects(c, query, &mandates); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	}
+}
+
+// MandateRequest is a payload for POST /mandates endpoint. Amount is sent in
+// currency of the source account. Schedule is `daily`, `weekly`, `monthly`
+// or cron expression (see `parseRecurrence`) starting at optional StartAt.
+// OnInsufficientFunds is `skip` (default), `retry` (up to Retries times) or
+// `suspend`, see `Mandate.Fail`.
+type MandateRequest struct {
+	AccountFromID       uint       `json:"from_account" binding:"required"`
+	AccountToID         uint       `json:"to_account" binding:"required"`
+	Amount              Decimal    `json:"amount" binding:"required"`
+	Schedule            string     `json:"schedule" binding:"required"`
+	StartAt             *time.Time `json:"start_at"`
+	OnInsufficientFunds string     `json:"on_insufficient_funds"`
+	Retries             int        `json:"retries"`
+}
+
+// CreateMandate is a handler for POST /mandates endpoint.
+// Mandate makes payments from the source account by its schedule the same
+// way as POST /payments does, X-API-User header identifies their maker.
+// Writes created mandate in JSON format.
+func CreateMandate(c *gin.Context, db *gorm.DB) {
+	var request MandateRequest
+	if err := c.BindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if request.AccountFromID == request.AccountToID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Source and destination accounts are the same"})
+		return
+	}
+	if !request.Amount.Positive() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Amount should be positive"})
+		return
+	}
+
+	mandate, err := makeMandate(db, request, apiUser(c), time.Now().UTC())
+	if err == nil {
+		err = db.Create(&mandate).Error
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, mandate)
+}
+
+// ChangeMandate is a handler for POST /mandates/:id/pause, /resume and
+// /cancel endpoints. It changes status of mandate with `id`, see
+// `Mandate.SetStatus`.
+// Writes changed mandate in JSON format.
+func ChangeMandate(c *gin.Context, db *gorm.DB, status string) {
+	var mandate *Mandate
+	if err := inTransaction(db, func(txn *gorm.DB) (err error) {
+		if mandate, err = loadMandate(txn, c.Param("id")); err != nil {
+			return err
+		}
+		if err := mandate.SetStatus(status, time.Now().UTC()); err != nil {
+			return err
+		}
+		saved, err := saveMandate(txn, mandate)
+		if err == nil && !saved {
+			err = errors.New("Mandate was changed concurrently, try again")
+		}
+		return err
+	}); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, mandate)
+}
+
+// BatchRequest is a payload for POST /payment-batches endpoint: payments of
+// the same format as POST /payments expects (see `PaymentRequest`, without
+// quotes, scheduling and splits) and batch Mode, see `PaymentBatch`.
+type BatchRequest struct {
+	Mode     string           `json:"mode" binding:"required"`
+	Payments []PaymentRequest `json:"payments" binding:"required"`
+}
+
+// validateBatchPayload validates payload for POST /payment-batches endpoint,
+// see `BatchRequest`.
+// Returns nil on success and error otherwise.
+func validateBatchPayload(c *gin.Context, request *BatchRequest) error {
+	if err := c.BindJSON(request); err != nil {
+		return err
+	}
+	if request.Mode != batchAllOrNothing && request.Mode != batchBestEffort {
+		return fmt.Errorf("Unknown batch mode %q", request.Mode)
+	}
+	if len(request.Payments) == 0 || len(request.Payments) > maxBatchSize {
+		return fmt.Errorf("Batch should have from 1 to %d payments", maxBatchSize)
+	}
+	for i, payment := range request.Payments {
+		switch {
+		case payment.AccountFromID == 0 || payment.AccountToID == 0 || payment.Amount == "":
+			return fmt.Errorf("Payment #%d: from_account, to_account and amount are required", i)
+		case payment.AccountFromID == payment.AccountToID:
+			return fmt.Errorf("Payment #%d: Source and destination accounts are the same", i)
+		case !payment.Amount.Positive():
+			return fmt.Errorf("Payment #%d: Amount should be positive", i)
+		case payment.QuoteID != 0 || payment.ExecuteAt != nil || len(payment.Splits) > 0:
+			return fmt.Errorf("Payment #%d: Batch payments can't use quotes, be scheduled or split", i)
+		}
+	}
+	return nil
+}
+
+// SubmitBatch is a handler for POST /payment-batches endpoint.
+// All-or-nothing batch makes all payments in a single transaction or none
+// (the whole batch fails with the error of the payment which is not
+// possible), best-effort batch makes each payment on its own and reports
+// their outcomes. Both are stored with per-payment outcomes, see GetBatch.
+// X-API-User header identifies maker of the payments, see `Approval`.
+// Writes created batch with its items in JSON format.
+func SubmitBatch(c *gin.Context, db *gorm.DB, opts Options) {
+	var request BatchRequest
+	if err := validateBatchPayload(c, &request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	batch := PaymentBatch{Mode: request.Mode, Maker: apiUser(c)}
+	for i, payment := range request.Payments {
+		batch.Items = append(batch.Items, BatchItem{
+			Position:      i,
+			AccountFromID: payment.AccountFromID,
+			AccountToID:   payment.AccountToID,
+			Amount:        payment.Amount,
+		})
+	}
+
+	if batch.Mode == batchBestEffort {
+		if err := makeBatchItems(db, opts, &batch); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "batch": batch.ID})
+			return
+		}
+		c.JSON(http.StatusCreated, batch)
+		return
+	}
+
+	failed, attempt, err := makeBatch(db, opts, &batch)
+	if err != nil {
+		res := gin.H{"error": err.Error()}
+		if failed >= 0 {
+			res["error"] = fmt.Sprintf("Payment #%d: %s", failed, err)
+		}
+		if ferr := recordBatchFailure(db, &batch, failed, attempt, err.Error()); ferr != nil {
+			log.Printf("Can't record failed batch: %s", ferr)
+		} else {
+			res["batch"] = batch.ID
+		}
+		c.JSON(http.StatusBadRequest, res)
+		return
+	}
+	c.JSON(http.StatusCreated, batch)
+}
+
+// GetBatch is a handler for GET /payment-batches/:id endpoint.
+// Writes batch with `id` with outcomes of its payments in JSON format.
+func GetBatch(c *gin.Context, db *gorm.DB) {
+	var batch PaymentBatch
+	byPosition := func(db *gorm.DB) *gorm.DB {
+		return db.Order("position")
+	}
+	if err := db.Preload("Items", byPosition).First(&batch, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("No batch with ID=%s", c.Param("id"))})
+		return
 	}
+	c.JSON(http.StatusOK, batch)
 }
@@ -47,10 +47,50 @@ func tearDown(db *gorm.DB) {
 	db.Close()
 }
 
+// expectTransfer sets expectations for 50.00 USD transfer between accounts
+// written into the journal with given status.
+func expectTransfer(mock sqlmock.Sqlmock, from uint, to uint, status string, reason string) {
+	var postedAt interface{}
+	if status == statusPosted {
+		postedAt = AnyTime{}
+	}
+	mock.ExpectExec("INSERT INTO .transfers.").
+		WithArgs(AnyTime{}, AnyTime{}, nil, status, reason, 0, 0).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO .payments.").
+		WithArgs(AnyTime{}, AnyTime{}, nil, from, 5000, "USD", "outgoing", to, 0, 1, status, 0, "", postedAt, 0, "", 0, "", 0, "").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO .payments.").
+		WithArgs(AnyTime{}, AnyTime{}, nil, to, 5000, "USD", "incoming", 0, from, 1, status, 0, "", postedAt, 0, "", 0, "", 0, "").
+		WillReturnResult(sqlmock.NewResult(2, 1))
+	mock.ExpectExec("INSERT INTO .status_transitions.").
+		WithArgs(AnyTime{}, 1, "", statusPending, "").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO .status_transitions.").
+		WithArgs(AnyTime{}, 1, statusPending, status, reason).
+		WillReturnResult(sqlmock.NewResult(2, 1))
+}
+
+// expectNoLimits expects payment limits lookup which finds nothing
+func expectNoLimits(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery(`SELECT \* FROM .limits.`).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+}
+
+// expectNoSystemAccounts expects lookup of system accounts to be locked last
+// (see `loadAccounts`) which finds nothing
+func expectNoSystemAccounts(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery(`SELECT .+ FROM .accounts. .+owner IN`).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+}
+
+// expectNoFee expects fee schedule lookup which finds nothing
+func expectNoFee(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery(`SELECT \* FROM "fee_schedules"`).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+}
+
 func TestListAllAccounts(t *testing.T) {
 	sql, db := setUp()
 	defer tearDown(db)
-	engine := setupRouter(db)
+	engine := setupRouter(db, defaultOptions())
 
 	req, _ := http.NewRequest("GET", "/v1/accounts", nil)
 	w := httptest.NewRecorder()
@@ -71,7 +111,7 @@ func TestListAllAccounts(t *testing.T) {
 func TestListAllAccountsWrongPage(t *testing.T) {
 	_, db := setUp()
 	defer tearDown(db)
-	engine := setupRouter(db)
+	engine := setupRouter(db, defaultOptions())
 
 	req, _ := http.NewRequest("GET", "/v1/accounts?page=10x", nil)
 	w := httptest.NewRecorder()
@@ -85,7 +125,7 @@ func TestListAllAccountsWrongPage(t *testing.T) {
 func TestListNonExistentAccount(t *testing.T) {
 	sql, db := setUp()
 	defer tearDown(db)
-	engine := setupRouter(db)
+	engine := setupRouter(db, defaultOptions())
 
 	req, _ := http.NewRequest("GET", "/v1/accounts?id=10", nil)
 	w := httptest.NewRecorder()
@@ -105,15 +145,15 @@ func TestListNonExistentAccount(t *testing.T) {
 func TestListOneAccount(t *testing.T) {
 	sql, db := setUp()
 	defer tearDown(db)
-	engine := setupRouter(db)
+	engine := setupRouter(db, defaultOptions())
 
 	req, _ := http.NewRequest("GET", "/v1/accounts?id=1", nil)
 	w := httptest.NewRecorder()
-	columns := []string{"id", "created_at", "updated_at", "deleted_at", "owner", "balance", "currency"}
+	columns := []string{"id", "created_at", "updated_at", "deleted_at", "owner", "balance", "currency", "version"}
 	sql.ExpectQuery(`SELECT \* FROM .+ "accounts"\."id"`).
 		WithArgs("1").
 		WillReturnRows(sqlmock.NewRows(columns).AddRow(
-			1, time.Now(), time.Now(), time.Now(), "alice", "155.0", "USD"))
+			1, time.Now(), time.Now(), time.Now(), "alice", 15500, "USD", 3))
 
 	engine.ServeHTTP(w, req)
 
@@ -129,25 +169,26 @@ func TestListOneAccount(t *testing.T) {
 	if err := json.Unmarshal(w.Body.Bytes(), &respBody); err != nil {
 		t.Error(err)
 	}
-	if respBody.ID != 1 || respBody.Balance != 155.0 || respBody.Currency != "USD" {
+	// Version is internal to optimistic concurrency
+	if respBody.ID != 1 || respBody.Balance != 15500 || respBody.Currency != "USD" || respBody.Version != 0 {
 		t.Errorf("Wrong response, got %s", w.Body)
 	}
 }
 func TestGetAllPayments(t *testing.T) {
 	sql, db := setUp()
 	defer tearDown(db)
-	engine := setupRouter(db)
+	engine := setupRouter(db, defaultOptions())
 
 	req, _ := http.NewRequest("GET", "/v1/payments", nil)
 	w := httptest.NewRecorder()
-	columns := []string{"id", "created_at", "updated_at", "deleted_at", "account_id", "amount", "direction", "account_to_id", "account_from_id"}
+	columns := []string{"id", "created_at", "updated_at", "deleted_at", "account_id", "amount", "currency", "direction", "account_to_id", "account_from_id"}
 	sql.ExpectQuery(`SELECT \* FROM "payments"`).
 		WillReturnRows(sqlmock.NewRows(columns).
-			AddRow(1, time.Now(), time.Now(), time.Now(), 1, "155.0", "", 2, 0).
-			AddRow(2, time.Now(), time.Now(), time.Now(), 1, "155.0", "", 0, 2).
-			AddRow(3, time.Now(), time.Now(), time.Now(), 2, "155.0", "", 1, 0).
-			AddRow(4, time.Now(), time.Now(), time.Now(), 2, "155.0", "", 1, 0).
-			AddRow(5, time.Now(), time.Now(), time.Now(), 2, "155.0", "", 0, 1))
+			AddRow(1, time.Now(), time.Now(), time.Now(), 1, 15500, "USD", "", 2, 0).
+			AddRow(2, time.Now(), time.Now(), time.Now(), 1, 15500, "USD", "", 0, 2).
+			AddRow(3, time.Now(), time.Now(), time.Now(), 2, 15500, "USD", "", 1, 0).
+			AddRow(4, time.Now(), time.Now(), time.Now(), 2, 15500, "USD", "", 1, 0).
+			AddRow(5, time.Now(), time.Now(), time.Now(), 2, 15500, "USD", "", 0, 1))
 
 	engine.ServeHTTP(w, req)
 
@@ -167,24 +208,24 @@ func TestGetAllPayments(t *testing.T) {
 		t.Errorf("Wrong response, got %s", w.Body)
 	}
 	payment := respBody[3]
-	if payment.ID != 4 || payment.Amount != 155.0 || payment.AccountID != 2 || payment.AccountToID != 1 {
+	if payment.ID != 4 || payment.Amount != 15500 || payment.AccountID != 2 || payment.AccountToID != 1 {
 		t.Errorf("Wrong payment, got %s", payment)
 	}
 }
 func TestGetSingleAccountPayments(t *testing.T) {
 	sql, db := setUp()
 	defer tearDown(db)
-	engine := setupRouter(db)
+	engine := setupRouter(db, defaultOptions())
 
 	req, _ := http.NewRequest("GET", "/v1/payments?account_id=2", nil)
 	w := httptest.NewRecorder()
-	columns := []string{"id", "created_at", "updated_at", "deleted_at", "account_id", "amount", "direction", "account_to_id", "account_from_id"}
+	columns := []string{"id", "created_at", "updated_at", "deleted_at", "account_id", "amount", "currency", "direction", "account_to_id", "account_from_id"}
 	sql.ExpectQuery(`SELECT \* FROM "payments"`).
 		WithArgs("2").
 		WillReturnRows(sqlmock.NewRows(columns).
-			AddRow(3, time.Now(), time.Now(), time.Now(), 2, "155.0", "", 1, 0).
-			AddRow(4, time.Now(), time.Now(), time.Now(), 2, "155.0", "", 1, 0).
-			AddRow(5, time.Now(), time.Now(), time.Now(), 2, "155.0", "", 0, 1))
+			AddRow(3, time.Now(), time.Now(), time.Now(), 2, 15500, "USD", "", 1, 0).
+			AddRow(4, time.Now(), time.Now(), time.Now(), 2, 15500, "USD", "", 1, 0).
+			AddRow(5, time.Now(), time.Now(), time.Now(), 2, 15500, "USD", "", 0, 1))
 
 	engine.ServeHTTP(w, req)
 
@@ -208,7 +249,7 @@ func TestGetSingleAccountPayments(t *testing.T) {
 func TestSubmitWrongRequest(t *testing.T) {
 	_, db := setUp()
 	defer tearDown(db)
-	engine := setupRouter(db)
+	engine := setupRouter(db, defaultOptions())
 
 	testCases := []string{
 		`{"account":1, "amount":50.0, "to_account":1}`,
@@ -216,6 +257,8 @@ func TestSubmitWrongRequest(t *testing.T) {
 		`{"to_a2ccount":1, "amount":50.0, "from_account":1}`,
 		`{"to_account":1, "amount":50.0}`,
 		`{"from_account2":1, "amount":50.0}`,
+		`{"from_account":1, "amount":-50.0, "to_account":2}`,
+		`{"from_account":1, "amount":"fifty", "to_account":2}`,
 	}
 
 	for _, payload := range testCases {
@@ -232,34 +275,32 @@ func TestSubmitWrongRequest(t *testing.T) {
 func TestSubmitSuccess(t *testing.T) {
 	sql, db := setUp()
 	defer tearDown(db)
-	engine := setupRouter(db)
+	engine := setupRouter(db, defaultOptions())
 
 	req, _ := http.NewRequest("POST", "/v1/payments", bytes.NewBufferString(`{"from_account":1, "amount":50.0, "to_account":2}`))
 	w := httptest.NewRecorder()
 	aColumns := []string{"id", "created_at", "updated_at", "deleted_at", "owner", "balance", "currency"}
-	// pColumns := []string{"id", "created_at", "updated_at", "deleted_at", "account_id", "amount", "direction", "account_to_id", "account_from_id"}
+	// pColumns := []string{"id", "created_at", "updated_at", "deleted_at", "account_id", "amount", "currency", "direction", "account_to_id", "account_from_id"}
 
 	sql.ExpectBegin()
+	expectNoSystemAccounts(sql)
 	sql.ExpectQuery(`SELECT \* FROM "accounts"  WHERE .+ "accounts"\."id"`).
 		WithArgs(1).
 		WillReturnRows(sqlmock.NewRows(aColumns).
-			AddRow(1, time.Time{}, time.Time{}, nil, "alice", 155.0, "USD"))
+			AddRow(1, time.Time{}, time.Time{}, nil, "alice", 15500, "USD"))
 	sql.ExpectQuery(`SELECT \* FROM "accounts"  WHERE .+ "accounts"\."id"`).
 		WithArgs(2).
 		WillReturnRows(sqlmock.NewRows(aColumns).
-			AddRow(2, time.Time{}, time.Time{}, nil, "bob", 5.0, "USD"))
-	sql.ExpectExec(`UPDATE "accounts" SET`).
-		WithArgs(time.Time{}, time.Time{}, nil, "alice", 105.0, "USD", 1).
+			AddRow(2, time.Time{}, time.Time{}, nil, "bob", 500, "USD"))
+	expectNoLimits(sql)
+	expectNoFee(sql)
+	sql.ExpectExec(`UPDATE accounts SET balance = \?, held = \?, version = version \+ 1`).
+		WithArgs(10500, 0, AnyTime{}, 1, 0).
 		WillReturnResult(sqlmock.NewResult(0, 1))
-	sql.ExpectExec(`UPDATE "accounts" SET`).
-		WithArgs(time.Time{}, time.Time{}, nil, "bob", 55.0, "USD", 2).
+	sql.ExpectExec(`UPDATE accounts SET balance = \?, held = \?, version = version \+ 1`).
+		WithArgs(5500, 0, AnyTime{}, 2, 0).
 		WillReturnResult(sqlmock.NewResult(0, 1))
-	sql.ExpectExec(`INSERT INTO "payments"`).
-		WithArgs(AnyTime{}, AnyTime{}, nil, 1, 50.0, "outgoing", 2, 0).
-		WillReturnResult(sqlmock.NewResult(1, 1))
-	sql.ExpectExec(`INSERT INTO "payments"`).
-		WithArgs(AnyTime{}, AnyTime{}, nil, 2, 50.0, "incoming", 0, 1).
-		WillReturnResult(sqlmock.NewResult(2, 1))
+	expectTransfer(sql, 1, 2, statusPosted, "")
 	sql.ExpectCommit()
 
 	engine.ServeHTTP(w, req)
@@ -267,44 +308,45 @@ func TestSubmitSuccess(t *testing.T) {
 	if err := sql.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
 	}
-	if w.Code != http.StatusOK {
-		t.Errorf("Response code should be %d, was: %d (%s)", http.StatusOK, w.Code, w.Body)
+	if w.Code != http.StatusCreated {
+		t.Errorf("Response code should be %d, was: %d (%s)", http.StatusCreated, w.Code, w.Body)
 	}
 }
 
 func TestSubmitCommitFailure(t *testing.T) {
 	sql, db := setUp()
 	defer tearDown(db)
-	engine := setupRouter(db)
+	engine := setupRouter(db, defaultOptions())
 
 	req, _ := http.NewRequest("POST", "/v1/payments", bytes.NewBufferString(`{"from_account":1, "amount":50.0, "to_account":2}`))
 	w := httptest.NewRecorder()
 	aColumns := []string{"id", "created_at", "updated_at", "deleted_at", "owner", "balance", "currency"}
-	// pColumns := []string{"id", "created_at", "updated_at", "deleted_at", "account_id", "amount", "direction", "account_to_id", "account_from_id"}
+	// pColumns := []string{"id", "created_at", "updated_at", "deleted_at", "account_id", "amount", "currency", "direction", "account_to_id", "account_from_id"}
 
 	sql.ExpectBegin()
+	expectNoSystemAccounts(sql)
 	sql.ExpectQuery(`SELECT \* FROM "accounts"  WHERE .+ "accounts"\."id"`).
 		WithArgs(1).
 		WillReturnRows(sqlmock.NewRows(aColumns).
-			AddRow(1, time.Time{}, time.Time{}, nil, "alice", 155.0, "USD"))
+			AddRow(1, time.Time{}, time.Time{}, nil, "alice", 15500, "USD"))
 	sql.ExpectQuery(`SELECT \* FROM "accounts"  WHERE .+ "accounts"\."id"`).
 		WithArgs(2).
 		WillReturnRows(sqlmock.NewRows(aColumns).
-			AddRow(2, time.Time{}, time.Time{}, nil, "bob", 5.0, "USD"))
-	sql.ExpectExec(`UPDATE "accounts" SET`).
-		WithArgs(time.Time{}, time.Time{}, nil, "alice", 105.0, "USD", 1).
+			AddRow(2, time.Time{}, time.Time{}, nil, "bob", 500, "USD"))
+	expectNoLimits(sql)
+	expectNoFee(sql)
+	sql.ExpectExec(`UPDATE accounts SET balance = \?, held = \?, version = version \+ 1`).
+		WithArgs(10500, 0, AnyTime{}, 1, 0).
 		WillReturnResult(sqlmock.NewResult(0, 1))
-	sql.ExpectExec(`UPDATE "accounts" SET`).
-		WithArgs(time.Time{}, time.Time{}, nil, "bob", 55.0, "USD", 2).
+	sql.ExpectExec(`UPDATE accounts SET balance = \?, held = \?, version = version \+ 1`).
+		WithArgs(5500, 0, AnyTime{}, 2, 0).
 		WillReturnResult(sqlmock.NewResult(0, 1))
-	sql.ExpectExec(`INSERT INTO "payments"`).
-		WithArgs(AnyTime{}, AnyTime{}, nil, 1, 50.0, "outgoing", 2, 0).
-		WillReturnResult(sqlmock.NewResult(1, 1))
-	sql.ExpectExec(`INSERT INTO "payments"`).
-		WithArgs(AnyTime{}, AnyTime{}, nil, 2, 50.0, "incoming", 0, 1).
-		WillReturnResult(sqlmock.NewResult(2, 1))
+	expectTransfer(sql, 1, 2, statusPosted, "")
 	sql.ExpectCommit().
-		WillReturnError(errors.New("Error 4025: CONSTRAINT `positive_balance` failed for `test`.`accounts`"))
+		WillReturnError(errors.New("Error 4025: CONSTRAINT `balance_floor` failed for `test`.`accounts`"))
+	sql.ExpectBegin()
+	expectTransfer(sql, 1, 2, statusFailed, "Error 4025: CONSTRAINT `balance_floor` failed for `test`.`accounts`")
+	sql.ExpectCommit()
 
 	engine.ServeHTTP(w, req)
 
@@ -319,23 +361,37 @@ func TestSubmitCommitFailure(t *testing.T) {
 func TestSubmitError(t *testing.T) {
 	sql, db := setUp()
 	defer tearDown(db)
-	engine := setupRouter(db)
+	engine := setupRouter(db, defaultOptions())
 
 	req, _ := http.NewRequest("POST", "/v1/payments", bytes.NewBufferString(`{"from_account":1, "amount":50.0, "to_account":2}`))
 	w := httptest.NewRecorder()
 	aColumns := []string{"id", "created_at", "updated_at", "deleted_at", "owner", "balance", "currency"}
-	// pColumns := []string{"id", "created_at", "updated_at", "deleted_at", "account_id", "amount", "direction", "account_to_id", "account_from_id"}
+	// pColumns := []string{"id", "created_at", "updated_at", "deleted_at", "account_id", "amount", "currency", "direction", "account_to_id", "account_from_id"}
 
 	sql.ExpectBegin()
+	expectNoSystemAccounts(sql)
 	sql.ExpectQuery(`SELECT \* FROM "accounts"  WHERE .+ "accounts"\."id"`).
 		WithArgs(1).
 		WillReturnRows(sqlmock.NewRows(aColumns).
-			AddRow(1, time.Time{}, time.Time{}, nil, "alice", 155.0, "USD"))
+			AddRow(1, time.Time{}, time.Time{}, nil, "alice", 15500, "USD"))
 	sql.ExpectQuery(`SELECT \* FROM "accounts"  WHERE .+ "accounts"\."id"`).
 		WithArgs(2).
 		WillReturnRows(sqlmock.NewRows(aColumns).
-			AddRow(2, time.Time{}, time.Time{}, nil, "bob", 5.0, "EUR"))
+			AddRow(2, time.Time{}, time.Time{}, nil, "bob", 500, "EUR"))
+	expectNoLimits(sql)
+	sql.ExpectQuery(`SELECT \* FROM "exchange_rates"  WHERE .+from_currency = \? AND to_currency = \?`).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
 	sql.ExpectRollback()
+	// Failure is recorded without legs as there is no rate to convert amount
+	sql.ExpectBegin()
+	sql.ExpectExec("INSERT INTO .transfers.").
+		WithArgs(AnyTime{}, AnyTime{}, nil, statusFailed, "No exchange rate from USD to EUR", 0, 0).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	sql.ExpectExec("INSERT INTO .status_transitions.").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	sql.ExpectExec("INSERT INTO .status_transitions.").
+		WillReturnResult(sqlmock.NewResult(2, 1))
+	sql.ExpectCommit()
 
 	engine.ServeHTTP(w, req)
 
@@ -346,3 +402,204 @@ func TestSubmitError(t *testing.T) {
 		t.Errorf("Response code should be %d, was: %d (%s)", http.StatusBadRequest, w.Code, w.Body)
 	}
 }
+
+func TestSubmitLocksAccountsInOrder(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("can't create sqlmock: %s", err)
+	}
+	gormDB, err := gorm.Open("mysql", db)
+	if err != nil {
+		t.Fatalf("can't open gorm connection: %s", err)
+	}
+	defer tearDown(gormDB)
+	engine := setupRouter(gormDB.Set("gorm:update_column", true), defaultOptions())
+
+	// Source account has higher ID, but it's locked second
+	req, _ := http.NewRequest("POST", "/v1/payments", bytes.NewBufferString(`{"from_account":2, "amount":50.0, "to_account":1}`))
+	w := httptest.NewRecorder()
+	aColumns := []string{"id", "created_at", "updated_at", "deleted_at", "owner", "balance", "currency"}
+
+	mock.ExpectBegin()
+	expectNoSystemAccounts(mock)
+	mock.ExpectQuery("SELECT \\* FROM `accounts` .+ FOR UPDATE").
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows(aColumns).
+			AddRow(1, time.Time{}, time.Time{}, nil, "alice", 15500, "USD"))
+	mock.ExpectQuery("SELECT \\* FROM `accounts` .+ FOR UPDATE").
+		WithArgs(2).
+		WillReturnRows(sqlmock.NewRows(aColumns).
+			AddRow(2, time.Time{}, time.Time{}, nil, "bob", 500, "USD"))
+	expectNoLimits(mock)
+	mock.ExpectRollback()
+	mock.ExpectBegin()
+	expectTransfer(mock, 2, 1, statusFailed, "Not enough balance")
+	mock.ExpectCommit()
+
+	engine.ServeHTTP(w, req)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Response code should be %d, was: %d (%s)", http.StatusBadRequest, w.Code, w.Body)
+	}
+}
+
+func TestSubmitLocksSystemAccountsLast(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("can't create sqlmock: %s", err)
+	}
+	gormDB, err := gorm.Open("mysql", db)
+	if err != nil {
+		t.Fatalf("can't open gorm connection: %s", err)
+	}
+	defer tearDown(gormDB)
+	engine := setupRouter(gormDB.Set("gorm:update_column", true), defaultOptions())
+
+	// Destination has lower ID, but it's system account locked last, like
+	// system accounts locked for fees and conversion
+	req, _ := http.NewRequest("POST", "/v1/payments", bytes.NewBufferString(`{"from_account":2, "amount":50.0, "to_account":1}`))
+	w := httptest.NewRecorder()
+	aColumns := []string{"id", "created_at", "updated_at", "deleted_at", "owner", "balance", "currency"}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT .+ FROM `accounts` .+owner IN").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectQuery("SELECT \\* FROM `accounts` .+ FOR UPDATE").
+		WithArgs(2).
+		WillReturnRows(sqlmock.NewRows(aColumns).
+			AddRow(2, time.Time{}, time.Time{}, nil, "bob", 500, "USD"))
+	mock.ExpectQuery("SELECT \\* FROM `accounts` .+ FOR UPDATE").
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows(aColumns).
+			AddRow(1, time.Time{}, time.Time{}, nil, fxOwner, 15500, "USD"))
+	expectNoLimits(mock)
+	mock.ExpectRollback()
+	mock.ExpectBegin()
+	expectTransfer(mock, 2, 1, statusFailed, "Not enough balance")
+	mock.ExpectCommit()
+
+	engine.ServeHTTP(w, req)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Response code should be %d, was: %d (%s)", http.StatusBadRequest, w.Code, w.Body)
+	}
+}
+
+func TestSubmitBatchLocksAccountsInOrder(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("can't create sqlmock: %s", err)
+	}
+	gormDB, err := gorm.Open("mysql", db)
+	if err != nil {
+		t.Fatalf("can't open gorm connection: %s", err)
+	}
+	defer tearDown(gormDB)
+	engine := setupRouter(gormDB.Set("gorm:update_column", true), defaultOptions())
+
+	// Accounts of all payments are locked before the first one is made,
+	// system account the last
+	req, _ := http.NewRequest("POST", "/v1/payment-batches", bytes.NewBufferString(`{"mode":"all_or_nothing", "payments":[{"from_account":3, "amount":"1.00", "to_account":2}, {"from_account":2, "amount":"1.00", "to_account":1}]}`))
+	w := httptest.NewRecorder()
+	aColumns := []string{"id", "created_at", "updated_at", "deleted_at", "owner", "balance", "currency"}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id FROM `accounts` .+id IN \\(\\?,\\?,\\?,\\?\\)").
+		WithArgs(3, 2, 2, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1).AddRow(2).AddRow(3))
+	mock.ExpectQuery("SELECT .+ FROM `accounts` .+owner IN").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	for _, row := range []struct {
+		id    uint
+		owner string
+	}{{2, "bob"}, {3, "carol"}, {1, fxOwner}} {
+		mock.ExpectQuery("SELECT \\* FROM `accounts` .+ FOR UPDATE").
+			WithArgs(row.id).
+			WillReturnRows(sqlmock.NewRows(aColumns).AddRow(row.id, time.Time{}, time.Time{}, nil, row.owner, 0, "USD"))
+	}
+	expectNoSystemAccounts(mock)
+	mock.ExpectQuery("SELECT \\* FROM `accounts` .+ FOR UPDATE").
+		WithArgs(2).
+		WillReturnRows(sqlmock.NewRows(aColumns).
+			AddRow(2, time.Time{}, time.Time{}, nil, "bob", 500, "USD"))
+	mock.ExpectQuery("SELECT \\* FROM `accounts` .+ FOR UPDATE").
+		WithArgs(3).
+		WillReturnRows(sqlmock.NewRows(aColumns).
+			AddRow(3, time.Time{}, time.Time{}, nil, "carol", 0, "USD"))
+	expectNoLimits(mock)
+	mock.ExpectRollback()
+
+	engine.ServeHTTP(w, req)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Response code should be %d, was: %d (%s)", http.StatusBadRequest, w.Code, w.Body)
+	}
+}
+
+func TestSubmitOptimisticRetry(t *testing.T) {
+	sql, db := setUp()
+	defer tearDown(db)
+	opts := defaultOptions()
+	opts.Concurrency = optimisticConcurrency
+	engine := setupRouter(db, opts)
+
+	req, _ := http.NewRequest("POST", "/v1/payments", bytes.NewBufferString(`{"from_account":1, "amount":50.0, "to_account":2}`))
+	w := httptest.NewRecorder()
+	aColumns := []string{"id", "created_at", "updated_at", "deleted_at", "owner", "balance", "currency", "version"}
+
+	// First attempt: concurrent transfer changes source account after it's read
+	sql.ExpectBegin()
+	sql.ExpectQuery(`SELECT \* FROM "accounts"  WHERE .+ "accounts"\."id"`).
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows(aColumns).
+			AddRow(1, time.Time{}, time.Time{}, nil, "alice", 15500, "USD", 3))
+	sql.ExpectQuery(`SELECT \* FROM "accounts"  WHERE .+ "accounts"\."id"`).
+		WithArgs(2).
+		WillReturnRows(sqlmock.NewRows(aColumns).
+			AddRow(2, time.Time{}, time.Time{}, nil, "bob", 500, "USD", 7))
+	expectNoLimits(sql)
+	expectNoFee(sql)
+	sql.ExpectExec(`UPDATE accounts SET balance = \?, held = \?, version = version \+ 1`).
+		WithArgs(10500, 0, AnyTime{}, 1, 3).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	sql.ExpectRollback()
+
+	// Second attempt succeeds with fresh data
+	sql.ExpectBegin()
+	sql.ExpectQuery(`SELECT \* FROM "accounts"  WHERE .+ "accounts"\."id"`).
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows(aColumns).
+			AddRow(1, time.Time{}, time.Time{}, nil, "alice", 14500, "USD", 4))
+	sql.ExpectQuery(`SELECT \* FROM "accounts"  WHERE .+ "accounts"\."id"`).
+		WithArgs(2).
+		WillReturnRows(sqlmock.NewRows(aColumns).
+			AddRow(2, time.Time{}, time.Time{}, nil, "bob", 500, "USD", 7))
+	expectNoLimits(sql)
+	expectNoFee(sql)
+	sql.ExpectExec(`UPDATE accounts SET balance = \?, held = \?, version = version \+ 1`).
+		WithArgs(9500, 0, AnyTime{}, 1, 4).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	sql.ExpectExec(`UPDATE accounts SET balance = \?, held = \?, version = version \+ 1`).
+		WithArgs(5500, 0, AnyTime{}, 2, 7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectTransfer(sql, 1, 2, statusPosted, "")
+	sql.ExpectCommit()
+
+	engine.ServeHTTP(w, req)
+
+	if err := sql.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+	if w.Code != http.StatusCreated {
+		t.Errorf("Response code should be %d, was: %d (%s)", http.StatusCreated, w.Code, w.Body)
+	}
+}
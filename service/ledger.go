@@ -0,0 +1,1405 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// signedAmountSQL is a journal entry amount with sign: incoming payments
+// credit account, outgoing payments debit it.
+const signedAmountSQL = "CASE WHEN payments.direction = 'incoming' THEN payments.amount ELSE -payments.amount END"
+
+// postedSQL selects journal entries applied to balances. Reversed transfers
+// are still applied, it's their reversal which compensates them.
+const postedSQL = "payments.status IN ('posted', 'reversed')"
+
+// forUpdate makes SELECT queries lock selected rows until the end of the
+// transaction. sqlite3 doesn't support `FOR UPDATE`, but it doesn't need it
+// either as it locks the whole database for writing transactions.
+func forUpdate(txn *gorm.DB) *gorm.DB {
+	if txn.NewScope(nil).Dialect().GetName() == "sqlite3" {
+		return txn
+	}
+	return txn.Set("gorm:query_option", "FOR UPDATE")
+}
+
+// fxOwner owns system FX accounts, one per currency. Cross-currency transfers
+// go through them: FX account in source currency receives the payment and FX
+// account in destination currency pays out the converted amount, so the
+// latter should be funded to provide liquidity.
+const fxOwner = "system:fx"
+
+// revenueOwner owns system revenue accounts, one per currency, which receive
+// payment fees.
+const revenueOwner = "system:revenue"
+
+// systemOwners own system accounts, which are locked after all others
+var systemOwners = []string{fxOwner, revenueOwner}
+
+// errVersionConflict is returned when account was changed by a concurrent
+// transaction since it was read (see `saveAccount`)
+var errVersionConflict = errors.New("Account was changed concurrently, try again")
+
+// loadAccounts loads accounts by their IDs within a transaction. With
+// pessimistic concurrency accounts are locked until the end of transaction.
+// Accounts are always loaded in ascending ID order, system accounts (see
+// `systemOwners`) after all others, so concurrent transfers between the same
+// accounts can't deadlock each other whichever of them they pay to directly
+// or lock for fees and conversion (see `loadSystemAccounts`).
+// Returns accounts mapped by ID, error if any account doesn't exist.
+func loadAccounts(txn *gorm.DB, opts Options, ids ...uint) (map[uint]*Account, error) {
+	sorted := append([]uint(nil), ids...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	query := txn
+	if opts.Concurrency != optimisticConcurrency {
+		query = forUpdate(txn)
+		if len(sorted) > 1 {
+			var systemIDs []uint
+			if err := txn.Model(&Account{}).Where("id IN (?) AND owner IN (?)", sorted, systemOwners).
+				Pluck("id", &systemIDs).Error; err != nil {
+				return nil, err
+			}
+			system := make(map[uint]bool, len(systemIDs))
+			for _, id := range systemIDs {
+				system[id] = true
+			}
+			sort.SliceStable(sorted, func(i, j int) bool { return !system[sorted[i]] && system[sorted[j]] })
+		}
+	}
+	accounts := make(map[uint]*Account, len(sorted))
+	for _, id := range sorted {
+		if _, ok := accounts[id]; ok {
+			continue
+		}
+		var account Account
+		if err := query.First(&account, id).Error; err != nil {
+			return nil, fmt.Errorf("No account with ID=%d", id)
+		}
+		accounts[id] = &account
+	}
+	return accounts, nil
+}
+
+// loadSystemAccounts loads system accounts of owner (e.g. `fxOwner`) in
+// currencies within a transaction into accounts, see `loadAccounts`. System
+// accounts are always loaded after accounts of transfer, which keeps locking
+// order consistent.
+// Returns system accounts mapped by currency, error if any account doesn't exist.
+func loadSystemAccounts(txn *gorm.DB, opts Options, accounts map[uint]*Account, owner string, currencies ...string) (map[string]*Account, error) {
+	systemIDs := make(map[string]uint, len(currencies))
+	ids := make([]uint, 0, len(currencies))
+	for _, currency := range currencies {
+		var account Account
+		if err := txn.Where("owner = ? AND currency = ?", owner, currency).Order("id").First(&account).Error; err != nil {
+			return nil, fmt.Errorf("No %s account for %s", owner, currency)
+		}
+		systemIDs[currency] = account.ID
+		if _, ok := accounts[account.ID]; !ok {
+			ids = append(ids, account.ID)
+		}
+	}
+	loaded, err := loadAccounts(txn, opts, ids...)
+	if err != nil {
+		return nil, err
+	}
+	for id, account := range loaded {
+		accounts[id] = account
+	}
+	res := make(map[string]*Account, len(systemIDs))
+	for currency, id := range systemIDs {
+		res[currency] = accounts[id]
+	}
+	return res, nil
+}
+
+// findRate looks up exchange rate between currencies valid at given time.
+// Returns the latest of valid rates, error if there is none.
+func findRate(db *gorm.DB, from string, to string, at time.Time) (ExchangeRate, error) {
+	var rate ExchangeRate
+	err := db.Where("from_currency = ? AND to_currency = ? AND valid_from <= ? AND (valid_until IS NULL OR valid_until > ?)", from, to, at.UTC(), at.UTC()).
+		Order("valid_from DESC, id DESC").
+		First(&rate).Error
+	if err == gorm.ErrRecordNotFound {
+		return rate, fmt.Errorf("No exchange rate from %s to %s", from, to)
+	}
+	return rate, err
+}
+
+// exchange converts payment between accounts with different currencies with
+// exchange rate, see `Payment.Exchange`. FX accounts involved are loaded into
+// accounts.
+// Returns pending journal record of the payment and error if transfer is not
+// possible, nil otherwise.
+func exchange(txn *gorm.DB, opts Options, payment *Payment, accounts map[uint]*Account, rate ExchangeRate) (Transfer, error) {
+	source, dest := accounts[payment.AccountFromID], accounts[payment.AccountToID]
+	fx, err := loadSystemAccounts(txn, opts, accounts, fxOwner, source.Currency, dest.Currency)
+	if err != nil {
+		return Transfer{}, err
+	}
+	return payment.Exchange(source, dest, fx[source.Currency], fx[dest.Currency], rate, opts.rounding(dest.Currency))
+}
+
+// findFee looks up fee schedule for payment of amount from account (see
+// `FeeSchedule`) and calculates payment fee.
+// Returns zero fee if no schedule applies to the payment.
+func findFee(db *gorm.DB, opts Options, account *Account, amount Amount) (Amount, error) {
+	var schedule FeeSchedule
+	// Account tier is the only tier which can go before the empty one
+	err := db.Where("currency = ? AND tier IN (?) AND from_amount <= ?", account.Currency, []string{"", account.Tier}, amount).
+		Order("tier DESC, from_amount DESC, id DESC").
+		First(&schedule).Error
+	if err == gorm.ErrRecordNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return schedule.Fee(amount, opts.rounding(account.Currency))
+}
+
+// chargeFee charges fee of transfer from source account, see
+// `Transfer.ChargeFee`. Revenue account is loaded into accounts.
+// Returns error if fee can't be charged, nil otherwise.
+func chargeFee(txn *gorm.DB, opts Options, transfer *Transfer, accounts map[uint]*Account, source *Account, fee Amount) error {
+	if fee == 0 {
+		return nil
+	}
+	revenue, err := loadSystemAccounts(txn, opts, accounts, revenueOwner, source.Currency)
+	if err != nil {
+		return err
+	}
+	return transfer.ChargeFee(source, revenue[source.Currency], fee)
+}
+
+// limitUsage calculates what's already used of limit at given time from
+// posted outgoing payments (not counting fees) of accounts the limit applies
+// to, see `Limit`.
+func limitUsage(db *gorm.DB, limit Limit, at time.Time) (usage LimitUsage, err error) {
+	query := db.Table("payments").
+		Where("payments.direction = ? AND (payments.kind IS NULL OR payments.kind <> ?) AND payments.deleted_at IS NULL AND "+postedSQL, outgoing, feeKind)
+	if limit.AccountID != 0 {
+		query = query.Where("payments.account_id = ?", limit.AccountID)
+	} else {
+		query = query.Where("payments.account_id IN (SELECT id FROM accounts WHERE owner = ? AND currency = ?)", limit.Owner, limit.Currency)
+	}
+
+	at = at.UTC()
+	day := time.Date(at.Year(), at.Month(), at.Day(), 0, 0, 0, 0, time.UTC)
+	month := time.Date(at.Year(), at.Month(), 1, 0, 0, 0, 0, time.UTC)
+	var count int
+	for _, window := range []struct {
+		since  time.Time
+		amount *Amount
+		count  *int
+	}{
+		{day, &usage.Daily, &count},
+		{month, &usage.Monthly, &count},
+		{at.Add(-time.Hour), new(Amount), &usage.Hourly},
+	} {
+		if err = query.Where("payments.created_at >= ?", window.since).
+			Select("COALESCE(SUM(payments.amount), 0), COUNT(*)").
+			Row().Scan(window.amount, window.count); err != nil {
+			return usage, err
+		}
+	}
+	return usage, nil
+}
+
+// checkLimits checks payment of amount from source account fits into limits
+// of the account and of its owner, see `Limit`.
+// Returns limitError if payment violates a limit, other error if limits can't
+// be checked, nil otherwise.
+func checkLimits(db *gorm.DB, source *Account, amount Amount, at time.Time) error {
+	var limits []Limit
+	if err := db.Where("(account_id = ? OR (account_id = 0 AND owner = ?)) AND currency = ?", source.ID, source.Owner, source.Currency).
+		Order("id").Find(&limits).Error; err != nil {
+		return err
+	}
+	for _, limit := range limits {
+		var usage LimitUsage
+		// Only payment amount is checked without any usage
+		if limit.DailyAmount > 0 || limit.MonthlyAmount > 0 || limit.HourlyCount > 0 {
+			var err error
+			if usage, err = limitUsage(db, limit, at); err != nil {
+				return err
+			}
+		}
+		if err := limit.Check(amount, usage); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// screenTransfer screens pending transfer of payment (see `Screener`) unless
+// screening is off and records the decision with the transfer. Transfer
+// flagged for review is parked: its legs are not applied to balances.
+// Returns error if payment is rejected or can't be screened.
+func screenTransfer(db *gorm.DB, opts Options, transfer *Transfer, payment Payment, destinations []uint) error {
+	if opts.Screener == nil {
+		return nil
+	}
+	screening, err := opts.Screener.Screen(db, payment, destinations, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	transfer.Screenings = append(transfer.Screenings, screening)
+	switch screening.Decision {
+	case screeningReject:
+		return fmt.Errorf("Payment rejected by screening: %s", screening.Rules)
+	case screeningReview:
+		if err := transfer.Validate(); err != nil {
+			return err
+		}
+		return transfer.SetStatus(statusReview, "Flagged by screening: "+screening.Rules)
+	}
+	return nil
+}
+
+// requireApproval parks pending transfer of payment for approval if payment
+// amount is above approval threshold of its currency (see
+// `Options.ApprovalThresholds`). Approval request by maker is added to
+// the transfer.
+// Returns error if payment needs approval, but maker is unknown.
+func requireApproval(opts Options, transfer *Transfer, payment Payment, maker string) error {
+	threshold, ok := opts.ApprovalThresholds[payment.Currency]
+	if !ok || payment.Amount <= threshold {
+		return nil
+	}
+	if maker == "" {
+		return fmt.Errorf("Payments above %s %s need approval, %s header is required",
+			threshold.Decimal(payment.Currency), payment.Currency, apiUserHeader)
+	}
+	if err := transfer.Validate(); err != nil {
+		return err
+	}
+	if err := transfer.SetStatus(statusApproval, "Awaiting approval"); err != nil {
+		return err
+	}
+	transfer.Approvals = append(transfer.Approvals, Approval{
+		AccountFromID: payment.AccountFromID,
+		AccountToID:   payment.AccountToID,
+		Amount:        payment.Amount,
+		Currency:      payment.Currency,
+		Maker:         maker,
+		Status:        approvalPending,
+		ExpiresAt:     time.Now().UTC().Add(opts.ApprovalTTL),
+	})
+	return nil
+}
+
+// makeTransfer makes requested payment within a transaction: loads accounts
+// involved, checks payment limits, converts amount if their currencies differ
+// (split payments are not converted) and charges payment fee (at quoted rate
+// and fee if request refers to a quote), screens the transfer and posts it
+// unless it's parked for review or approval.
+// Returns transfer (even if payment is not possible, to record the failure)
+// and error if payment is not possible, nil otherwise.
+func makeTransfer(txn *gorm.DB, opts Options, request PaymentRequest) (Transfer, error) {
+	sourceID, destID := request.AccountFromID, request.AccountToID
+	accounts, err := loadAccounts(txn, opts, append([]uint{sourceID}, request.Destinations()...)...)
+	if err != nil {
+		return Transfer{}, err
+	}
+	source, dest := accounts[sourceID], accounts[destID]
+
+	payment, err := request.Payment(source.Currency)
+	if err != nil {
+		return Transfer{}, err
+	}
+	var splits []Payment
+	if len(request.Splits) > 0 {
+		if request.QuoteID != 0 {
+			return Transfer{}, errors.New("Quotes can't be used for split payments")
+		}
+		if splits, err = request.SplitPayments(source.Currency); err != nil {
+			return Transfer{}, err
+		}
+	}
+	var quote *Quote
+	if request.QuoteID != 0 {
+		if quote, err = loadQuote(txn, opts, request.QuoteID); err != nil {
+			return Transfer{}, err
+		}
+		if err := quote.Accepts(payment, time.Now().UTC()); err != nil {
+			return Transfer{}, err
+		}
+	}
+	if err := checkLimits(txn, source, payment.Amount, time.Now().UTC()); err != nil {
+		return Transfer{}, err
+	}
+
+	var transfer Transfer
+	if len(splits) > 0 {
+		transfer, err = payment.Split(splits, accounts)
+	} else if source.Currency == dest.Currency {
+		transfer, err = payment.Transfer(source, dest)
+	} else {
+		var rate ExchangeRate
+		if quote != nil {
+			rate = quote.ExchangeRate()
+		} else if rate, err = findRate(txn, source.Currency, dest.Currency, time.Now().UTC()); err != nil {
+			return transfer, err
+		}
+		transfer, err = exchange(txn, opts, &payment, accounts, rate)
+		if err == nil && quote != nil && payment.DestinationAmount != quote.DestinationAmount {
+			err = errors.New("Quote is no longer valid")
+		}
+	}
+	if err != nil {
+		return transfer, err
+	}
+
+	var fee Amount
+	if quote != nil {
+		fee = quote.Fee
+	} else if fee, err = findFee(txn, opts, source, payment.Amount); err != nil {
+		return transfer, err
+	}
+	if err := chargeFee(txn, opts, &transfer, accounts, source, fee); err != nil {
+		return transfer, err
+	}
+	transfer.MandateID = request.MandateID
+	if err := screenTransfer(txn, opts, &transfer, payment, request.Destinations()); err != nil {
+		return transfer, err
+	}
+	// Reviewed transfer doesn't need another approval
+	if transfer.Status == statusPending {
+		if err := requireApproval(opts, &transfer, payment, request.Maker); err != nil {
+			return transfer, err
+		}
+	}
+	if transfer.Status == statusPending {
+		err = postTransfer(txn, &transfer, accounts)
+	} else {
+		err = txn.Create(&transfer).Error
+	}
+	if err != nil {
+		return transfer, err
+	}
+	if quote != nil {
+		return transfer, useQuote(txn, quote, transfer.ID)
+	}
+	return transfer, nil
+}
+
+// makeQuote prices requested payment: calculates its fee and converts amount
+// with the current exchange rate if currencies of accounts involved differ.
+// Balances are not checked, they may change before quote is used anyway.
+// Returns quote valid for `Options.QuoteTTL`, error if payment can't be priced.
+func makeQuote(db *gorm.DB, opts Options, request PaymentRequest) (Quote, error) {
+	var source, dest Account
+	if err := db.First(&source, request.AccountFromID).Error; err != nil {
+		return Quote{}, fmt.Errorf("No account with ID=%d", request.AccountFromID)
+	}
+	if err := db.First(&dest, request.AccountToID).Error; err != nil {
+		return Quote{}, fmt.Errorf("No account with ID=%d", request.AccountToID)
+	}
+	payment, err := request.Payment(source.Currency)
+	if err != nil {
+		return Quote{}, err
+	}
+
+	fee, err := findFee(db, opts, &source, payment.Amount)
+	if err != nil {
+		return Quote{}, err
+	}
+	now := time.Now().UTC()
+	quote := Quote{
+		AccountFromID:       payment.AccountFromID,
+		AccountToID:         payment.AccountToID,
+		Amount:              payment.Amount,
+		Currency:            payment.Currency,
+		DestinationAmount:   payment.Amount,
+		DestinationCurrency: dest.Currency,
+		Fee:                 fee,
+		ExpiresAt:           now.Add(opts.QuoteTTL),
+	}
+	if source.Currency == dest.Currency {
+		return quote, nil
+	}
+	rate, err := findRate(db, source.Currency, dest.Currency, now)
+	if err != nil {
+		return quote, err
+	}
+	quote.ExchangeRateID, quote.Rate = rate.ID, rate.Rate
+	quote.DestinationAmount, err = payment.Amount.Convert(source.Currency, dest.Currency, rate.Rate, opts.rounding(dest.Currency))
+	return quote, err
+}
+
+// loadQuote loads quote by ID within a transaction. With pessimistic
+// concurrency quote is locked until the end of transaction.
+// Returns error if quote doesn't exist.
+func loadQuote(txn *gorm.DB, opts Options, id uint) (*Quote, error) {
+	query := txn
+	if opts.Concurrency != optimisticConcurrency {
+		query = forUpdate(txn)
+	}
+	var quote Quote
+	if err := query.First(&quote, id).Error; err != nil {
+		return nil, fmt.Errorf("No quote with ID=%d", id)
+	}
+	return &quote, nil
+}
+
+// useQuote marks quote as used by transfer. Update only succeeds if quote is
+// not used yet, so concurrent payments can't use the same quote.
+// Returns error if quote was already used.
+func useQuote(txn *gorm.DB, quote *Quote, transferID uint) error {
+	res := txn.Model(&Quote{}).Where("id = ? AND transfer_id = 0", quote.ID).Update("transfer_id", transferID)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected != 1 {
+		return errors.New("Quote was already used")
+	}
+	quote.TransferID = transferID
+	return nil
+}
+
+// saveAccount writes changed account balance and held amount. Update only succeeds if account
+// version is the same as when account was read, version is incremented then.
+// Locked accounts always pass the check, but version is still maintained, so
+// concurrency strategy can be switched any time.
+// Returns errVersionConflict if account was changed concurrently.
+func saveAccount(txn *gorm.DB, account *Account) error {
+	now := time.Now().UTC()
+	res := txn.Exec(`UPDATE accounts SET balance = ?, held = ?, version = version + 1, updated_at = ? WHERE id = ? AND version = ?`,
+		account.Balance, account.Held, now, account.ID, account.Version)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected != 1 {
+		return errVersionConflict
+	}
+	account.Version++
+	account.UpdatedAt = now
+	return nil
+}
+
+// postTransfer writes pending transfer into the journal as posted: changed
+// balances of accounts involved and transfer record with its legs. Legs must
+// be already applied to the accounts (see `Transfer.Apply`), which are loaded
+// within txn.
+// Returns error if transfer is not balanced or account was changed concurrently.
+func postTransfer(txn *gorm.DB, transfer *Transfer, accounts map[uint]*Account) error {
+	if err := transfer.Validate(); err != nil {
+		return err
+	}
+	if err := transfer.SetStatus(statusPosted, ""); err != nil {
+		return err
+	}
+	if err := saveAccounts(txn, transfer, accounts); err != nil {
+		return err
+	}
+	return txn.Create(transfer).Error
+}
+
+// saveAccounts writes changed balances of accounts involved in transfer,
+// in ascending ID order.
+// Returns error if account is missing or was changed concurrently.
+func saveAccounts(txn *gorm.DB, transfer *Transfer, accounts map[uint]*Account) error {
+	ids := make([]uint, 0, len(accounts))
+	for _, leg := range transfer.Payments {
+		if _, ok := accounts[leg.AccountID]; !ok {
+			return fmt.Errorf("No account with ID=%d", leg.AccountID)
+		}
+		ids = append(ids, leg.AccountID)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for i, id := range ids {
+		if i > 0 && ids[i-1] == id {
+			continue
+		}
+		if err := saveAccount(txn, accounts[id]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reviewTransfer completes transfer parked with status (for review or
+// approval) by reviewer decision: approved transfer is posted, its legs are
+// applied to balances of accounts loaded within txn, so balances are checked
+// again. So are limits of the source account: parked transfers don't count
+// towards limit usage, several of them could exceed a limit together.
+// Rejected transfer fails. Review is recorded with the transfer.
+// Returns error if transfer is not parked with status or can't be posted.
+func reviewTransfer(txn *gorm.DB, opts Options, transfer *Transfer, status string, review Review) error {
+	if transfer.Status != status {
+		return fmt.Errorf("Payment is %s, not in %s", transfer.Status, status)
+	}
+	switch review.Decision {
+	case reviewApproved:
+		ids := make([]uint, 0, len(transfer.Payments))
+		for _, leg := range transfer.Payments {
+			ids = append(ids, leg.AccountID)
+		}
+		accounts, err := loadAccounts(txn, opts, ids...)
+		if err != nil {
+			return err
+		}
+		// The first outgoing leg other than fee is paid by the source account
+		for _, leg := range transfer.Payments {
+			if leg.Direction == outgoing && leg.Kind != feeKind {
+				if err := checkLimits(txn, accounts[leg.AccountID], leg.Amount, time.Now().UTC()); err != nil {
+					return err
+				}
+				break
+			}
+		}
+		if err := transfer.Apply(accounts); err != nil {
+			return err
+		}
+		if err := transfer.SetStatus(statusPosted, "Approved by "+review.Reviewer); err != nil {
+			return err
+		}
+		if err := saveAccounts(txn, transfer, accounts); err != nil {
+			return err
+		}
+	case reviewRejected:
+		if err := transfer.SetStatus(statusFailed, "Rejected by "+review.Reviewer); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("Unknown review decision %q", review.Decision)
+	}
+	if err := saveStatus(txn, transfer); err != nil {
+		return err
+	}
+	review.TransferID = transfer.ID
+	if err := txn.Create(&review).Error; err != nil {
+		return err
+	}
+	transfer.Reviews = append(transfer.Reviews, review)
+	return nil
+}
+
+// saveStatus writes status change of a transfer already in the journal
+// (see `Transfer.SetStatus`): status of transfer and its legs and new status
+// history records.
+func saveStatus(txn *gorm.DB, transfer *Transfer) error {
+	if err := txn.Model(&Transfer{}).Where("id = ?", transfer.ID).
+		Updates(map[string]interface{}{"status": transfer.Status, "reason": transfer.Reason}).Error; err != nil {
+		return err
+	}
+	updates := map[string]interface{}{"status": transfer.Status}
+	if transfer.Status == statusPosted {
+		updates["posted_at"] = transfer.PostedAt()
+	}
+	if err := txn.Model(&Payment{}).Where("transfer_id = ?", transfer.ID).
+		Updates(updates).Error; err != nil {
+		return err
+	}
+	for i := range transfer.Transitions {
+		transition := &transfer.Transitions[i]
+		if transition.ID != 0 {
+			continue
+		}
+		transition.TransferID = transfer.ID
+		if err := txn.Create(transition).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// placeHold reserves requested payment amount of the source account until
+// `Options.HoldTTL` passes. Money is not moved, so fees and exchange rates
+// are only applied on capture (see `captureHold`).
+// Returns hold to be created, error if source account doesn't have enough
+// available balance.
+func placeHold(txn *gorm.DB, opts Options, request PaymentRequest) (Hold, error) {
+	accounts, err := loadAccounts(txn, opts, request.AccountFromID, request.AccountToID)
+	if err != nil {
+		return Hold{}, err
+	}
+	source := accounts[request.AccountFromID]
+	payment, err := request.Payment(source.Currency)
+	if err != nil {
+		return Hold{}, err
+	}
+	if source.Available() < payment.Amount {
+		return Hold{}, errNotEnoughBalance
+	}
+	source.Held += payment.Amount
+	if err := saveAccount(txn, source); err != nil {
+		return Hold{}, err
+	}
+	return Hold{
+		AccountFromID: payment.AccountFromID,
+		AccountToID:   payment.AccountToID,
+		Amount:        payment.Amount,
+		Currency:      payment.Currency,
+		Status:        holdActive,
+		ExpiresAt:     time.Now().UTC().Add(opts.HoldTTL),
+	}, nil
+}
+
+// loadHold loads hold by ID within a transaction. Hold is locked until the
+// end of transaction, so it can't be captured or released concurrently.
+// Returns error if hold doesn't exist.
+func loadHold(txn *gorm.DB, id interface{}) (*Hold, error) {
+	var hold Hold
+	if err := forUpdate(txn).First(&hold, id).Error; err != nil {
+		return nil, fmt.Errorf("No hold with ID=%v", id)
+	}
+	return &hold, nil
+}
+
+// releaseHold makes funds reserved by active hold available again and
+// changes hold status (captured, voided or expired).
+// Returns error if hold is not active.
+func releaseHold(txn *gorm.DB, opts Options, hold *Hold, status string) error {
+	if hold.Status != holdActive {
+		return fmt.Errorf("Hold is %s", hold.Status)
+	}
+	accounts, err := loadAccounts(txn, opts, hold.AccountFromID)
+	if err != nil {
+		return err
+	}
+	account := accounts[hold.AccountFromID]
+	account.Held -= hold.Amount
+	if err := saveAccount(txn, account); err != nil {
+		return err
+	}
+	hold.Status = status
+	return txn.Model(&Hold{}).Where("id = ?", hold.ID).Update("status", status).Error
+}
+
+// captureHold turns active hold into a payment of amount (the whole hold if
+// zero) made the same way as any other payment (see `makeTransfer`). The hold
+// is released first, so payment can use held funds. Payment can't be parked
+// for review or approval then: held funds would be available to other
+// payments until it's posted.
+// Returns transfer made (possibly incomplete on error), error if hold can't be
+// captured or payment is not possible.
+func captureHold(txn *gorm.DB, opts Options, hold *Hold, amount Amount) (Transfer, error) {
+	if amount == 0 {
+		amount = hold.Amount
+	}
+	if err := hold.Captures(amount, time.Now().UTC()); err != nil {
+		return Transfer{}, err
+	}
+	if err := releaseHold(txn, opts, hold, holdCaptured); err != nil {
+		return Transfer{}, err
+	}
+	transfer, err := makeTransfer(txn, opts, PaymentRequest{
+		AccountFromID: hold.AccountFromID,
+		AccountToID:   hold.AccountToID,
+		Amount:        amount.Decimal(hold.Currency),
+	})
+	if err != nil {
+		return transfer, err
+	}
+	if transfer.Status != statusPosted {
+		return transfer, fmt.Errorf("Captured payment can't be parked for %s", transfer.Status)
+	}
+	hold.TransferID = transfer.ID
+	return transfer, txn.Model(&Hold{}).Where("id = ?", hold.ID).Update("transfer_id", transfer.ID).Error
+}
+
+// expireHolds releases active holds expired by given time, each in its own
+// transaction.
+// Returns number of holds released and the first error, if any.
+func expireHolds(db *gorm.DB, opts Options, at time.Time) (int, error) {
+	var ids []uint
+	if err := db.Model(&Hold{}).Where("status = ? AND expires_at <= ?", holdActive, at.UTC()).Pluck("id", &ids).Error; err != nil {
+		return 0, err
+	}
+	expired := 0
+	for _, id := range ids {
+		released := false
+		err := runTransfer(db, opts, func(txn *gorm.DB) error {
+			hold, err := loadHold(txn, id)
+			if err != nil {
+				return err
+			}
+			// Captured or voided since
+			if hold.Status != holdActive {
+				return nil
+			}
+			released = true
+			return releaseHold(txn, opts, hold, holdExpired)
+		})
+		if err != nil {
+			return expired, err
+		}
+		if released {
+			expired++
+		}
+	}
+	return expired, nil
+}
+
+// decideApproval approves or declines (see `reviewApproved` and
+// `reviewRejected`) pending approval by checker with optional note: transfer
+// parked for approval is reviewed (see `reviewTransfer`) and approval gets
+// decision status.
+// Returns reviewed transfer, error if checker can't decide or transfer can't
+// be posted.
+func decideApproval(txn *gorm.DB, opts Options, approval *Approval, checker, decision, note string) (Transfer, error) {
+	var transfer Transfer
+	if err := approval.Decide(checker, decision, time.Now().UTC()); err != nil {
+		return transfer, err
+	}
+	// Lock on approval serializes decisions, transfer is only changed with it
+	if err := txn.Preload("Payments").Preload("Screenings").First(&transfer, approval.TransferID).Error; err != nil {
+		return transfer, fmt.Errorf("No transfer with ID=%d", approval.TransferID)
+	}
+	if err := reviewTransfer(txn, opts, &transfer, statusApproval, Review{Reviewer: checker, Decision: decision, Note: note}); err != nil {
+		return transfer, err
+	}
+
+	approval.Checker, approval.Status = checker, approvalApproved
+	if decision == reviewRejected {
+		approval.Status = approvalDeclined
+	}
+	if err := txn.Model(&Approval{}).Where("id = ?", approval.ID).
+		Updates(map[string]interface{}{"checker": approval.Checker, "status": approval.Status}).Error; err != nil {
+		return transfer, err
+	}
+	transfer.Approvals = []Approval{*approval}
+	return transfer, nil
+}
+
+// loadApproval loads approval by ID within a transaction. Approval is locked
+// until the end of transaction, so it can't be decided on concurrently.
+// Returns error if approval doesn't exist.
+func loadApproval(txn *gorm.DB, id interface{}) (*Approval, error) {
+	var approval Approval
+	if err := forUpdate(txn).First(&approval, id).Error; err != nil {
+		return nil, fmt.Errorf("No approval with ID=%v", id)
+	}
+	return &approval, nil
+}
+
+// expireApprovals fails transfers whose approvals are pending, but expired
+// by given time, each in its own transaction.
+// Returns number of approvals expired and the first error, if any.
+func expireApprovals(db *gorm.DB, opts Options, at time.Time) (int, error) {
+	var ids []uint
+	if err := db.Model(&Approval{}).Where("status = ? AND expires_at <= ?", approvalPending, at.UTC()).Pluck("id", &ids).Error; err != nil {
+		return 0, err
+	}
+	expired := 0
+	for _, id := range ids {
+		stale := false
+		err := inTransaction(db, func(txn *gorm.DB) error {
+			approval, err := loadApproval(txn, id)
+			if err != nil {
+				return err
+			}
+			// Decided on since
+			if approval.Status != approvalPending {
+				return nil
+			}
+			stale = true
+			var transfer Transfer
+			if err := txn.Preload("Payments").First(&transfer, approval.TransferID).Error; err != nil {
+				return fmt.Errorf("No transfer with ID=%d", approval.TransferID)
+			}
+			if err := transfer.SetStatus(statusFailed, "Approval expired"); err != nil {
+				return err
+			}
+			if err := saveStatus(txn, &transfer); err != nil {
+				return err
+			}
+			return txn.Model(&Approval{}).Where("id = ?", id).Update("status", approvalExpired).Error
+		})
+		if err != nil {
+			return expired, err
+		}
+		if stale {
+			expired++
+		}
+	}
+	return expired, nil
+}
+
+// requestedPayment converts payment request to be made later into a payment
+// in currency of the source account without locking accounts.
+// Returns error if any account doesn't exist or amount is not valid.
+func requestedPayment(db *gorm.DB, request PaymentRequest) (Payment, error) {
+	var source, dest Account
+	if err := db.First(&source, request.AccountFromID).Error; err != nil {
+		return Payment{}, fmt.Errorf("No account with ID=%d", request.AccountFromID)
+	}
+	if err := db.First(&dest, request.AccountToID).Error; err != nil {
+		return Payment{}, fmt.Errorf("No account with ID=%d", request.AccountToID)
+	}
+	return request.Payment(source.Currency)
+}
+
+// schedulePayment validates requested payment to be made at
+// `PaymentRequest.ExecuteAt`: accounts exist and amount is valid in currency
+// of the source account. Balances and limits are only checked on execution.
+// Returns scheduled payment to be created, error if payment can't be made.
+func schedulePayment(db *gorm.DB, request PaymentRequest) (ScheduledPayment, error) {
+	if request.QuoteID != 0 {
+		return ScheduledPayment{}, errors.New("Quotes can't be used for scheduled payments")
+	}
+	if len(request.Splits) > 0 {
+		return ScheduledPayment{}, errors.New("Split payments can't be scheduled")
+	}
+	if !request.ExecuteAt.After(time.Now().UTC()) {
+		return ScheduledPayment{}, errors.New("Execution time should be in the future")
+	}
+	payment, err := requestedPayment(db, request)
+	if err != nil {
+		return ScheduledPayment{}, err
+	}
+	return ScheduledPayment{
+		AccountFromID: payment.AccountFromID,
+		AccountToID:   payment.AccountToID,
+		Amount:        payment.Amount,
+		Currency:      payment.Currency,
+		Maker:         request.Maker,
+		ExecuteAt:     request.ExecuteAt.UTC(),
+		Status:        scheduleScheduled,
+	}, nil
+}
+
+// claimScheduledPayment atomically changes status of scheduled payment (to
+// executed, failed or canceled) with optional reason. Only one of concurrent
+// claims, possibly by different service replicas, succeeds: the update is
+// conditional on payment still being scheduled.
+// Returns false if payment is not scheduled (any more), true otherwise.
+func claimScheduledPayment(txn *gorm.DB, id uint, status string, reason string) (bool, error) {
+	res := txn.Model(&ScheduledPayment{}).Where("id = ? AND status = ?", id, scheduleScheduled).
+		Updates(map[string]interface{}{"status": status, "reason": reason})
+	return res.RowsAffected == 1, res.Error
+}
+
+// executeScheduledPayment makes scheduled payment with id the same way as
+// POST /payments does (see `makeTransfer`). Failed payment is recorded (see
+// `recordFailure`) and scheduled payment becomes failed with the reason.
+// Returns false if payment was executed or canceled concurrently, true
+// otherwise; error only if outcome can't be recorded.
+func executeScheduledPayment(db *gorm.DB, opts Options, id uint) (bool, error) {
+	var scheduled ScheduledPayment
+	if err := db.First(&scheduled, id).Error; err != nil {
+		return false, err
+	}
+
+	// attempt keeps transfer legs (if it got that far) to record failure
+	var attempt Transfer
+	claimed := false
+	err := runTransfer(db, opts, func(txn *gorm.DB) (err error) {
+		attempt = Transfer{}
+		if claimed, err = claimScheduledPayment(txn, id, scheduleExecuted, ""); err != nil || !claimed {
+			return err
+		}
+		if attempt, err = makeTransfer(txn, opts, scheduled.Request()); err != nil {
+			return err
+		}
+		return txn.Model(&ScheduledPayment{}).Where("id = ?", id).Update("transfer_id", attempt.ID).Error
+	})
+	if err == nil {
+		return claimed, nil
+	}
+
+	reason := err.Error()
+	claimed = false
+	err = inTransaction(db, func(txn *gorm.DB) (err error) {
+		// Payment could be made by another replica meanwhile
+		if claimed, err = claimScheduledPayment(txn, id, scheduleFailed, reason); err != nil || !claimed {
+			return err
+		}
+		failed, err := recordFailure(txn, attempt, reason)
+		if err != nil {
+			return err
+		}
+		return txn.Model(&ScheduledPayment{}).Where("id = ?", id).Update("transfer_id", failed.ID).Error
+	})
+	return claimed, err
+}
+
+// executeScheduledPayments executes payments scheduled by given time, in order
+// of their execution time, each in its own transaction. Execution times are
+// stored in UTC, sqlite3 compares them as strings.
+// Returns number of payments executed (made or failed) and the first error,
+// if any.
+func executeScheduledPayments(db *gorm.DB, opts Options, at time.Time) (int, error) {
+	var ids []uint
+	if err := db.Model(&ScheduledPayment{}).Where("status = ? AND execute_at <= ?", scheduleScheduled, at.UTC()).
+		Order("execute_at, id").Pluck("id", &ids).Error; err != nil {
+		return 0, err
+	}
+	executed := 0
+	for _, id := range ids {
+		claimed, err := executeScheduledPayment(db, opts, id)
+		if err != nil {
+			return executed, err
+		}
+		if claimed {
+			executed++
+		}
+	}
+	return executed, nil
+}
+
+// makeMandate validates requested mandate (see `Mandate`) made by maker at
+// given time. The first occurrence is due at start time (or the first one
+// after it for cron schedules), but not before the mandate is made.
+// Returns active mandate to be created, error if it's not valid.
+func makeMandate(db *gorm.DB, request MandateRequest, maker string, at time.Time) (Mandate, error) {
+	payment, err := requestedPayment(db, PaymentRequest{
+		AccountFromID: request.AccountFromID,
+		AccountToID:   request.AccountToID,
+		Amount:        request.Amount,
+	})
+	if err != nil {
+		return Mandate{}, err
+	}
+	mandate := Mandate{
+		AccountFromID:       payment.AccountFromID,
+		AccountToID:         payment.AccountToID,
+		Amount:              payment.Amount,
+		Currency:            payment.Currency,
+		Maker:               maker,
+		Schedule:            request.Schedule,
+		StartAt:             at.UTC(),
+		OnInsufficientFunds: request.OnInsufficientFunds,
+		Retries:             request.Retries,
+		Status:              mandateActive,
+	}
+	if request.StartAt != nil {
+		mandate.StartAt = request.StartAt.UTC()
+	}
+	switch mandate.OnInsufficientFunds {
+	case "":
+		mandate.OnInsufficientFunds = insufficientSkip
+	case insufficientSkip, insufficientSuspend:
+	case insufficientRetry:
+		if mandate.Retries <= 0 {
+			return Mandate{}, errors.New("Retries should be positive")
+		}
+	default:
+		return Mandate{}, fmt.Errorf("Unknown insufficient funds behavior %q", mandate.OnInsufficientFunds)
+	}
+
+	recurrence, err := mandate.Recurrence()
+	if err != nil {
+		return Mandate{}, err
+	}
+	from := mandate.StartAt
+	if from.Before(at) {
+		from = at
+	}
+	if mandate.DueAt = recurrence.Next(from.Add(-time.Nanosecond)); mandate.DueAt.IsZero() {
+		return Mandate{}, errNoOccurrence
+	}
+	mandate.NextRunAt = mandate.DueAt
+	return mandate, nil
+}
+
+// saveMandate writes mandate changes unless it was changed since it was read
+// (by a concurrent execution, possibly in another service replica).
+// Returns false if mandate was changed, true otherwise.
+func saveMandate(txn *gorm.DB, mandate *Mandate) (bool, error) {
+	res := txn.Model(&Mandate{}).Where("id = ? AND version = ?", mandate.ID, mandate.Version).
+		Updates(map[string]interface{}{
+			"status":      mandate.Status,
+			"reason":      mandate.Reason,
+			"due_at":      mandate.DueAt,
+			"next_run_at": mandate.NextRunAt,
+			"attempts":    mandate.Attempts,
+			"version":     mandate.Version + 1,
+		})
+	if res.Error != nil || res.RowsAffected != 1 {
+		return false, res.Error
+	}
+	mandate.Version++
+	return true, nil
+}
+
+// loadMandate loads mandate by ID within a transaction. Mandate is locked
+// until the end of transaction.
+// Returns error if mandate doesn't exist.
+func loadMandate(txn *gorm.DB, id interface{}) (*Mandate, error) {
+	var mandate Mandate
+	if err := forUpdate(txn).First(&mandate, id).Error; err != nil {
+		return nil, fmt.Errorf("No mandate with ID=%v", id)
+	}
+	return &mandate, nil
+}
+
+// executeMandate pays due occurrence of mandate with id at given time the
+// same way as POST /payments does (see `makeTransfer`), the payment is linked
+// to the mandate. Failed payment is recorded (see `recordFailure`), lack of
+// funds is handled as mandate says (see `Mandate.Fail`) and the occurrence is
+// skipped on other failures. Mandate times are kept in UTC, see
+// `executeMandates`.
+// Returns false if occurrence is not due (e.g. it was paid concurrently),
+// true otherwise; error only if outcome can't be recorded.
+func executeMandate(db *gorm.DB, opts Options, id uint, at time.Time) (bool, error) {
+	at = at.UTC()
+	var mandate Mandate
+	if err := db.First(&mandate, id).Error; err != nil {
+		return false, err
+	}
+	// Paid, paused or canceled since it was found due
+	if mandate.Status != mandateActive || mandate.NextRunAt.After(at) {
+		return false, nil
+	}
+	recurrence, err := mandate.Recurrence()
+	if err != nil {
+		return false, err
+	}
+
+	// attempt keeps transfer legs (if it got that far) to record failure
+	var attempt Transfer
+	claimed := false
+	err = runTransfer(db, opts, func(txn *gorm.DB) (err error) {
+		attempt = Transfer{}
+		paid := mandate
+		paid.Advance(recurrence, at)
+		if claimed, err = saveMandate(txn, &paid); err != nil || !claimed {
+			return err
+		}
+		attempt, err = makeTransfer(txn, opts, mandate.Request())
+		return err
+	})
+	if err == nil {
+		return claimed, nil
+	}
+
+	reason := err.Error()
+	failed := mandate
+	if err == errNotEnoughBalance {
+		failed.Fail(recurrence, at, opts.MandateRetryInterval)
+	} else {
+		failed.Advance(recurrence, at)
+	}
+	claimed = false
+	err = inTransaction(db, func(txn *gorm.DB) (err error) {
+		// Occurrence could be paid by another replica meanwhile
+		if claimed, err = saveMandate(txn, &failed); err != nil || !claimed {
+			return err
+		}
+		attempt.MandateID = mandate.ID
+		_, err = recordFailure(txn, attempt, reason)
+		return err
+	})
+	return claimed, err
+}
+
+// executeMandates pays occurrences of active mandates due by given time, each
+// in its own transaction. Run times are stored in UTC, sqlite3 compares them
+// as strings.
+// Returns number of occurrences attempted and the first error, if any.
+func executeMandates(db *gorm.DB, opts Options, at time.Time) (int, error) {
+	var ids []uint
+	if err := db.Model(&Mandate{}).Where("status = ? AND next_run_at <= ?", mandateActive, at.UTC()).
+		Order("next_run_at, id").Pluck("id", &ids).Error; err != nil {
+		return 0, err
+	}
+	executed := 0
+	for _, id := range ids {
+		claimed, err := executeMandate(db, opts, id, at)
+		if err != nil {
+			return executed, err
+		}
+		if claimed {
+			executed++
+		}
+	}
+	return executed, nil
+}
+
+// lockBatchAccounts locks accounts of all payments of all-or-nothing batch
+// the same way as `loadAccounts` does before any of them is made, so
+// concurrent batches and transfers between the same accounts can't deadlock
+// each other. Unknown accounts are skipped, their payments fail later.
+func lockBatchAccounts(txn *gorm.DB, opts Options, batch *PaymentBatch) error {
+	if opts.Concurrency == optimisticConcurrency {
+		return nil
+	}
+	ids := make([]uint, 0, 2*len(batch.Items))
+	for _, item := range batch.Items {
+		ids = append(ids, item.AccountFromID, item.AccountToID)
+	}
+	var existing []uint
+	if err := txn.Model(&Account{}).Where("id IN (?)", ids).Pluck("id", &existing).Error; err != nil {
+		return err
+	}
+	_, err := loadAccounts(txn, opts, existing...)
+	return err
+}
+
+// makeBatch makes payments of all-or-nothing batch in a single transaction,
+// each the same way as POST /payments does (see `makeTransfer`), and creates
+// completed batch along with them. Accounts of all payments are locked
+// upfront, see `lockBatchAccounts`. If any payment is not possible, none is
+// made.
+// Returns position of payment which is not possible (-1 if it's commit which
+// failed) with its transfer (to record the failure, see `recordBatchFailure`)
+// and error, nil on success.
+func makeBatch(db *gorm.DB, opts Options, batch *PaymentBatch) (int, Transfer, error) {
+	var attempt Transfer
+	failed := -1
+	err := runTransfer(db, opts, func(txn *gorm.DB) (err error) {
+		attempt, failed = Transfer{}, -1
+		made := *batch
+		made.Items = append([]BatchItem(nil), batch.Items...)
+		if err := lockBatchAccounts(txn, opts, &made); err != nil {
+			return err
+		}
+		for i := range made.Items {
+			if attempt, err = makeTransfer(txn, opts, made.Items[i].Request(batch.Maker)); err != nil {
+				failed = i
+				return err
+			}
+			made.Items[i].Status, made.Items[i].TransferID = attempt.Status, attempt.ID
+		}
+		made.Status = batchCompleted
+		if err := txn.Create(&made).Error; err != nil {
+			return err
+		}
+		*batch = made
+		return nil
+	})
+	return failed, attempt, err
+}
+
+// recordBatchFailure creates all-or-nothing batch none of whose payments is
+// made because payment at position failed (see `makeBatch`) with error.
+// Failure of the payment is recorded as well, see `recordFailure`.
+func recordBatchFailure(db *gorm.DB, batch *PaymentBatch, failed int, attempt Transfer, reason string) error {
+	batch.Status = batchFailed
+	for i := range batch.Items {
+		batch.Items[i].Status, batch.Items[i].Error = statusFailed, reason
+		if failed >= 0 && i != failed {
+			batch.Items[i].Error = fmt.Sprintf("Payment #%d of the batch is not possible", failed)
+		}
+	}
+	return inTransaction(db, func(txn *gorm.DB) error {
+		if failed >= 0 {
+			transfer, err := recordFailure(txn, attempt, reason)
+			if err != nil {
+				return err
+			}
+			batch.Items[failed].TransferID = transfer.ID
+		}
+		return txn.Create(batch).Error
+	})
+}
+
+// makeBatchItems creates best-effort batch and makes its payments one by one,
+// each the same way as POST /payments does (see `makeTransfer`) in its own
+// transaction along with its item status. Failed payments are recorded (see
+// `recordFailure`) and don't stop the rest. Batch is completed once all its
+// payments are attempted.
+// Returns error only if batch or payment outcome can't be written.
+func makeBatchItems(db *gorm.DB, opts Options, batch *PaymentBatch) error {
+	batch.Status = batchProcessing
+	for i := range batch.Items {
+		batch.Items[i].Status = statusPending
+	}
+	if err := db.Create(batch).Error; err != nil {
+		return err
+	}
+
+	for i := range batch.Items {
+		item := &batch.Items[i]
+		// attempt keeps transfer legs (if it got that far) to record failure
+		var attempt Transfer
+		err := runTransfer(db, opts, func(txn *gorm.DB) (err error) {
+			if attempt, err = makeTransfer(txn, opts, item.Request(batch.Maker)); err != nil {
+				return err
+			}
+			return updateBatchItem(txn, item, attempt.Status, attempt.ID, "")
+		})
+		if err == nil {
+			continue
+		}
+		reason := err.Error()
+		if err := inTransaction(db, func(txn *gorm.DB) error {
+			failed, err := recordFailure(txn, attempt, reason)
+			if err != nil {
+				return err
+			}
+			return updateBatchItem(txn, item, statusFailed, failed.ID, reason)
+		}); err != nil {
+			return err
+		}
+	}
+	batch.Complete()
+	return db.Model(&PaymentBatch{}).Where("id = ?", batch.ID).Update("status", batch.Status).Error
+}
+
+// updateBatchItem writes outcome of batch item payment: status of its
+// transfer and error if payment is not possible.
+func updateBatchItem(txn *gorm.DB, item *BatchItem, status string, transferID uint, reason string) error {
+	item.Status, item.TransferID, item.Error = status, transferID, reason
+	return txn.Model(&BatchItem{}).Where("id = ?", item.ID).
+		Updates(map[string]interface{}{"status": status, "transfer_id": transferID, "error": reason}).Error
+}
+
+// runTransfer runs fn in a database transaction. With optimistic concurrency
+// whole transaction is retried on version conflict, up to
+// `Options.TransferAttempts` times.
+// Returns fn or commit error, nil on success.
+func runTransfer(db *gorm.DB, opts Options, fn func(txn *gorm.DB) error) (err error) {
+	for attempt := 1; ; attempt++ {
+		err = inTransaction(db, fn)
+		if err != errVersionConflict || attempt >= opts.TransferAttempts {
+			return err
+		}
+	}
+}
+
+// refundedAmount returns amount refunded by posted reversals of transfer
+func refundedAmount(txn *gorm.DB, transferID uint) (Amount, error) {
+	var refunds []Transfer
+	if err := txn.Preload("Payments").Where("reversal_of_id = ? AND status = ?", transferID, statusPosted).Find(&refunds).Error; err != nil {
+		return 0, err
+	}
+	var refunded Amount
+	for _, refund := range refunds {
+		amount, _ := refund.Total()
+		refunded += amount
+	}
+	return refunded, nil
+}
+
+// recordFailure writes rejected transfer into the journal as failed, with
+// the rejection reason and screening decisions. Failed transfer legs don't
+// change balances. Transfer may come from rolled back transaction, it's
+// written from scratch then.
+// Returns failed transfer.
+func recordFailure(db *gorm.DB, transfer Transfer, reason string) (Transfer, error) {
+	failed := Transfer{
+		ReversalOfID: transfer.ReversalOfID,
+		MandateID:    transfer.MandateID,
+		Payments:     make([]Payment, len(transfer.Payments)),
+		Screenings:   make([]Screening, len(transfer.Screenings)),
+	}
+	for i, leg := range transfer.Payments {
+		leg.Model, leg.TransferID, leg.PostedAt = gorm.Model{}, 0, nil
+		failed.Payments[i] = leg
+	}
+	for i, screening := range transfer.Screenings {
+		screening.ID, screening.TransferID = 0, 0
+		failed.Screenings[i] = screening
+	}
+	if err := failed.SetStatus(statusPending, ""); err != nil {
+		return failed, err
+	}
+	if err := failed.SetStatus(statusFailed, reason); err != nil {
+		return failed, err
+	}
+	return failed, db.Create(&failed).Error
+}
+
+// postedPayments selects posted journal entries of account.
+func postedPayments(db *gorm.DB, accountID uint) *gorm.DB {
+	return db.Model(&Payment{}).Where("payments.account_id = ? AND "+postedSQL, accountID)
+}
+
+// postedSum sums journal entries selected by query.
+func postedSum(query *gorm.DB) (sum Amount, err error) {
+	err = query.Select("COALESCE(SUM(" + signedAmountSQL + "), 0)").Row().Scan(&sum)
+	return sum, err
+}
+
+// balanceAt returns balance of account at given time, that is its opening
+// balance plus payments posted before that time. Journal entries are summed
+// from the nearer end of account history: forward from the opening balance or
+// back from the current one, so recent balances of accounts with long history
+// don't sum it all. Either way only the entries in range are read by payments
+// index on account and posting time. Account must be loaded within the same
+// transaction, so its balance matches the journal. Time should not be before
+// the account was opened, it has opening balance then.
+func balanceAt(txn *gorm.DB, account Account, at time.Time) (Amount, error) {
+	at = at.UTC()
+	if at.Sub(account.CreatedAt) < time.Since(at) {
+		before, err := postedSum(postedPayments(txn, account.ID).Where("payments.posted_at < ?", at))
+		return account.OpeningBalance + before, err
+	}
+	after, err := postedSum(postedPayments(txn, account.ID).Where("payments.posted_at >= ?", at))
+	return account.Balance - after, err
+}
+
+// accountStatement makes statement of account for period from (inclusive,
+// since the account was opened if zero) to (exclusive), see `Statement`.
+// Payments belong to the period they were posted in. Statement is a page of
+// at most limit movements following cursor movement (from the start of the
+// period if zero), its NextCursor is set when there are more. Account must be
+// loaded within the same transaction, see `balanceAt`.
+func accountStatement(txn *gorm.DB, account Account, from time.Time, to time.Time, cursor uint, limit int) (Statement, error) {
+	statement := Statement{AccountID: account.ID, Currency: account.Currency, To: to.UTC(), OpeningBalance: account.OpeningBalance}
+	query := postedPayments(txn, account.ID).Where("payments.posted_at < ?", statement.To)
+	if !from.IsZero() {
+		from = from.UTC()
+		statement.From = &from
+		query = query.Where("payments.posted_at >= ?", from)
+	}
+	if cursor != 0 {
+		var last Payment
+		if err := query.Where("payments.id = ?", cursor).First(&last).Error; err != nil {
+			return statement, fmt.Errorf("No movement with ID=%d in statement", cursor)
+		}
+		// Balance right after the cursor movement: entries posted at the same
+		// time are ordered by ID
+		balance, err := balanceAt(txn, account, *last.PostedAt)
+		if err != nil {
+			return statement, err
+		}
+		same, err := postedSum(postedPayments(txn, account.ID).Where("payments.posted_at = ? AND payments.id <= ?", *last.PostedAt, last.ID))
+		if err != nil {
+			return statement, err
+		}
+		statement.OpeningBalance = balance + same
+		query = query.Where("payments.posted_at > ? OR (payments.posted_at = ? AND payments.id > ?)", *last.PostedAt, *last.PostedAt, last.ID)
+	} else if !from.IsZero() {
+		var err error
+		if statement.OpeningBalance, err = balanceAt(txn, account, from); err != nil {
+			return statement, err
+		}
+	}
+	statement.ClosingBalance = statement.OpeningBalance
+	var movements []Payment
+	if err := query.Order("payments.posted_at, payments.id").Limit(limit + 1).Find(&movements).Error; err != nil {
+		return statement, err
+	}
+	if len(movements) > limit {
+		movements = movements[:limit]
+		statement.NextCursor = movements[limit-1].ID
+	}
+	for _, payment := range movements {
+		statement.Add(payment)
+	}
+	return statement, nil
+}
+
+// Discrepancy is an account whose balance doesn't match its journal,
+// that is opening balance plus all its journal entries.
+type Discrepancy struct {
+	AccountID      uint
+	Currency       string
+	Balance        Amount
+	JournalBalance Amount
+}
+
+// findDiscrepancies reconciles account balances against the journal.
+// Returns accounts with mismatched balances, paginated with offset.
+func findDiscrepancies(db *gorm.DB, offset int) ([]Discrepancy, error) {
+	var res []Discrepancy
+	err := db.Table("accounts").
+		Select("accounts.id AS account_id, accounts.currency, accounts.balance, " +
+			"accounts.opening_balance + COALESCE(SUM(" + signedAmountSQL + "), 0) AS journal_balance").
+		Joins("LEFT JOIN payments ON payments.account_id = accounts.id AND payments.deleted_at IS NULL AND " + postedSQL).
+		Group("accounts.id, accounts.currency, accounts.balance, accounts.opening_balance").
+		Having("accounts.balance <> accounts.opening_balance + COALESCE(SUM(" + signedAmountSQL + "), 0)").
+		Order("accounts.id").
+		Offset(offset).Limit(itemsPerPage).
+		Scan(&res).Error
+	return res, err
+}
@@ -2,7 +2,10 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 
@@ -10,6 +13,332 @@ import (
 	_ "github.com/jinzhu/gorm/dialects/mysql"
 )
 
+// Concurrency strategies for transfers, see `Options.Concurrency`
+const (
+	pessimisticConcurrency = "pessimistic"
+	optimisticConcurrency  = "optimistic"
+)
+
+// Options are service settings set on startup
+type Options struct {
+	// Concurrency is either `pessimistic` to lock accounts with `SELECT ... FOR UPDATE`
+	// during transfer or `optimistic` to check account version on update instead,
+	// for databases without row locks.
+	Concurrency string
+	// TransferAttempts is max number of attempts to make a transfer on
+	// optimistic concurrency conflict.
+	TransferAttempts int
+	// QuoteTTL is how long quote is valid for, see `Quote`.
+	QuoteTTL time.Duration
+	// HoldTTL is how long hold reserves funds unless captured or voided,
+	// see `Hold`.
+	HoldTTL time.Duration
+	// ApprovalThresholds maps currency to amount payments above which need
+	// approval, see `Approval`. Payments in other currencies don't.
+	ApprovalThresholds map[string]Amount
+	// ApprovalTTL is how long approval requests are valid for.
+	ApprovalTTL time.Duration
+	// ExpiryInterval is how often expired holds and approvals are released.
+	ExpiryInterval time.Duration
+	// ScheduleInterval is how often due scheduled payments and mandates are
+	// executed, see `ScheduledPayment` and `Mandate`.
+	ScheduleInterval time.Duration
+	// MandateRetryInterval is how long to wait before retrying mandate
+	// payment which failed for lack of funds, see `Mandate.Fail`.
+	MandateRetryInterval time.Duration
+	// Screener screens payments before they are made, payments are not
+	// screened if it's nil. See `ScreeningRules`.
+	Screener Screener
+	// Rounding maps currency to rounding mode of amounts converted into it,
+	// see `Amount.Convert`. Other currencies use `defaultRounding`.
+	Rounding map[string]string
+}
+
+// rounding returns rounding mode of amounts converted into currency
+func (o Options) rounding(currency string) string {
+	if rounding, ok := o.Rounding[currency]; ok {
+		return rounding
+	}
+	return defaultRounding
+}
+
+// parseRounding parses rounding modes of currencies from comma separated
+// list of currency=mode pairs, e.g. "JPY=down,USD=half-even".
+// Returns error if currency or rounding mode is not known.
+func parseRounding(value string) (map[string]string, error) {
+	res := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || !supportedCurrency(parts[0]) || !knownRounding(parts[1]) {
+			return nil, fmt.Errorf("Invalid rounding %q", pair)
+		}
+		res[parts[0]] = parts[1]
+	}
+	return res, nil
+}
+
+// parseThresholds parses amounts per currency from comma separated list of
+// currency=amount pairs, e.g. "USD=1000.00,EUR=900".
+// Returns error if currency is not known or amount is not valid.
+func parseThresholds(value string) (map[string]Amount, error) {
+	res := make(map[string]Amount)
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || !supportedCurrency(parts[0]) {
+			return nil, fmt.Errorf("Invalid threshold %q", pair)
+		}
+		amount, err := Decimal(parts[1]).Amount(parts[0])
+		if err != nil || amount < 0 {
+			return nil, fmt.Errorf("Invalid threshold %q", pair)
+		}
+		res[parts[0]] = amount
+	}
+	return res, nil
+}
+
+// defaultOptions returns service settings used unless overridden with flags
+func defaultOptions() Options {
+	return Options{
+		Concurrency:          pessimisticConcurrency,
+		TransferAttempts:     5,
+		QuoteTTL:             time.Minute,
+		HoldTTL:              7 * 24 * time.Hour,
+		ApprovalTTL:          24 * time.Hour,
+		ExpiryInterval:       time.Minute,
+		ScheduleInterval:     time.Minute,
+		MandateRetryInterval: time.Hour,
+	}
+}
+
+// migrations are one-off data migrations `AutoMigrate` can't do. Each one is
+// applied only once (see `SchemaMigration`) inside a transaction, then optional
+// `alter` step changes column types which can't be done transactionally.
+var migrations = []struct {
+	name  string
+	apply func(txn *gorm.DB) error
+	alter func(db *gorm.DB) error
+}{
+	{name: "minor_units", apply: migrateMinorUnits, alter: alterMinorUnits},
+	{name: "opening_balances", apply: migrateOpeningBalances},
+	{name: "payment_statuses", apply: migratePaymentStatuses},
+	{name: "held_amounts", apply: migrateHeldAmounts},
+	{name: "overdraft_limits", apply: migrateOverdraftLimits, alter: alterOverdraftLimits},
+	{name: "posted_at", apply: migratePostedAt},
+	{name: "idempotency_requesters", apply: migrateIdempotencyRequesters, alter: alterIdempotencyRequesters},
+}
+
+// migrateMinorUnits converts floating point balances and payment amounts into
+// minor units of their currency. Payments get currency of their account.
+// Currencies weren't validated before, they are uppercased and every one of
+// them is converted, those unknown to `currencyExponents` with the exponent
+// they are read with (see `currencyExponent`).
+func migrateMinorUnits(txn *gorm.DB) error {
+	for _, statement := range []string{
+		`UPDATE accounts SET currency = UPPER(currency)`,
+		`UPDATE payments SET currency = (SELECT currency FROM accounts WHERE accounts.id = payments.account_id) WHERE currency IS NULL OR currency = ''`,
+		`UPDATE payments SET currency = UPPER(currency)`,
+	} {
+		if err := txn.Exec(statement).Error; err != nil {
+			return err
+		}
+	}
+	rows, err := txn.Raw(`SELECT currency FROM accounts UNION SELECT currency FROM payments WHERE currency IS NOT NULL`).Rows()
+	if err != nil {
+		return err
+	}
+	var currencies []string
+	for rows.Next() {
+		var currency string
+		if err := rows.Scan(&currency); err != nil {
+			rows.Close()
+			return err
+		}
+		currencies = append(currencies, currency)
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+
+	for _, currency := range currencies {
+		factor := 1
+		for i := 0; i < currencyExponent(currency); i++ {
+			factor *= 10
+		}
+		if err := txn.Exec(`UPDATE accounts SET balance = ROUND(balance * ?) WHERE currency = ?`, factor, currency).Error; err != nil {
+			return err
+		}
+		if err := txn.Exec(`UPDATE payments SET amount = ROUND(amount * ?) WHERE currency = ?`, factor, currency).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// alterMinorUnits changes money columns type to integer. sqlite3 can't change
+// column type, its tables are rebuilt instead (see `rebuildTable`), otherwise
+// whole amounts would still be read as floating point numbers.
+func alterMinorUnits(db *gorm.DB) error {
+	if db.NewScope(nil).Dialect().GetName() == "sqlite3" {
+		if err := inTransaction(db, func(txn *gorm.DB) error {
+			if err := rebuildTable(txn, &Account{}, "balance"); err != nil {
+				return err
+			}
+			return rebuildTable(txn, &Payment{}, "amount")
+		}); err != nil {
+			return err
+		}
+		// Indexes are looked up outside of the transaction, where dropped
+		// indexes of the old tables still existed
+		return db.AutoMigrate(&Account{}, &Payment{}).Error
+	}
+	if err := db.Model(&Account{}).ModifyColumn("balance", "bigint").Error; err != nil {
+		return err
+	}
+	return db.Model(&Payment{}).ModifyColumn("amount", "bigint").Error
+}
+
+// rebuildTable recreates table of model with its current schema and copies
+// rows into it, casting integer columns. This is how column types are changed
+// with sqlite3. Table must have all columns of the model already, indexes
+// are not recreated within transaction.
+func rebuildTable(txn *gorm.DB, model interface{}, integers ...string) error {
+	scope := txn.NewScope(model)
+	table := scope.QuotedTableName()
+	old := scope.Quote(scope.TableName() + "_old")
+	var columns, values []string
+	for _, field := range scope.GetModelStruct().StructFields {
+		if !field.IsNormal {
+			continue
+		}
+		column := scope.Quote(field.DBName)
+		value := column
+		for _, integer := range integers {
+			if field.DBName == integer {
+				value = "CAST(ROUND(" + column + ") AS INTEGER)"
+			}
+		}
+		columns, values = append(columns, column), append(values, value)
+	}
+
+	if err := txn.Exec(`CREATE TABLE ` + old + ` AS SELECT * FROM ` + table).Error; err != nil {
+		return err
+	}
+	if err := txn.DropTable(model).Error; err != nil {
+		return err
+	}
+	if err := txn.CreateTable(model).Error; err != nil {
+		return err
+	}
+	if err := txn.Exec(`INSERT INTO ` + table + ` (` + strings.Join(columns, ", ") + `) SELECT ` + strings.Join(values, ", ") + ` FROM ` + old).Error; err != nil {
+		return err
+	}
+	return txn.Exec(`DROP TABLE ` + old).Error
+}
+
+// migrateOpeningBalances sets opening balance of accounts created before
+// the journal, so their balances reconcile with payments made since then.
+// Payments made before the journal don't belong to any transfer.
+func migrateOpeningBalances(txn *gorm.DB) error {
+	return txn.Exec(`UPDATE accounts SET opening_balance = balance - COALESCE((SELECT SUM(` + signedAmountSQL + `) FROM payments WHERE payments.account_id = accounts.id AND payments.deleted_at IS NULL), 0)`).Error
+}
+
+// migratePaymentStatuses marks transfers and payments made before statuses
+// were introduced as posted: only successful payments were stored then.
+func migratePaymentStatuses(txn *gorm.DB) error {
+	for _, table := range []string{"transfers", "payments"} {
+		if err := txn.Exec(`UPDATE `+table+` SET status = ? WHERE status IS NULL OR status = ''`, statusPosted).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateHeldAmounts sets held amount of accounts created before holds,
+// nothing could be held on them.
+func migrateHeldAmounts(txn *gorm.DB) error {
+	return txn.Exec(`UPDATE accounts SET held = 0 WHERE held IS NULL`).Error
+}
+
+// migrateOverdraftLimits sets overdraft limit of accounts created before
+// limits were introduced, none of them could go below zero.
+func migrateOverdraftLimits(txn *gorm.DB) error {
+	return txn.Exec(`UPDATE accounts SET overdraft_limit = 0 WHERE overdraft_limit IS NULL`).Error
+}
+
+// migratePostedAt sets posting time of payments posted before it was recorded:
+// when their transfer was posted or, lacking status history, when they were
+// made.
+func migratePostedAt(txn *gorm.DB) error {
+	return txn.Exec(`UPDATE payments SET posted_at = COALESCE((SELECT MIN(status_transitions.created_at) FROM status_transitions WHERE status_transitions.transfer_id = payments.transfer_id AND status_transitions.to_status = ?), payments.created_at) WHERE posted_at IS NULL AND `+postedSQL, statusPosted).Error
+}
+
+// migrateIdempotencyRequesters scopes idempotency keys stored before they
+// were scoped by requester to requests without API user.
+func migrateIdempotencyRequesters(txn *gorm.DB) error {
+	return txn.Exec(`UPDATE idempotency_keys SET requester = '' WHERE requester IS NULL`).Error
+}
+
+// alterIdempotencyRequesters drops unique index of idempotency keys
+// superseded by unique index of requester and key.
+func alterIdempotencyRequesters(db *gorm.DB) error {
+	dialect := db.NewScope(nil).Dialect()
+	if !dialect.HasIndex("idempotency_keys", "uix_idempotency_keys_key") {
+		return nil
+	}
+	return dialect.RemoveIndex("idempotency_keys", "uix_idempotency_keys_key")
+}
+
+// alterOverdraftLimits drops positive balance constraint superseded by
+// balance floor constraint, which takes overdraft limit into account.
+// This will not work with sqlite3, which doesn't have the constraint either.
+func alterOverdraftLimits(db *gorm.DB) error {
+	return db.Exec(`ALTER TABLE accounts DROP CHECK positive_balance`).Error
+}
+
+// runMigrations applies `migrations` not applied yet.
+// Returns nil on success and error otherwise.
+func runMigrations(db *gorm.DB) error {
+	for _, migration := range migrations {
+		err := db.Where(&SchemaMigration{Name: migration.name}).First(&SchemaMigration{}).Error
+		if err == nil {
+			continue
+		}
+		if err != gorm.ErrRecordNotFound {
+			return err
+		}
+
+		if err := inTransaction(db, func(txn *gorm.DB) error {
+			if err := migration.apply(txn); err != nil {
+				return err
+			}
+			return txn.Create(&SchemaMigration{Name: migration.name}).Error
+		}); err != nil {
+			return fmt.Errorf("%s migration failed: %s", migration.name, err)
+		}
+		if migration.alter != nil {
+			if err := migration.alter(db); err != nil {
+				log.Println(err.Error())
+			}
+		}
+		log.Printf("Applied %s migration", migration.name)
+	}
+	return nil
+}
+
+// Timestamps are written in UTC, including those set by gorm: sqlite3
+// compares them as strings, so times in different zones don't compare right.
+func init() {
+	gorm.NowFunc = func() time.Time {
+		return time.Now().UTC()
+	}
+}
+
 // setupDatabase opens database "connection" (connection pool to be more
 // strict) and migrates schema
 func setupDatabase(dialect string, connect string) (*gorm.DB, error) {
@@ -20,31 +349,164 @@ func setupDatabase(dialect string, connect string) (*gorm.DB, error) {
 	}
 	db.AutoMigrate(&Account{})
 	db.AutoMigrate(&Payment{})
+	db.AutoMigrate(&Transfer{})
+	db.AutoMigrate(&StatusTransition{})
+	db.AutoMigrate(&IdempotencyKey{})
+	db.AutoMigrate(&ExchangeRate{})
+	db.AutoMigrate(&Quote{})
+	db.AutoMigrate(&FeeSchedule{})
+	db.AutoMigrate(&Hold{})
+	db.AutoMigrate(&Limit{})
+	db.AutoMigrate(&Screening{})
+	db.AutoMigrate(&Review{})
+	db.AutoMigrate(&Approval{})
+	db.AutoMigrate(&ScheduledPayment{})
+	db.AutoMigrate(&Mandate{})
+	db.AutoMigrate(&PaymentBatch{})
+	db.AutoMigrate(&BatchItem{})
+	db.AutoMigrate(&SchemaMigration{})
+	if err := runMigrations(db); err != nil {
+		db.Close()
+		return nil, err
+	}
 
 	// As `gorm` doesn't have constraints we have to do this manually,
-	// there is open PR for that.
+	// there is open PR for that. Balance may only go below zero down to
+	// account overdraft limit (see `Account.Available`).
 	// This will not work with sqlite3 as it expects CONSTRAINTs to be defined
 	// during CREATE TABLE statement.
-	if err := db.Raw(`ALTER TABLE accounts ADD CONSTRAINT positive_balance CHECK (balance >= 0);`).Error; err != nil {
+	if err := db.Exec(`ALTER TABLE accounts ADD CONSTRAINT balance_floor CHECK (balance + overdraft_limit >= 0);`).Error; err != nil {
 		log.Println(err.Error())
 	}
 	return db, nil
 }
 
 // setupRouter will create GIN router engine fot http request and provide
-// handlers with a "database connection pool".
-func setupRouter(db *gorm.DB) *gin.Engine {
+// handlers with a "database connection pool" and service options.
+func setupRouter(db *gorm.DB, opts Options) *gin.Engine {
 	router := gin.Default()
 
 	v1 := router.Group("/v1")
 	v1.GET("/accounts", func(c *gin.Context) {
 		GetAccount(c, db)
 	})
+	v1.POST("/accounts", func(c *gin.Context) {
+		CreateAccount(c, db)
+	})
+	v1.PATCH("/accounts/:id", func(c *gin.Context) {
+		UpdateAccount(c, db)
+	})
+	v1.DELETE("/accounts/:id", func(c *gin.Context) {
+		CloseAccount(c, db)
+	})
+	v1.GET("/accounts/:id/statement", func(c *gin.Context) {
+		GetStatement(c, db)
+	})
+	v1.GET("/accounts/:id/balance", func(c *gin.Context) {
+		GetBalance(c, db)
+	})
+	admin := v1.Group("/admin")
+	admin.GET("/rates", func(c *gin.Context) {
+		GetRates(c, db)
+	})
+	admin.POST("/rates", func(c *gin.Context) {
+		LoadRates(c, db)
+	})
+	admin.GET("/fees", func(c *gin.Context) {
+		GetFees(c, db)
+	})
+	admin.POST("/fees", func(c *gin.Context) {
+		LoadFees(c, db)
+	})
+	admin.DELETE("/fees/:id", func(c *gin.Context) {
+		DeleteFee(c, db)
+	})
+	admin.GET("/limits", func(c *gin.Context) {
+		GetLimits(c, db)
+	})
+	admin.POST("/limits", func(c *gin.Context) {
+		LoadLimits(c, db)
+	})
+	admin.DELETE("/limits/:id", func(c *gin.Context) {
+		DeleteLimit(c, db)
+	})
+	v1.GET("/reconciliation", func(c *gin.Context) {
+		GetDiscrepancies(c, db)
+	})
+	v1.POST("/quotes", func(c *gin.Context) {
+		CreateQuote(c, db, opts)
+	})
+	v1.GET("/reviews", func(c *gin.Context) {
+		GetReviews(c, db)
+	})
+	v1.POST("/reviews/:id/approve", func(c *gin.Context) {
+		ReviewPayment(c, db, opts, reviewApproved)
+	})
+	v1.POST("/reviews/:id/reject", func(c *gin.Context) {
+		ReviewPayment(c, db, opts, reviewRejected)
+	})
+	v1.GET("/approvals", func(c *gin.Context) {
+		GetApprovals(c, db)
+	})
+	v1.POST("/approvals/:id/approve", func(c *gin.Context) {
+		DecideApproval(c, db, opts, reviewApproved)
+	})
+	v1.POST("/approvals/:id/decline", func(c *gin.Context) {
+		DecideApproval(c, db, opts, reviewRejected)
+	})
+	v1.GET("/holds", func(c *gin.Context) {
+		GetHolds(c, db)
+	})
+	v1.POST("/holds", func(c *gin.Context) {
+		CreateHold(c, db, opts)
+	})
+	v1.POST("/holds/:id/capture", func(c *gin.Context) {
+		CaptureHold(c, db, opts)
+	})
+	v1.POST("/holds/:id/void", func(c *gin.Context) {
+		VoidHold(c, db, opts)
+	})
+	v1.GET("/scheduled-payments", func(c *gin.Context) {
+		GetScheduledPayments(c, db)
+	})
+	v1.POST("/scheduled-payments/:id/cancel", func(c *gin.Context) {
+		CancelScheduledPayment(c, db)
+	})
+	v1.GET("/mandates", func(c *gin.Context) {
+		GetMandates(c, db)
+	})
+	v1.POST("/mandates", func(c *gin.Context) {
+		CreateMandate(c, db)
+	})
+	v1.POST("/mandates/:id/pause", func(c *gin.Context) {
+		ChangeMandate(c, db, mandatePaused)
+	})
+	v1.POST("/mandates/:id/resume", func(c *gin.Context) {
+		ChangeMandate(c, db, mandateActive)
+	})
+	v1.POST("/mandates/:id/cancel", func(c *gin.Context) {
+		ChangeMandate(c, db, mandateCanceled)
+	})
+	v1.POST("/payment-batches", func(c *gin.Context) {
+		SubmitBatch(c, db, opts)
+	})
+	v1.GET("/payment-batches/:id", func(c *gin.Context) {
+		GetBatch(c, db)
+	})
 	v1.GET("/payments", func(c *gin.Context) {
 		GetPayments(c, db)
 	})
+	v1.GET("/payments/:id", func(c *gin.Context) {
+		GetPayment(c, db)
+	})
 	v1.POST("/payments", func(c *gin.Context) {
-		Submit(c, db)
+		Submit(c, db, opts)
+	})
+	v1.POST("/payments/:id/reverse", func(c *gin.Context) {
+		ReversePayment(c, db, opts)
+	})
+	v1.GET("/transfers/:id", func(c *gin.Context) {
+		GetTransfer(c, db)
 	})
 
 	return router
@@ -54,8 +516,39 @@ func main() {
 	// dialect
 	dialect := flag.String("dialect", "mysql", "Database to use; see gorm dialects")
 	connect := flag.String("connect", "root:secret@/test?charset=utf8&parseTime=True&loc=Local", "DSN connection string")
+	opts := defaultOptions()
+	flag.StringVar(&opts.Concurrency, "concurrency", opts.Concurrency, "Transfer concurrency control: pessimistic (row locks) or optimistic (version check)")
+	flag.IntVar(&opts.TransferAttempts, "transfer-attempts", opts.TransferAttempts, "Max attempts of optimistic transfer on conflict")
+	flag.DurationVar(&opts.QuoteTTL, "quote-ttl", opts.QuoteTTL, "How long quotes are valid for")
+	flag.DurationVar(&opts.HoldTTL, "hold-ttl", opts.HoldTTL, "How long holds reserve funds unless captured or voided")
+	flag.DurationVar(&opts.ApprovalTTL, "approval-ttl", opts.ApprovalTTL, "How long approval requests of large payments are valid for")
+	flag.DurationVar(&opts.ExpiryInterval, "expiry-interval", opts.ExpiryInterval, "How often expired holds and approvals are released")
+	flag.DurationVar(&opts.ScheduleInterval, "schedule-interval", opts.ScheduleInterval, "How often due scheduled payments and mandates are executed")
+	flag.DurationVar(&opts.MandateRetryInterval, "mandate-retry-interval", opts.MandateRetryInterval, "How long to wait before retrying mandate payments which failed for lack of funds")
+	thresholds := flag.String("approval-thresholds", "", "Amounts per currency payments above which need approval, e.g. USD=1000.00,EUR=900")
+	rounding := flag.String("rounding", "", "Rounding of converted amounts per currency, e.g. JPY=down,USD=half-even; "+defaultRounding+" by default")
+	screeningRules := flag.String("screening-rules", "", "JSON file with payment screening rules; payments are not screened by default")
 	flag.Parse()
 
+	if opts.Concurrency != pessimisticConcurrency && opts.Concurrency != optimisticConcurrency {
+		log.Fatalf("Unknown concurrency strategy %q", opts.Concurrency)
+	}
+	roundingModes, err := parseRounding(*rounding)
+	if err != nil {
+		log.Fatal(err)
+	}
+	opts.Rounding = roundingModes
+	if opts.ApprovalThresholds, err = parseThresholds(*thresholds); err != nil {
+		log.Fatal(err)
+	}
+	if *screeningRules != "" {
+		rules, err := loadScreeningRules(*screeningRules)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts.Screener = rules
+	}
+
 	db, err := setupDatabase(*dialect, *connect)
 	if err != nil {
 		log.Fatal(err)
@@ -63,6 +556,29 @@ func main() {
 	}
 	defer db.Close()
 
-	router := setupRouter(db)
+	go func() {
+		for range time.Tick(opts.ExpiryInterval) {
+			if _, err := expireHolds(db, opts, time.Now().UTC()); err != nil {
+				log.Printf("Can't release expired holds: %s", err)
+			}
+			if _, err := expireApprovals(db, opts, time.Now().UTC()); err != nil {
+				log.Printf("Can't expire approvals: %s", err)
+			}
+		}
+	}()
+	// Replicas may execute the same payments concurrently, each one is
+	// claimed only once (see `claimScheduledPayment` and `saveMandate`)
+	go func() {
+		for range time.Tick(opts.ScheduleInterval) {
+			if _, err := executeScheduledPayments(db, opts, time.Now().UTC()); err != nil {
+				log.Printf("Can't execute scheduled payments: %s", err)
+			}
+			if _, err := executeMandates(db, opts, time.Now().UTC()); err != nil {
+				log.Printf("Can't execute mandates: %s", err)
+			}
+		}
+	}()
+
+	router := setupRouter(db, opts)
 	router.Run()
 }
@@ -1,55 +1,1401 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"strconv"
+	"time"
 
 	"github.com/jinzhu/gorm"
 )
 
-// Account type represent physical bank account with "should-always-stay-positive"
-// balance field, owner and currency fields. Assuming only transactions between
-// accounts with the same currencies are allowed.
+// Account type represent physical bank account with balance field (which
+// should stay positive unless account has an overdraft limit), owner and
+// currency fields. Transactions between accounts with different currencies go
+// through FX accounts (see `fxOwner`).
+// Balance is kept in minor units of the account currency. It always equals
+// OpeningBalance plus all account journal entries (see `findDiscrepancies`).
+// Version is incremented on every balance change, see `saveAccount`.
+// Tier selects fee schedules applied to account payments, see `FeeSchedule`.
+// Held is the sum of active holds on account (see `Hold`), which is not
+// available for payments although still part of the balance.
+// OverdraftLimit is how far below zero balance may go, zero for most accounts.
 type Account struct {
 	gorm.Model
 
-	Owner    string
-	Balance  float64
-	Currency string
+	Owner          string
+	Balance        Amount
+	OpeningBalance Amount
+	Currency       string
+	Version        uint   `json:"-"`
+	Tier           string `json:"tier"`
+	Held           Amount `json:"-"`
+	OverdraftLimit Amount `json:"overdraft_limit"`
 }
 
+// Available returns balance available for payments: not held balance plus
+// overdraft limit.
+func (a Account) Available() Amount {
+	return a.Balance - a.Held + a.OverdraftLimit
+}
+
+// errNotEnoughBalance is returned when payment exceeds available balance
+var errNotEnoughBalance = errors.New("Not enough balance")
+
+// accountJSON has the same fields as Account but default JSON encoding
+type accountJSON Account
+
+// MarshalJSON implements json.Marshaler interface. Balances are written as
+// decimal strings in account currency.
+func (a Account) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		accountJSON
+		Balance          Decimal
+		OpeningBalance   Decimal
+		OverdraftLimit   Decimal `json:"overdraft_limit"`
+		AvailableBalance Decimal `json:"available_balance"`
+	}{
+		accountJSON(a),
+		a.Balance.Decimal(a.Currency),
+		a.OpeningBalance.Decimal(a.Currency),
+		a.OverdraftLimit.Decimal(a.Currency),
+		a.Available().Decimal(a.Currency),
+	})
+}
+
+// UnmarshalJSON implements json.Unmarshaler interface, see MarshalJSON.
+func (a *Account) UnmarshalJSON(data []byte) (err error) {
+	aux := struct {
+		*accountJSON
+		Balance        Decimal
+		OpeningBalance Decimal
+		OverdraftLimit Decimal `json:"overdraft_limit"`
+	}{accountJSON: (*accountJSON)(a)}
+	if err = json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	if a.Balance, err = aux.Balance.Amount(a.Currency); err != nil {
+		return err
+	}
+	if a.OpeningBalance, err = aux.OpeningBalance.Amount(a.Currency); err != nil {
+		return err
+	}
+	a.OverdraftLimit, err = aux.OverdraftLimit.Amount(a.Currency)
+	return err
+}
+
+// Payment statuses. Every transfer starts as pending and ends up either
+// posted (applied to balances) or failed (rejected, with reason stored).
+// Transfer flagged by screening is parked for review and large transfer is
+// parked for approval (not applied to balances) until it's either posted or
+// failed. Posted transfer can be reversed later.
+const (
+	statusPending  = "pending"
+	statusReview   = "review"
+	statusApproval = "approval"
+	statusPosted   = "posted"
+	statusFailed   = "failed"
+	statusReversed = "reversed"
+)
+
+// statusTransitions lists allowed status changes of a transfer. Transfer
+// without status can only become pending.
+var statusTransitions = map[string][]string{
+	"":             {statusPending},
+	statusPending:  {statusReview, statusApproval, statusPosted, statusFailed},
+	statusReview:   {statusPosted, statusFailed},
+	statusApproval: {statusPosted, statusFailed},
+	statusPosted:   {statusReversed},
+}
+
+// knownStatus checks status is one of payment statuses
+func knownStatus(status string) bool {
+	switch status {
+	case statusPending, statusReview, statusApproval, statusPosted, statusFailed, statusReversed:
+		return true
+	}
+	return false
+}
+
+// Payment directions. Outgoing payment debits account, incoming one credits it.
+const (
+	outgoing = "outgoing"
+	incoming = "incoming"
+)
+
+// feeKind marks payments (legs) of fee charged by transfer, see `Transfer.ChargeFee`
+const feeKind = "fee"
+
 // Payment (or transfer) describe balance (money) transfer between accounts.
 // API allows to specify source and destination.
 // AccountID specifies what account this transfer applies to, Direction specifies
 // is it either `incoming` transfer or `outgoing`.
 // There always should be reciprocal transfer for other account involved: that is,
 // identified by either AccountTo or AccountFrom IDs.
-// Amount number should always be positive.
+// Amount number should always be positive and is kept in minor units of
+// Currency, which is the currency of the account.
+// Payments are journal entries (legs) of a `Transfer`, identified by TransferID.
+// Legs of cross-currency transfer keep applied exchange rate along with amounts
+// sent from source and received by destination account.
+// Fee is a fee charged for the payment in the source currency. Fee itself is
+// paid by separate legs of the transfer, which are of `fee` Kind.
+// PostedAt is when the payment was applied to account balance, it's not set
+// until the payment is posted. Payments are indexed by account and posting
+// time for balance history, see `balanceAt`.
 type Payment struct {
 	gorm.Model
 
-	AccountID     uint    `json:"account"`
-	Amount        float64 `json:"amount" binding:"required,gt=0"`
+	AccountID     uint   `json:"account" sql:"index:idx_payments_account_posted_at"`
+	Amount        Amount `json:"amount"`
+	Currency      string `json:"currency"`
 	Direction     string
-	AccountToID   uint `json:"to_account" binding:"required"`
-	AccountFromID uint `json:"from_account" binding:"required"`
+	AccountToID   uint   `json:"to_account"`
+	AccountFromID uint   `json:"from_account"`
+	TransferID    uint   `json:"transfer"`
+	Status        string `json:"status"`
+	Fee           Amount `json:"fee"`
+	Kind          string `json:"kind,omitempty"`
+
+	PostedAt *time.Time `json:"posted_at,omitempty" sql:"index:idx_payments_account_posted_at"`
+
+	ExchangeRateID      uint    `json:"exchange_rate,omitempty"`
+	Rate                Decimal `json:"rate,omitempty"`
+	SourceAmount        Amount  `json:"source_amount,omitempty"`
+	SourceCurrency      string  `json:"source_currency,omitempty"`
+	DestinationAmount   Amount  `json:"destination_amount,omitempty"`
+	DestinationCurrency string  `json:"destination_currency,omitempty"`
+}
+
+// Signed returns payment amount as it applies to account balance: negative
+// for outgoing payments and positive for incoming ones.
+func (p Payment) Signed() Amount {
+	if p.Direction == outgoing {
+		return -p.Amount
+	}
+	return p.Amount
+}
+
+// paymentJSON has the same fields as Payment but default JSON encoding
+type paymentJSON Payment
+
+// feeCurrency returns currency of payment fee, which is the source currency
+func (p Payment) feeCurrency() string {
+	if p.SourceCurrency != "" {
+		return p.SourceCurrency
+	}
+	return p.Currency
+}
+
+// MarshalJSON implements json.Marshaler interface. Amounts are written as
+// decimal strings in their currencies.
+func (p Payment) MarshalJSON() ([]byte, error) {
+	aux := struct {
+		paymentJSON
+		Amount            Decimal `json:"amount"`
+		Fee               Decimal `json:"fee"`
+		SourceAmount      Decimal `json:"source_amount,omitempty"`
+		DestinationAmount Decimal `json:"destination_amount,omitempty"`
+	}{paymentJSON: paymentJSON(p), Amount: p.Amount.Decimal(p.Currency), Fee: p.Fee.Decimal(p.feeCurrency())}
+	if p.SourceCurrency != "" {
+		aux.SourceAmount = p.SourceAmount.Decimal(p.SourceCurrency)
+		aux.DestinationAmount = p.DestinationAmount.Decimal(p.DestinationCurrency)
+	}
+	return json.Marshal(aux)
+}
+
+// UnmarshalJSON implements json.Unmarshaler interface, see MarshalJSON.
+func (p *Payment) UnmarshalJSON(data []byte) (err error) {
+	aux := struct {
+		*paymentJSON
+		Amount            Decimal `json:"amount"`
+		Fee               Decimal `json:"fee"`
+		SourceAmount      Decimal `json:"source_amount"`
+		DestinationAmount Decimal `json:"destination_amount"`
+	}{paymentJSON: (*paymentJSON)(p)}
+	if err = json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	if p.Fee, err = aux.Fee.Amount(p.feeCurrency()); err != nil {
+		return err
+	}
+	if p.SourceAmount, err = aux.SourceAmount.Amount(p.SourceCurrency); err != nil {
+		return err
+	}
+	if p.DestinationAmount, err = aux.DestinationAmount.Amount(p.DestinationCurrency); err != nil {
+		return err
+	}
+	p.Amount, err = aux.Amount.Amount(p.Currency)
+	return err
+}
+
+// maxSplits is max number of destinations of split payment
+const maxSplits = 100
+
+// Split is a destination of split payment: Amount (in currency of the source
+// account) paid to AccountToID.
+type Split struct {
+	AccountToID uint    `json:"to_account"`
+	Amount      Decimal `json:"amount"`
+}
+
+// PaymentRequest is a payload for POST /payments and POST /quotes endpoints.
+// Amount is sent in currency of the source account and stays decimal until
+// the currency is known.
+// Splits replace AccountToID and Amount of split payment, which pays several
+// destination accounts at once, see `Payment.Split`.
+// QuoteID optionally refers to a quote (see `Quote`) for the payment.
+// Maker is API user submitting the payment, see `Approval`.
+// ExecuteAt optionally schedules the payment, see `ScheduledPayment`.
+// MandateID refers to mandate making the payment, see `Mandate`.
+type PaymentRequest struct {
+	AccountFromID uint       `json:"from_account" binding:"required"`
+	AccountToID   uint       `json:"to_account,omitempty"`
+	Amount        Decimal    `json:"amount,omitempty"`
+	Splits        []Split    `json:"splits,omitempty"`
+	QuoteID       uint       `json:"quote,omitempty"`
+	ExecuteAt     *time.Time `json:"execute_at,omitempty"`
+	Maker         string     `json:"-"`
+	MandateID     uint       `json:"-"`
+}
+
+// Destinations returns IDs of destination accounts of requested payment
+func (r PaymentRequest) Destinations() []uint {
+	if len(r.Splits) == 0 {
+		return []uint{r.AccountToID}
+	}
+	ids := make([]uint, len(r.Splits))
+	for i, split := range r.Splits {
+		ids[i] = split.AccountToID
+	}
+	return ids
+}
+
+// Payment converts request into a payment in currency of the source account.
+// Split payment is a payment of the total amount of its splits without
+// destination account.
+// Returns error if amount is not representable in that currency.
+func (r PaymentRequest) Payment(currency string) (Payment, error) {
+	payment := Payment{
+		Currency:      currency,
+		AccountFromID: r.AccountFromID,
+		AccountToID:   r.AccountToID,
+	}
+	if len(r.Splits) == 0 {
+		amount, err := r.Amount.Amount(currency)
+		payment.Amount = amount
+		return payment, err
+	}
+	splits, err := r.SplitPayments(currency)
+	if err != nil {
+		return Payment{}, err
+	}
+	for _, split := range splits {
+		payment.Amount += split.Amount
+	}
+	return payment, nil
+}
+
+// SplitPayments converts splits of request into payments to each destination
+// in currency of the source account.
+// Returns error if any amount is not representable in that currency.
+func (r PaymentRequest) SplitPayments(currency string) ([]Payment, error) {
+	res := make([]Payment, len(r.Splits))
+	for i, split := range r.Splits {
+		amount, err := split.Amount.Amount(currency)
+		if err != nil {
+			return nil, err
+		}
+		res[i] = Payment{
+			Amount:        amount,
+			Currency:      currency,
+			AccountFromID: r.AccountFromID,
+			AccountToID:   split.AccountToID,
+		}
+	}
+	return res, nil
+}
+
+// IdempotencyKey keeps the outcome (successful or not) of POST /payments
+// request made with `Idempotency-Key` header. Keys are scoped by Requester
+// (API user making the request, see `apiUser`), so different users can't
+// replay each other's responses. RequestHash is a fingerprint of the request
+// payload, so the same key can't be reused for a different payment.
+type IdempotencyKey struct {
+	gorm.Model
+
+	Requester    string `gorm:"unique_index:uix_idempotency_keys_requester_key"`
+	Key          string `gorm:"unique_index:uix_idempotency_keys_requester_key"`
+	RequestHash  string
+	ResponseCode int
+	ResponseBody string `sql:"type:text"`
+}
+
+// ExchangeRate is a rate to convert money from one currency to another, price
+// of a unit of FromCurrency in ToCurrency. Rate is valid since ValidFrom and
+// until ValidUntil (or forever if not set). The latest valid rate is used.
+type ExchangeRate struct {
+	gorm.Model
+
+	FromCurrency string     `json:"from" sql:"index:idx_exchange_rates_currencies"`
+	ToCurrency   string     `json:"to" sql:"index:idx_exchange_rates_currencies"`
+	Rate         Decimal    `json:"rate"`
+	ValidFrom    time.Time  `json:"valid_from"`
+	ValidUntil   *time.Time `json:"valid_until"`
+}
+
+// Quote is a price of a payment offered to a customer: exchange rate (for
+// payment between accounts with different currencies) and fee locked until
+// ExpiresAt. Amount and Fee are in Currency of the source account.
+// Quote can be used by one payment only, TransferID refers to it once made.
+type Quote struct {
+	gorm.Model
+
+	AccountFromID       uint      `json:"from_account"`
+	AccountToID         uint      `json:"to_account"`
+	Amount              Amount    `json:"amount"`
+	Currency            string    `json:"currency"`
+	ExchangeRateID      uint      `json:"exchange_rate,omitempty"`
+	Rate                Decimal   `json:"rate,omitempty"`
+	DestinationAmount   Amount    `json:"destination_amount"`
+	DestinationCurrency string    `json:"destination_currency"`
+	Fee                 Amount    `json:"fee"`
+	ExpiresAt           time.Time `json:"expires_at"`
+	TransferID          uint      `json:"transfer,omitempty"`
+}
+
+// quoteJSON has the same fields as Quote but default JSON encoding
+type quoteJSON Quote
+
+// MarshalJSON implements json.Marshaler interface. Amounts are written as
+// decimal strings in their currencies.
+func (q Quote) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		quoteJSON
+		Amount            Decimal `json:"amount"`
+		DestinationAmount Decimal `json:"destination_amount"`
+		Fee               Decimal `json:"fee"`
+	}{
+		quoteJSON(q),
+		q.Amount.Decimal(q.Currency),
+		q.DestinationAmount.Decimal(q.DestinationCurrency),
+		q.Fee.Decimal(q.Currency),
+	})
+}
+
+// Accepts checks quote can be used for payment at given time: it's the same
+// payment, quote is not used yet and has not expired.
+// Returns error if it can't, nil otherwise.
+func (q Quote) Accepts(p Payment, at time.Time) error {
+	if p.AccountFromID != q.AccountFromID || p.AccountToID != q.AccountToID ||
+		p.Amount != q.Amount || p.Currency != q.Currency {
+		return errors.New("Payment doesn't match the quote")
+	}
+	if q.TransferID != 0 {
+		return errors.New("Quote was already used")
+	}
+	if !at.Before(q.ExpiresAt) {
+		return errors.New("Quote has expired")
+	}
+	return nil
+}
+
+// ExchangeRate returns exchange rate locked by quote
+func (q Quote) ExchangeRate() ExchangeRate {
+	rate := ExchangeRate{FromCurrency: q.Currency, ToCurrency: q.DestinationCurrency, Rate: q.Rate}
+	rate.ID = q.ExchangeRateID
+	return rate
+}
+
+// FeeSchedule sets fee of payments from accounts in Currency and of Tier
+// (any tier if empty) of at least FromAmount: flat fee plus percentage of
+// payment amount, but not less than Min and not more than Max (unless zero).
+// Schedule with the highest FromAmount applies, so schedules with different
+// FromAmount make tiers of payment amounts. Schedules of account tier take
+// precedence over schedules of any tier. Amounts are in Currency.
+type FeeSchedule struct {
+	gorm.Model
+
+	Currency   string  `json:"currency" sql:"index"`
+	Tier       string  `json:"tier"`
+	FromAmount Amount  `json:"from_amount"`
+	Flat       Amount  `json:"flat"`
+	Percent    Decimal `json:"percent"`
+	Min        Amount  `json:"min"`
+	Max        Amount  `json:"max"`
+}
+
+// feeScheduleJSON has the same fields as FeeSchedule but default JSON encoding
+type feeScheduleJSON FeeSchedule
+
+// MarshalJSON implements json.Marshaler interface. Amounts are written as
+// decimal strings in schedule currency.
+func (s FeeSchedule) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		feeScheduleJSON
+		FromAmount Decimal `json:"from_amount"`
+		Flat       Decimal `json:"flat"`
+		Min        Decimal `json:"min"`
+		Max        Decimal `json:"max"`
+	}{
+		feeScheduleJSON(s),
+		s.FromAmount.Decimal(s.Currency),
+		s.Flat.Decimal(s.Currency),
+		s.Min.Decimal(s.Currency),
+		s.Max.Decimal(s.Currency),
+	})
+}
+
+// Fee calculates fee of payment amount by schedule. Percentage is rounded
+// to minor units with rounding mode (see `Amount.Percent`).
+// Returns error if fee can't be calculated, nil otherwise.
+func (s FeeSchedule) Fee(amount Amount, rounding string) (Amount, error) {
+	fee := s.Flat
+	if s.Percent != "" {
+		percentage, err := amount.Percent(s.Percent, rounding)
+		if err != nil {
+			return 0, err
+		}
+		fee += percentage
+	}
+	if fee < s.Min {
+		fee = s.Min
+	}
+	if s.Max > 0 && fee > s.Max {
+		fee = s.Max
+	}
+	return fee, nil
+}
+
+// Limit restricts outgoing payments of account with AccountID or, if it's
+// zero, of all accounts of Owner in Currency taken together: amount of
+// a single payment (MaxAmount), totals of payments made during calendar day
+// and month (UTC) and number of payments made during the last hour. Zero
+// means no restriction. Amounts are in Currency.
+type Limit struct {
+	gorm.Model
+
+	AccountID     uint   `json:"account,omitempty" sql:"index"`
+	Owner         string `json:"owner,omitempty" sql:"index"`
+	Currency      string `json:"currency"`
+	MaxAmount     Amount `json:"max_amount"`
+	DailyAmount   Amount `json:"daily_amount"`
+	MonthlyAmount Amount `json:"monthly_amount"`
+	HourlyCount   int    `json:"hourly_count"`
+}
+
+// limitJSON has the same fields as Limit but default JSON encoding
+type limitJSON Limit
+
+// MarshalJSON implements json.Marshaler interface. Amounts are written as
+// decimal strings in limit currency.
+func (l Limit) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		limitJSON
+		MaxAmount     Decimal `json:"max_amount"`
+		DailyAmount   Decimal `json:"daily_amount"`
+		MonthlyAmount Decimal `json:"monthly_amount"`
+	}{
+		limitJSON(l),
+		l.MaxAmount.Decimal(l.Currency),
+		l.DailyAmount.Decimal(l.Currency),
+		l.MonthlyAmount.Decimal(l.Currency),
+	})
+}
+
+// LimitUsage is what's already used of a limit: totals of outgoing payments
+// made during the current day and month and number of them made during the
+// last hour.
+type LimitUsage struct {
+	Daily   Amount
+	Monthly Amount
+	Hourly  int
+}
+
+// limitError is returned when payment violates a limit, see `Limit.Check`
+type limitError string
+
+func (e limitError) Error() string {
+	return string(e)
+}
+
+// Check checks payment of amount fits into limit given its current usage.
+// Returns limitError if it doesn't, nil otherwise.
+func (l Limit) Check(amount Amount, usage LimitUsage) error {
+	scope := fmt.Sprintf("account ID=%d", l.AccountID)
+	if l.AccountID == 0 {
+		scope = fmt.Sprintf("owner %s", l.Owner)
+	}
+	switch {
+	case l.MaxAmount > 0 && amount > l.MaxAmount:
+		return limitError(fmt.Sprintf("Payment exceeds max amount %s %s of %s", l.MaxAmount.Decimal(l.Currency), l.Currency, scope))
+	case l.DailyAmount > 0 && usage.Daily+amount > l.DailyAmount:
+		return limitError(fmt.Sprintf("Payment exceeds daily limit %s %s of %s", l.DailyAmount.Decimal(l.Currency), l.Currency, scope))
+	case l.MonthlyAmount > 0 && usage.Monthly+amount > l.MonthlyAmount:
+		return limitError(fmt.Sprintf("Payment exceeds monthly limit %s %s of %s", l.MonthlyAmount.Decimal(l.Currency), l.Currency, scope))
+	case l.HourlyCount > 0 && usage.Hourly+1 > l.HourlyCount:
+		return limitError(fmt.Sprintf("Payment exceeds %d payments per hour of %s", l.HourlyCount, scope))
+	}
+	return nil
+}
+
+// Hold statuses. Hold is active until it's captured, voided or expires,
+// funds it reserves are released then.
+const (
+	holdActive   = "active"
+	holdCaptured = "captured"
+	holdVoided   = "voided"
+	holdExpired  = "expired"
+)
+
+// Hold reserves Amount of source account (see `Account.Held`) for a payment
+// to AccountToID without moving money. Amount is in Currency of the source
+// account. Captured hold becomes a payment of captured amount, TransferID
+// refers to it, and the rest of the hold is released.
+type Hold struct {
+	gorm.Model
+
+	AccountFromID uint      `json:"from_account" sql:"index"`
+	AccountToID   uint      `json:"to_account"`
+	Amount        Amount    `json:"amount"`
+	Currency      string    `json:"currency"`
+	Status        string    `json:"status" sql:"index"`
+	ExpiresAt     time.Time `json:"expires_at"`
+	TransferID    uint      `json:"transfer,omitempty"`
+}
+
+// holdJSON has the same fields as Hold but default JSON encoding
+type holdJSON Hold
+
+// MarshalJSON implements json.Marshaler interface. Amount is written as
+// decimal string in hold currency.
+func (h Hold) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		holdJSON
+		Amount Decimal `json:"amount"`
+	}{holdJSON(h), h.Amount.Decimal(h.Currency)})
+}
+
+// Captures checks hold can be captured for amount at given time: hold is
+// active, not expired and amount doesn't exceed it.
+// Returns error if it can't, nil otherwise.
+func (h Hold) Captures(amount Amount, at time.Time) error {
+	if h.Status != holdActive {
+		return fmt.Errorf("Hold is %s", h.Status)
+	}
+	if !at.Before(h.ExpiresAt) {
+		return errors.New("Hold has expired")
+	}
+	if amount > h.Amount {
+		return errors.New("Capture exceeds held amount")
+	}
+	return nil
+}
+
+// Scheduled payment statuses. Payment is scheduled until it's executed (made
+// or failed) or canceled.
+const (
+	scheduleScheduled = "scheduled"
+	scheduleExecuted  = "executed"
+	scheduleFailed    = "failed"
+	scheduleCanceled  = "canceled"
+)
+
+// ScheduledPayment is a payment to be made at ExecuteAt, the same way as
+// POST /payments makes it (see `executeScheduledPayment`). Amount is in
+// Currency of the source account. TransferID refers to the made or failed
+// transfer once payment is executed, Reason explains failure.
+type ScheduledPayment struct {
+	gorm.Model
+
+	AccountFromID uint      `json:"from_account" sql:"index"`
+	AccountToID   uint      `json:"to_account"`
+	Amount        Amount    `json:"amount"`
+	Currency      string    `json:"currency"`
+	Maker         string    `json:"maker,omitempty"`
+	ExecuteAt     time.Time `json:"execute_at" sql:"index"`
+	Status        string    `json:"status" sql:"index"`
+	Reason        string    `json:"reason,omitempty"`
+	TransferID    uint      `json:"transfer,omitempty"`
+}
+
+// scheduledPaymentJSON has the same fields as ScheduledPayment but default
+// JSON encoding
+type scheduledPaymentJSON ScheduledPayment
+
+// MarshalJSON implements json.Marshaler interface. Amount is written as
+// decimal string in payment currency.
+func (s ScheduledPayment) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		scheduledPaymentJSON
+		Amount Decimal `json:"amount"`
+	}{scheduledPaymentJSON(s), s.Amount.Decimal(s.Currency)})
+}
+
+// UnmarshalJSON implements json.Unmarshaler interface, see MarshalJSON.
+func (s *ScheduledPayment) UnmarshalJSON(data []byte) (err error) {
+	aux := struct {
+		*scheduledPaymentJSON
+		Amount Decimal `json:"amount"`
+	}{scheduledPaymentJSON: (*scheduledPaymentJSON)(s)}
+	if err = json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	s.Amount, err = aux.Amount.Amount(s.Currency)
+	return err
+}
+
+// Request returns payment request to execute scheduled payment with
+func (s ScheduledPayment) Request() PaymentRequest {
+	return PaymentRequest{
+		AccountFromID: s.AccountFromID,
+		AccountToID:   s.AccountToID,
+		Amount:        s.Amount.Decimal(s.Currency),
+		Maker:         s.Maker,
+	}
+}
+
+// Batch modes. All-or-nothing batch makes all its payments in a single
+// transaction or none of them, best-effort batch makes each one on its own.
+const (
+	batchAllOrNothing = "all_or_nothing"
+	batchBestEffort   = "best_effort"
+)
+
+// Batch statuses. Best-effort batch is processing until all its payments are
+// attempted, then it's completed (all made), partial or failed (none made).
+const (
+	batchProcessing = "processing"
+	batchCompleted  = "completed"
+	batchPartial    = "partial"
+	batchFailed     = "failed"
+)
+
+// maxBatchSize is max number of payments in a batch
+const maxBatchSize = 1000
+
+// PaymentBatch is a group of payments submitted together. Mode is either
+// `all_or_nothing` or `best_effort`. Maker is API user submitting the batch,
+// see `Approval`.
+type PaymentBatch struct {
+	gorm.Model
+
+	Mode   string      `json:"mode"`
+	Maker  string      `json:"maker,omitempty"`
+	Status string      `json:"status"`
+	Items  []BatchItem `json:"items"`
+}
+
+// BatchItem is a payment of a batch at Position (from zero) in the request.
+// Status is status of the made transfer, or `failed` with the Error if
+// payment is not possible (or other payment of all-or-nothing batch is not).
+// It's `pending` until payment is attempted.
+type BatchItem struct {
+	ID             uint    `gorm:"primary_key" json:"-"`
+	PaymentBatchID uint    `json:"-" sql:"index"`
+	Position       int     `json:"position"`
+	AccountFromID  uint    `json:"from_account"`
+	AccountToID    uint    `json:"to_account"`
+	Amount         Decimal `json:"amount"`
+	Status         string  `json:"status"`
+	Error          string  `json:"error,omitempty" sql:"type:text"`
+	TransferID     uint    `json:"transfer,omitempty"`
+}
+
+// Request returns payment request of batch item made by maker
+func (i BatchItem) Request(maker string) PaymentRequest {
+	return PaymentRequest{
+		AccountFromID: i.AccountFromID,
+		AccountToID:   i.AccountToID,
+		Amount:        i.Amount,
+		Maker:         maker,
+	}
+}
+
+// Complete sets status of batch whose items are all attempted: completed if
+// all payments are made, failed if none and partial otherwise.
+func (b *PaymentBatch) Complete() {
+	failed := 0
+	for _, item := range b.Items {
+		if item.Status == statusFailed {
+			failed++
+		}
+	}
+	switch failed {
+	case 0:
+		b.Status = batchCompleted
+	case len(b.Items):
+		b.Status = batchFailed
+	default:
+		b.Status = batchPartial
+	}
+}
+
+// Mandate statuses. Active mandate makes payments, paused one doesn't until
+// it's resumed and suspended one is paused for lack of funds. Canceled
+// mandate never makes payments again.
+const (
+	mandateActive    = "active"
+	mandatePaused    = "paused"
+	mandateSuspended = "suspended"
+	mandateCanceled  = "canceled"
+)
+
+// mandateTransitions lists allowed status changes of a mandate
+var mandateTransitions = map[string][]string{
+	mandateActive:    {mandatePaused, mandateSuspended, mandateCanceled},
+	mandatePaused:    {mandateActive, mandateCanceled},
+	mandateSuspended: {mandateActive, mandateCanceled},
+}
+
+// Mandate behaviors when source account doesn't have enough balance for
+// a payment, see `Mandate.Fail`
+const (
+	insufficientSkip    = "skip"
+	insufficientRetry   = "retry"
+	insufficientSuspend = "suspend"
+)
+
+// Mandate is a standing order making payments of Amount (in Currency of the
+// source account) to AccountToID by Schedule starting at StartAt, see
+// `parseRecurrence`. DueAt is the next occurrence to be paid and NextRunAt is
+// when it's attempted, later than DueAt for retries. Attempts counts failed
+// attempts to pay the occurrence, up to Retries more attempts are made if
+// OnInsufficientFunds is `retry`. Reason explains suspension.
+// Version is incremented on every change, so concurrent executions of the
+// same occurrence can't both succeed.
+type Mandate struct {
+	gorm.Model
+
+	AccountFromID       uint      `json:"from_account" sql:"index"`
+	AccountToID         uint      `json:"to_account"`
+	Amount              Amount    `json:"amount"`
+	Currency            string    `json:"currency"`
+	Maker               string    `json:"maker,omitempty"`
+	Schedule            string    `json:"schedule"`
+	StartAt             time.Time `json:"start_at"`
+	OnInsufficientFunds string    `json:"on_insufficient_funds"`
+	Retries             int       `json:"retries"`
+	Status              string    `json:"status" sql:"index"`
+	Reason              string    `json:"reason,omitempty"`
+	DueAt               time.Time `json:"due_at"`
+	NextRunAt           time.Time `json:"next_run_at" sql:"index"`
+	Attempts            int       `json:"attempts"`
+	Version             uint      `json:"-"`
+}
+
+// mandateJSON has the same fields as Mandate but default JSON encoding
+type mandateJSON Mandate
+
+// MarshalJSON implements json.Marshaler interface. Amount is written as
+// decimal string in mandate currency.
+func (m Mandate) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		mandateJSON
+		Amount Decimal `json:"amount"`
+	}{mandateJSON(m), m.Amount.Decimal(m.Currency)})
+}
+
+// UnmarshalJSON implements json.Unmarshaler interface, see MarshalJSON.
+func (m *Mandate) UnmarshalJSON(data []byte) (err error) {
+	aux := struct {
+		*mandateJSON
+		Amount Decimal `json:"amount"`
+	}{mandateJSON: (*mandateJSON)(m)}
+	if err = json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	m.Amount, err = aux.Amount.Amount(m.Currency)
+	return err
+}
+
+// Recurrence returns occurrences of mandate payments
+func (m Mandate) Recurrence() (Recurrence, error) {
+	return parseRecurrence(m.Schedule, m.StartAt)
+}
+
+// Request returns payment request to pay mandate occurrence with
+func (m Mandate) Request() PaymentRequest {
+	return PaymentRequest{
+		AccountFromID: m.AccountFromID,
+		AccountToID:   m.AccountToID,
+		Amount:        m.Amount.Decimal(m.Currency),
+		Maker:         m.Maker,
+		MandateID:     m.ID,
+	}
+}
+
+// SetStatus changes mandate status at given time. Resumed mandate continues
+// with the first occurrence after that time unless its due occurrence is
+// still ahead, missed occurrences are not paid.
+// Returns error if status change is not allowed.
+func (m *Mandate) SetStatus(status string, at time.Time) error {
+	allowed := false
+	for _, next := range mandateTransitions[m.Status] {
+		allowed = allowed || next == status
+	}
+	if !allowed {
+		return fmt.Errorf("Mandate can't change status from %q to %q", m.Status, status)
+	}
+	if status == mandateActive {
+		recurrence, err := m.Recurrence()
+		if err != nil {
+			return err
+		}
+		if !m.DueAt.After(at) {
+			if m.DueAt = recurrence.Next(at); m.DueAt.IsZero() {
+				return errNoOccurrence
+			}
+		}
+		m.NextRunAt, m.Attempts, m.Reason = m.DueAt, 0, ""
+	}
+	m.Status = status
+	return nil
+}
+
+// Advance moves mandate to the occurrence after the due one once it's paid
+// (or skipped) at given time. If payment was late, occurrences missed
+// meanwhile are skipped. Mandate without further occurrences is canceled.
+func (m *Mandate) Advance(recurrence Recurrence, at time.Time) {
+	next := recurrence.Next(m.DueAt)
+	if !next.IsZero() && !next.After(at) {
+		next = recurrence.Next(at)
+	}
+	if next.IsZero() {
+		m.Status = mandateCanceled
+		return
+	}
+	m.DueAt, m.NextRunAt, m.Attempts = next, next, 0
+}
+
+// Fail applies OnInsufficientFunds behavior after attempt to pay due
+// occurrence at given time failed for lack of funds: the occurrence is either
+// skipped, retried after retryInterval (unless it's the next occurrence
+// by then) or mandate is suspended.
+func (m *Mandate) Fail(recurrence Recurrence, at time.Time, retryInterval time.Duration) {
+	m.Attempts++
+	switch m.OnInsufficientFunds {
+	case insufficientRetry:
+		retryAt := at.Add(retryInterval)
+		next := recurrence.Next(m.DueAt)
+		if m.Attempts <= m.Retries && (next.IsZero() || retryAt.Before(next)) {
+			m.NextRunAt = retryAt
+			return
+		}
+	case insufficientSuspend:
+		m.Status, m.Reason = mandateSuspended, errNotEnoughBalance.Error()
+		return
+	}
+	m.Advance(recurrence, at)
+}
+
+// StatementLine is a movement on account statement: posted payment (journal
+// entry) of the account with signed Amount and account Balance right after it.
+// Counterparty is the other account of the payment.
+type StatementLine struct {
+	PaymentID    uint      `json:"payment"`
+	TransferID   uint      `json:"transfer"`
+	PostedAt     time.Time `json:"posted_at"`
+	Direction    string    `json:"direction"`
+	Kind         string    `json:"kind,omitempty"`
+	Counterparty uint      `json:"counterparty"`
+	Amount       Amount    `json:"amount"`
+	Balance      Amount    `json:"balance"`
+}
+
+// Statement is a statement of account for period From (inclusive) To
+// (exclusive): its balance at the start of the period, movements during the
+// period in posting order and balance at the end. From is nil for statements
+// since the account was opened. Statement may be a page of movements, then
+// balances are the ones before and after the page and NextCursor is the last
+// movement of the page (zero on the last page).
+type Statement struct {
+	AccountID      uint            `json:"account"`
+	Currency       string          `json:"currency"`
+	From           *time.Time      `json:"from,omitempty"`
+	To             time.Time       `json:"to"`
+	OpeningBalance Amount          `json:"opening_balance"`
+	ClosingBalance Amount          `json:"closing_balance"`
+	Lines          []StatementLine `json:"movements"`
+	NextCursor     uint            `json:"next_cursor,omitempty"`
+}
+
+// Add adds posted payment of the account to the end of statement.
+func (s *Statement) Add(p Payment) {
+	s.ClosingBalance += p.Signed()
+	line := StatementLine{
+		PaymentID:    p.ID,
+		TransferID:   p.TransferID,
+		Direction:    p.Direction,
+		Kind:         p.Kind,
+		Counterparty: p.AccountFromID,
+		Amount:       p.Signed(),
+		Balance:      s.ClosingBalance,
+	}
+	if p.Direction == outgoing {
+		line.Counterparty = p.AccountToID
+	}
+	if p.PostedAt != nil {
+		line.PostedAt = *p.PostedAt
+	}
+	s.Lines = append(s.Lines, line)
+}
+
+// statementJSON has the same fields as Statement but default JSON encoding
+type statementJSON Statement
+
+// MarshalJSON implements json.Marshaler interface. Amounts are written as
+// decimal strings in account currency.
+func (s Statement) MarshalJSON() ([]byte, error) {
+	type lineJSON struct {
+		StatementLine
+		Amount  Decimal `json:"amount"`
+		Balance Decimal `json:"balance"`
+	}
+	lines := make([]lineJSON, len(s.Lines))
+	for i, line := range s.Lines {
+		lines[i] = lineJSON{line, line.Amount.Decimal(s.Currency), line.Balance.Decimal(s.Currency)}
+	}
+	return json.Marshal(struct {
+		statementJSON
+		OpeningBalance Decimal    `json:"opening_balance"`
+		ClosingBalance Decimal    `json:"closing_balance"`
+		Lines          []lineJSON `json:"movements"`
+	}{
+		statementJSON(s),
+		s.OpeningBalance.Decimal(s.Currency),
+		s.ClosingBalance.Decimal(s.Currency),
+		lines,
+	})
+}
+
+// statementCSVHeader is the header row of statement in CSV format
+var statementCSVHeader = []string{"posted_at", "type", "payment", "transfer", "counterparty", "amount", "balance", "currency"}
+
+// CSV returns statement records in CSV format, header row first. Movements
+// are of `incoming`, `outgoing` or `fee` type, they are preceded by `opening`
+// balance record and followed by `closing` balance record.
+func (s Statement) CSV() [][]string {
+	var from string
+	if s.From != nil {
+		from = s.From.UTC().Format(time.RFC3339Nano)
+	}
+	records := [][]string{
+		statementCSVHeader,
+		{from, "opening", "", "", "", "", string(s.OpeningBalance.Decimal(s.Currency)), s.Currency},
+	}
+	for _, line := range s.Lines {
+		kind := line.Direction
+		if line.Kind != "" {
+			kind = line.Kind
+		}
+		records = append(records, []string{
+			line.PostedAt.UTC().Format(time.RFC3339Nano),
+			kind,
+			strconv.FormatUint(uint64(line.PaymentID), 10),
+			strconv.FormatUint(uint64(line.TransferID), 10),
+			strconv.FormatUint(uint64(line.Counterparty), 10),
+			string(line.Amount.Decimal(s.Currency)),
+			string(line.Balance.Decimal(s.Currency)),
+			s.Currency,
+		})
+	}
+	return append(records, []string{
+		s.To.UTC().Format(time.RFC3339Nano), "closing", "", "", "", "", string(s.ClosingBalance.Decimal(s.Currency)), s.Currency,
+	})
+}
+
+// SchemaMigration records one-off data migration applied to the database,
+// see `migrations`.
+type SchemaMigration struct {
+	Name      string `gorm:"primary_key"`
+	CreatedAt time.Time
+}
+
+// Transfer is a journal record of money movement. It groups its journal
+// entries (legs), stored as `Payment` rows: outgoing legs are debits, incoming
+// ones are credits and they must sum up to zero in every currency.
+// Status is shared by transfer and its legs, Reason explains the last status
+// change (e.g. why transfer failed) and Transitions keep status history.
+// ReversalOfID links refund (compensating transfer) to the refunded transfer.
+// MandateID links transfer to mandate which made it, see `Mandate`.
+// Screenings keep screening decisions on transfer, see `Screener`, and
+// Reviews keep decisions of reviewers on transfer parked for review or
+// approval. Approvals keep approval request of transfer parked for approval.
+type Transfer struct {
+	gorm.Model
+
+	Status       string             `json:"status"`
+	Reason       string             `json:"reason"`
+	ReversalOfID uint               `json:"reversal_of,omitempty" sql:"index"`
+	MandateID    uint               `json:"mandate,omitempty" sql:"index"`
+	Payments     []Payment          `json:"payments"`
+	Transitions  []StatusTransition `json:"transitions"`
+	Screenings   []Screening        `json:"screenings,omitempty"`
+	Reviews      []Review           `json:"reviews,omitempty"`
+	Approvals    []Approval         `json:"approvals,omitempty"`
+}
+
+// Review decisions on transfer parked for review, see `Review`
+const (
+	reviewApproved = "approved"
+	reviewRejected = "rejected"
+)
+
+// Review is a decision of Reviewer (API user) on transfer parked for review
+// with optional Note, see `reviewTransfer`.
+type Review struct {
+	ID         uint      `gorm:"primary_key" json:"-"`
+	CreatedAt  time.Time `json:"at"`
+	TransferID uint      `json:"-" sql:"index"`
+	Reviewer   string    `json:"reviewer"`
+	Decision   string    `json:"decision"`
+	Note       string    `json:"note" sql:"type:text"`
+}
+
+// Approval statuses. Approval is pending until it's approved, declined or
+// expires.
+const (
+	approvalPending  = "pending"
+	approvalApproved = "approved"
+	approvalDeclined = "declined"
+	approvalExpired  = "expired"
+)
+
+// Approval is a request to approve transfer parked for approval made by Maker
+// (API user who submitted the payment). It must be approved by Checker,
+// a different API user, before ExpiresAt. Amount is in Currency of the source
+// account.
+type Approval struct {
+	gorm.Model
+
+	TransferID    uint      `json:"transfer" sql:"index"`
+	AccountFromID uint      `json:"from_account"`
+	AccountToID   uint      `json:"to_account"`
+	Amount        Amount    `json:"amount"`
+	Currency      string    `json:"currency"`
+	Maker         string    `json:"maker"`
+	Checker       string    `json:"checker,omitempty"`
+	Status        string    `json:"status" sql:"index"`
+	ExpiresAt     time.Time `json:"expires_at"`
+}
+
+// approvalJSON has the same fields as Approval but default JSON encoding
+type approvalJSON Approval
+
+// MarshalJSON implements json.Marshaler interface. Amount is written as
+// decimal string in approval currency.
+func (a Approval) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		approvalJSON
+		Amount Decimal `json:"amount"`
+	}{approvalJSON(a), a.Amount.Decimal(a.Currency)})
+}
+
+// UnmarshalJSON implements json.Unmarshaler interface, see MarshalJSON.
+func (a *Approval) UnmarshalJSON(data []byte) (err error) {
+	aux := struct {
+		*approvalJSON
+		Amount Decimal `json:"amount"`
+	}{approvalJSON: (*approvalJSON)(a)}
+	if err = json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	a.Amount, err = aux.Amount.Amount(a.Currency)
+	return err
+}
+
+// Decide checks checker can decide on approval at given time: approval is
+// pending and has not expired, and checker is not the maker (unless
+// declining).
+// Returns error if checker can't, nil otherwise.
+func (a Approval) Decide(checker string, decision string, at time.Time) error {
+	if a.Status != approvalPending {
+		return fmt.Errorf("Approval is %s", a.Status)
+	}
+	if !at.Before(a.ExpiresAt) {
+		return errors.New("Approval has expired")
+	}
+	if decision == reviewApproved && checker == a.Maker {
+		return errors.New("Payment can't be approved by its maker")
+	}
+	return nil
+}
+
+// StatusTransition is a history record of transfer status change
+type StatusTransition struct {
+	ID         uint      `gorm:"primary_key" json:"-"`
+	CreatedAt  time.Time `json:"at"`
+	TransferID uint      `json:"-" sql:"index"`
+	FromStatus string    `json:"from"`
+	ToStatus   string    `json:"to"`
+	Reason     string    `json:"reason,omitempty"`
+}
+
+// SetStatus changes status of transfer and its legs and records the change
+// in transfer status history.
+// Returns error if such status change is not allowed, nil otherwise.
+func (t *Transfer) SetStatus(status string, reason string) error {
+	allowed := false
+	for _, next := range statusTransitions[t.Status] {
+		allowed = allowed || next == status
+	}
+	if !allowed {
+		return fmt.Errorf("Payment can't change status from %q to %q", t.Status, status)
+	}
+
+	at := time.Now().UTC()
+	t.Transitions = append(t.Transitions, StatusTransition{
+		CreatedAt:  at,
+		FromStatus: t.Status,
+		ToStatus:   status,
+		Reason:     reason,
+	})
+	t.Status, t.Reason = status, reason
+	for i := range t.Payments {
+		t.Payments[i].Status = status
+		if status == statusPosted {
+			t.Payments[i].PostedAt = &at
+		}
+	}
+	return nil
+}
+
+// PostedAt returns when transfer was posted, zero time if it's not posted.
+func (t Transfer) PostedAt() time.Time {
+	for _, transition := range t.Transitions {
+		if transition.ToStatus == statusPosted {
+			return transition.CreatedAt
+		}
+	}
+	return time.Time{}
+}
+
+// Validate checks transfer legs are balanced: debits and credits sum up to
+// zero per currency. Returns error if they aren't, nil otherwise.
+func (t Transfer) Validate() error {
+	if len(t.Payments) < 2 {
+		return errors.New("Transfer should have at least two legs")
+	}
+	sums := make(map[string]Amount)
+	for _, leg := range t.Payments {
+		if leg.Amount <= 0 {
+			return errors.New("Amount should be positive")
+		}
+		if leg.Direction != outgoing && leg.Direction != incoming {
+			return fmt.Errorf("Unknown direction %q", leg.Direction)
+		}
+		sums[leg.Currency] += leg.Signed()
+	}
+	for currency, sum := range sums {
+		if sum != 0 {
+			return fmt.Errorf("Transfer is not balanced in %s", currency)
+		}
+	}
+	return nil
+}
+
+// Total returns amount debited by transfer and its currency. Only debits in
+// currency of the first one count, e.g. amount sent by cross-currency transfer,
+// and fees don't.
+func (t Transfer) Total() (total Amount, currency string) {
+	for _, leg := range t.Payments {
+		if leg.Direction != outgoing || leg.Kind == feeKind {
+			continue
+		}
+		if currency == "" {
+			currency = leg.Currency
+		}
+		if leg.Currency == currency {
+			total += leg.Amount
+		}
+	}
+	return total, currency
+}
+
+// Reversal returns pending transfer which refunds amount of posted transfer:
+// its legs mirror transfer legs in opposite directions. Fees are not refunded.
+// Transfer between two accounts can be refunded partially, in several refunds,
+// other transfers can only be reversed in full. Refunded is an amount refunded
+// already.
+// Returns error if refund is not possible, nil otherwise.
+func (t Transfer) Reversal(amount Amount, refunded Amount) (Transfer, error) {
+	reversal := Transfer{ReversalOfID: t.ID}
+	if t.ReversalOfID != 0 {
+		return reversal, errors.New("Refund can't be reversed")
+	}
+	if t.Status != statusPosted {
+		return reversal, fmt.Errorf("Only %s payments can be refunded, payment is %s", statusPosted, t.Status)
+	}
+	total, currency := t.Total()
+	if amount <= 0 {
+		return reversal, errors.New("Amount should be positive")
+	}
+	if amount > total-refunded {
+		return reversal, fmt.Errorf("Refund exceeds amount left to refund %s %s", (total - refunded).Decimal(currency), currency)
+	}
+	var legs []Payment
+	for _, leg := range t.Payments {
+		if leg.Kind != feeKind {
+			legs = append(legs, leg)
+		}
+	}
+	if amount != total && len(legs) != 2 {
+		return reversal, errors.New("Only payments between two accounts can be refunded partially")
+	}
+
+	for _, leg := range legs {
+		mirror := Payment{
+			AccountID:     leg.AccountID,
+			AccountFromID: leg.AccountToID,
+			AccountToID:   leg.AccountFromID,
+			Amount:        leg.Amount,
+			Currency:      leg.Currency,
+			Direction:     outgoing,
+		}
+		if leg.Direction == outgoing {
+			mirror.Direction = incoming
+		}
+		if amount != total {
+			mirror.Amount = amount
+		}
+		reversal.Payments = append(reversal.Payments, mirror)
+	}
+	return reversal, reversal.SetStatus(statusPending, "")
+}
+
+// ChargeFee adds legs of fee paid by source account to revenue account to
+// transfer and applies them to the accounts balances. Fee is kept by all
+// the other legs of the transfer.
+// Returns error if fee can't be charged, transfer is left intact then.
+func (t *Transfer) ChargeFee(source *Account, revenue *Account, fee Amount) error {
+	fees := Transfer{Payments: []Payment{
+		{AccountID: source.ID, AccountToID: revenue.ID, Direction: outgoing},
+		{AccountID: revenue.ID, AccountFromID: source.ID, Direction: incoming},
+	}}
+	for i := range fees.Payments {
+		leg := &fees.Payments[i]
+		leg.Amount, leg.Currency, leg.Kind, leg.Status = fee, source.Currency, feeKind, t.Status
+	}
+	if err := fees.Apply(map[uint]*Account{source.ID: source, revenue.ID: revenue}); err != nil {
+		return err
+	}
+
+	for i := range t.Payments {
+		t.Payments[i].Fee = fee
+	}
+	t.Payments = append(t.Payments, fees.Payments...)
+	return nil
+}
+
+// Apply applies transfer legs to balances of involved accounts.
+// Checks for same currency of legs and accounts and that debited accounts
+// have enough balance.
+// Returns error if transfer is not possible, nil otherwise. Accounts are
+// left intact on error.
+func (t Transfer) Apply(accounts map[uint]*Account) error {
+	changes := make(map[uint]Amount)
+	for _, leg := range t.Payments {
+		account, ok := accounts[leg.AccountID]
+		if !ok {
+			return fmt.Errorf("No account with ID=%d", leg.AccountID)
+		}
+		if account.Currency != leg.Currency {
+			return errors.New("Different currencies")
+		}
+		changes[leg.AccountID] += leg.Signed()
+	}
+	for id, change := range changes {
+		// Cheap balance check here, held funds can't be spent
+		if change < 0 && accounts[id].Available()+change < 0 {
+			return errNotEnoughBalance
+		}
+	}
+
+	for id, change := range changes {
+		accounts[id].Balance += change
+	}
+	return nil
 }
 
 // Transfer applies payment to tow involved accounts.
 // Checks for same currency and that source account has enough balance
-// Returns error if transfer is not possible, nil otherwise.
-func (p *Payment) Transfer(source *Account, dest *Account) error {
+// Returns pending journal record of the payment (even if payment is not
+// possible) and error if transfer is not possible, nil otherwise.
+func (p *Payment) Transfer(source *Account, dest *Account) (Transfer, error) {
+	transfer := Transfer{Payments: []Payment{p.Outgoing(), p.Incoming()}}
+	if err := transfer.SetStatus(statusPending, ""); err != nil {
+		return transfer, err
+	}
+
 	if source.Currency != dest.Currency {
-		return errors.New("Different currencies")
+		return transfer, errors.New("Different currencies")
 	}
-	// Cheap balance check here
-	if source.Balance < p.Amount {
-		return errors.New("Not enough balance")
+	if err := transfer.Apply(map[uint]*Account{source.ID: source, dest.ID: dest}); err != nil {
+		return transfer, err
 	}
+	return transfer, nil
+}
 
-	source.Balance -= p.Amount
-	dest.Balance += p.Amount
-	return nil
+// Split applies split payment of total amount (see `PaymentRequest.Payment`)
+// to involved accounts: a single outgoing leg debits the source account and an
+// incoming leg of each split credits its destination account. All accounts
+// should be in the same currency.
+// Returns pending journal record of the payment (even if payment is not
+// possible) and error if transfer is not possible, nil otherwise.
+func (p *Payment) Split(splits []Payment, accounts map[uint]*Account) (Transfer, error) {
+	transfer := Transfer{Payments: []Payment{p.Outgoing()}}
+	for _, split := range splits {
+		transfer.Payments = append(transfer.Payments, split.Incoming())
+	}
+	if err := transfer.SetStatus(statusPending, ""); err != nil {
+		return transfer, err
+	}
+	if err := transfer.Apply(accounts); err != nil {
+		return transfer, err
+	}
+	return transfer, nil
+}
+
+// Exchange converts payment into currency of destination account with
+// exchange rate, rounding converted amount (see `Amount.Convert`), and applies
+// it to accounts involved. Payment is received by FX account in source
+// currency and converted amount is paid by FX account in destination currency.
+// Returns pending journal record of the payment (even if payment is not
+// possible) and error if transfer is not possible, nil otherwise.
+func (p *Payment) Exchange(source, dest, fxSource, fxDest *Account, rate ExchangeRate, rounding string) (Transfer, error) {
+	var transfer Transfer
+	if rate.FromCurrency != source.Currency || rate.ToCurrency != dest.Currency ||
+		fxSource.Currency != source.Currency || fxDest.Currency != dest.Currency {
+		return transfer, errors.New("Different currencies")
+	}
+	converted, err := p.Amount.Convert(source.Currency, dest.Currency, rate.Rate, rounding)
+	if err != nil {
+		return transfer, err
+	}
+	if converted <= 0 {
+		return transfer, errors.New("Amount is too small to be converted")
+	}
+	p.ExchangeRateID, p.Rate = rate.ID, rate.Rate
+	p.SourceAmount, p.SourceCurrency = p.Amount, source.Currency
+	p.DestinationAmount, p.DestinationCurrency = converted, dest.Currency
+
+	sent, received := p.Outgoing(), p.Incoming()
+	received.Amount, received.Currency = converted, dest.Currency
+	// FX accounts take the other side of both legs
+	fxCredit, fxDebit := p.Incoming(), p.Outgoing()
+	fxCredit.AccountID = fxSource.ID
+	fxDebit.AccountID, fxDebit.Amount, fxDebit.Currency = fxDest.ID, converted, dest.Currency
+	transfer.Payments = []Payment{sent, fxCredit, fxDebit, received}
+	if err := transfer.SetStatus(statusPending, ""); err != nil {
+		return transfer, err
+	}
+
+	accounts := map[uint]*Account{source.ID: source, dest.ID: dest, fxSource.ID: fxSource, fxDest.ID: fxDest}
+	if err := transfer.Apply(accounts); err != nil {
+		return transfer, err
+	}
+	return transfer, nil
 }
 
 // Outgoing returns `outgoing` payment to be recorded.
@@ -57,8 +1403,10 @@ func (p *Payment) Transfer(source *Account, dest *Account) error {
 func (p Payment) Outgoing() (res Payment) {
 	res.AccountID = p.AccountFromID
 	res.AccountToID = p.AccountToID
-	res.Direction = "outgoing"
+	res.Direction = outgoing
 	res.Amount = p.Amount
+	res.Currency = p.Currency
+	res.setConversion(p)
 	return res
 }
 
@@ -67,12 +1415,21 @@ func (p Payment) Outgoing() (res Payment) {
 func (p Payment) Incoming() (res Payment) {
 	res.AccountID = p.AccountToID
 	res.AccountFromID = p.AccountFromID
-	res.Direction = "incoming"
+	res.Direction = incoming
 	res.Amount = p.Amount
+	res.Currency = p.Currency
+	res.setConversion(p)
 	return res
 }
 
+// setConversion copies currency conversion details of payment p
+func (p *Payment) setConversion(from Payment) {
+	p.ExchangeRateID, p.Rate = from.ExchangeRateID, from.Rate
+	p.SourceAmount, p.SourceCurrency = from.SourceAmount, from.SourceCurrency
+	p.DestinationAmount, p.DestinationCurrency = from.DestinationAmount, from.DestinationCurrency
+}
+
 func (p Payment) String() string {
-	return fmt.Sprintf("ID=%d, FROM=%d, TO=%d, Amount=%f",
-		p.AccountID, p.AccountFromID, p.AccountToID, p.Amount)
+	return fmt.Sprintf("ID=%d, FROM=%d, TO=%d, Amount=%s %s",
+		p.AccountID, p.AccountFromID, p.AccountToID, p.Amount.Decimal(p.Currency), p.Currency)
 }
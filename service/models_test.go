@@ -1,7 +1,10 @@
 package main
 
 import (
+	"encoding/json"
+	"reflect"
 	"testing"
+	"time"
 )
 
 func TestOutgoing(t *testing.T) {
@@ -14,12 +17,14 @@ func TestOutgoing(t *testing.T) {
 				AccountFromID: 5,
 				AccountToID:   10,
 				Amount:        100,
+				Currency:      "USD",
 			},
 			expected: Payment{
 				AccountID:     5,
 				AccountToID:   10,
 				AccountFromID: 0,
 				Amount:        100,
+				Currency:      "USD",
 				Direction:     "outgoing",
 			},
 		},
@@ -42,12 +47,14 @@ func TestIncoming(t *testing.T) {
 				AccountFromID: 5,
 				AccountToID:   10,
 				Amount:        100,
+				Currency:      "USD",
 			},
 			expected: Payment{
 				AccountID:     10,
 				AccountToID:   0,
 				AccountFromID: 5,
 				Amount:        100,
+				Currency:      "USD",
 				Direction:     "incoming",
 			},
 		},
@@ -60,3 +67,558 @@ func TestIncoming(t *testing.T) {
 		}
 	}
 }
+
+func TestPaymentJSON(t *testing.T) {
+	payment := Payment{AccountID: 1, AccountToID: 2, Amount: 1005, Currency: "USD", Direction: "outgoing"}
+
+	data, err := json.Marshal(payment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		t.Fatal(err)
+	}
+	if raw["amount"] != "10.05" {
+		t.Errorf("Unexpected amount in %s", data)
+	}
+
+	var decoded Payment
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded != payment {
+		t.Errorf("Unexpected payment %s, expected %s", decoded, payment)
+	}
+}
+
+func TestPaymentRequest(t *testing.T) {
+	requests := []struct {
+		payload  string
+		currency string
+		expected Amount
+		fail     bool
+	}{
+		{payload: `{"from_account":1, "to_account":2, "amount":"10.05"}`, currency: "USD", expected: 1005},
+		{payload: `{"from_account":1, "to_account":2, "amount":10.05}`, currency: "USD", expected: 1005},
+		{payload: `{"from_account":1, "to_account":2, "amount":"10"}`, currency: "JPY", expected: 10},
+		{payload: `{"from_account":1, "to_account":2, "amount":"10.5"}`, currency: "JPY", fail: true},
+		{payload: `{"from_account":1, "splits":[{"to_account":2, "amount":"10.05"}, {"to_account":3, "amount":5}]}`, currency: "USD", expected: 1505},
+		{payload: `{"from_account":1, "splits":[{"to_account":2, "amount":"10"}, {"to_account":3, "amount":"0.5"}]}`, currency: "JPY", fail: true},
+	}
+
+	for _, test := range requests {
+		var request PaymentRequest
+		if err := json.Unmarshal([]byte(test.payload), &request); err != nil {
+			t.Fatal(err)
+		}
+		payment, err := request.Payment(test.currency)
+		if (err != nil) != test.fail {
+			t.Errorf("Unexpected error %v for %s", err, test.payload)
+		}
+		if err == nil && (payment.Amount != test.expected || payment.Currency != test.currency) {
+			t.Errorf("Unexpected payment %s for %s", payment, test.payload)
+		}
+	}
+}
+
+func TestTransferValidate(t *testing.T) {
+	transfers := []struct {
+		transfer Transfer
+		valid    bool
+	}{
+		{
+			transfer: Transfer{Payments: []Payment{
+				{AccountID: 1, Amount: 100, Currency: "USD", Direction: "outgoing"},
+				{AccountID: 2, Amount: 100, Currency: "USD", Direction: "incoming"},
+			}},
+			valid: true,
+		},
+		{
+			transfer: Transfer{Payments: []Payment{
+				{AccountID: 1, Amount: 100, Currency: "USD", Direction: "outgoing"},
+				{AccountID: 2, Amount: 70, Currency: "USD", Direction: "incoming"},
+				{AccountID: 3, Amount: 30, Currency: "USD", Direction: "incoming"},
+			}},
+			valid: true,
+		},
+		{
+			transfer: Transfer{Payments: []Payment{
+				{AccountID: 1, Amount: 100, Currency: "USD", Direction: "outgoing"},
+				{AccountID: 2, Amount: 90, Currency: "USD", Direction: "incoming"},
+			}},
+		},
+		{
+			transfer: Transfer{Payments: []Payment{
+				{AccountID: 1, Amount: 100, Currency: "USD", Direction: "outgoing"},
+				{AccountID: 2, Amount: 100, Currency: "EUR", Direction: "incoming"},
+			}},
+		},
+		{
+			transfer: Transfer{Payments: []Payment{
+				{AccountID: 1, Amount: 0, Currency: "USD", Direction: "outgoing"},
+				{AccountID: 2, Amount: 0, Currency: "USD", Direction: "incoming"},
+			}},
+		},
+		{
+			transfer: Transfer{Payments: []Payment{
+				{AccountID: 1, Amount: 100, Currency: "USD", Direction: "outgoing"},
+			}},
+		},
+	}
+
+	for i, test := range transfers {
+		if err := test.transfer.Validate(); (err == nil) != test.valid {
+			t.Errorf("Unexpected validation result %v for transfer #%d", err, i)
+		}
+	}
+}
+
+func TestPaymentTransfer(t *testing.T) {
+	tests := []struct {
+		source, dest           Account
+		amount                 Amount
+		sourceAfter, destAfter Amount
+		fail                   bool
+	}{
+		{
+			source: Account{Balance: 100, Currency: "USD"}, dest: Account{Balance: 5, Currency: "USD"},
+			amount: 100, sourceAfter: 0, destAfter: 105,
+		},
+		{
+			source: Account{Balance: 100, Currency: "USD"}, dest: Account{Balance: 5, Currency: "USD"},
+			amount: 101, sourceAfter: 100, destAfter: 5, fail: true,
+		},
+		{
+			source: Account{Balance: 100, Currency: "USD"}, dest: Account{Balance: 5, Currency: "EUR"},
+			amount: 10, sourceAfter: 100, destAfter: 5, fail: true,
+		},
+	}
+
+	for i, test := range tests {
+		test.source.ID, test.dest.ID = 1, 2
+		payment := Payment{AccountFromID: 1, AccountToID: 2, Amount: test.amount, Currency: test.source.Currency}
+		transfer, err := payment.Transfer(&test.source, &test.dest)
+		if (err != nil) != test.fail {
+			t.Errorf("Unexpected error %v for transfer #%d", err, i)
+		}
+		if test.source.Balance != test.sourceAfter || test.dest.Balance != test.destAfter {
+			t.Errorf("Unexpected balances %d, %d after transfer #%d", test.source.Balance, test.dest.Balance, i)
+		}
+		if err == nil && len(transfer.Payments) != 2 {
+			t.Errorf("Unexpected legs %v of transfer #%d", transfer.Payments, i)
+		}
+	}
+}
+
+func TestPaymentSplit(t *testing.T) {
+	tests := []struct {
+		dests   []Account
+		amounts []Amount
+		after   []Amount
+		fail    bool
+	}{
+		{
+			dests: []Account{{Balance: 5, Currency: "USD"}, {Currency: "USD"}}, amounts: []Amount{60, 40},
+			after: []Amount{0, 65, 40},
+		},
+		{
+			dests: []Account{{Balance: 5, Currency: "USD"}, {Currency: "USD"}}, amounts: []Amount{60, 41},
+			after: []Amount{100, 5, 0}, fail: true,
+		},
+		{
+			dests: []Account{{Balance: 5, Currency: "USD"}, {Currency: "EUR"}}, amounts: []Amount{60, 40},
+			after: []Amount{100, 5, 0}, fail: true,
+		},
+	}
+
+	for i, test := range tests {
+		source := Account{Balance: 100, Currency: "USD"}
+		source.ID = 1
+		accounts := map[uint]*Account{1: &source}
+		payment := Payment{AccountFromID: 1, Currency: "USD"}
+		var splits []Payment
+		for j := range test.dests {
+			dest := &test.dests[j]
+			dest.ID = uint(j + 2)
+			accounts[dest.ID] = dest
+			splits = append(splits, Payment{AccountFromID: 1, AccountToID: dest.ID, Amount: test.amounts[j], Currency: "USD"})
+			payment.Amount += test.amounts[j]
+		}
+		transfer, err := payment.Split(splits, accounts)
+		if (err != nil) != test.fail {
+			t.Errorf("Unexpected error %v for split #%d", err, i)
+		}
+		for j, balance := range test.after {
+			if accounts[uint(j+1)].Balance != balance {
+				t.Errorf("Unexpected balance %d of account %d after split #%d", accounts[uint(j+1)].Balance, j+1, i)
+			}
+		}
+		if len(transfer.Payments) != len(splits)+1 || transfer.Validate() != nil {
+			t.Errorf("Unexpected legs %v of split #%d", transfer.Payments, i)
+		}
+	}
+}
+
+func TestTransferReversal(t *testing.T) {
+	payment := Payment{AccountFromID: 1, AccountToID: 2, Amount: 100, Currency: "USD"}
+	posted := Transfer{Status: statusPosted, Payments: []Payment{payment.Outgoing(), payment.Incoming()}}
+	posted.ID = 7
+	split := Transfer{Status: statusPosted, Payments: []Payment{
+		{AccountID: 1, AccountToID: 2, Amount: 100, Currency: "USD", Direction: "outgoing"},
+		{AccountID: 2, AccountFromID: 1, Amount: 70, Currency: "USD", Direction: "incoming"},
+		{AccountID: 3, AccountFromID: 1, Amount: 30, Currency: "USD", Direction: "incoming"},
+	}}
+
+	tests := []struct {
+		transfer         Transfer
+		amount, refunded Amount
+		fail             bool
+	}{
+		{transfer: posted, amount: 100},
+		{transfer: posted, amount: 40, refunded: 60},
+		{transfer: posted, amount: 41, refunded: 60, fail: true},
+		{transfer: posted, amount: 0, fail: true},
+		{transfer: split, amount: 100},
+		{transfer: split, amount: 50, fail: true},
+		{transfer: Transfer{Status: statusFailed, Payments: posted.Payments}, amount: 100, fail: true},
+		{transfer: Transfer{Status: statusPosted, ReversalOfID: 1, Payments: posted.Payments}, amount: 100, fail: true},
+	}
+
+	for i, test := range tests {
+		reversal, err := test.transfer.Reversal(test.amount, test.refunded)
+		if (err != nil) != test.fail {
+			t.Errorf("Unexpected error %v for reversal #%d", err, i)
+		}
+		if err != nil {
+			continue
+		}
+		if reversal.ReversalOfID != test.transfer.ID || reversal.Status != statusPending || reversal.Validate() != nil {
+			t.Errorf("Unexpected reversal %+v #%d", reversal, i)
+		}
+		for j, leg := range reversal.Payments {
+			original := test.transfer.Payments[j]
+			if leg.AccountID != original.AccountID || leg.Direction == original.Direction {
+				t.Errorf("Leg %s doesn't compensate %s in reversal #%d", leg, original, i)
+			}
+		}
+		if total, _ := reversal.Total(); total != test.amount {
+			t.Errorf("Unexpected reversal amount %d #%d", total, i)
+		}
+	}
+}
+
+func TestPaymentExchange(t *testing.T) {
+	rate := ExchangeRate{FromCurrency: "USD", ToCurrency: "JPY", Rate: "110.5"}
+	tests := []struct {
+		fxBalance            Amount
+		amount               Amount
+		rate                 ExchangeRate
+		converted            Amount
+		sourceAfter, fxAfter Amount
+		fail                 bool
+	}{
+		{fxBalance: 2000, amount: 1001, rate: rate, converted: 1106, sourceAfter: 8999, fxAfter: 894},
+		{fxBalance: 1000, amount: 1001, rate: rate, sourceAfter: 10000, fxAfter: 1000, fail: true},
+		{fxBalance: 2000, amount: 1, rate: ExchangeRate{FromCurrency: "USD", ToCurrency: "JPY", Rate: "0.01"},
+			sourceAfter: 10000, fxAfter: 2000, fail: true},
+		{fxBalance: 2000, amount: 1001, rate: ExchangeRate{FromCurrency: "USD", ToCurrency: "EUR", Rate: "0.9"},
+			sourceAfter: 10000, fxAfter: 2000, fail: true},
+	}
+
+	for i, test := range tests {
+		source, dest := Account{Balance: 10000, Currency: "USD"}, Account{Currency: "JPY"}
+		fxSource, fxDest := Account{Owner: fxOwner, Currency: "USD"}, Account{Owner: fxOwner, Balance: test.fxBalance, Currency: "JPY"}
+		source.ID, dest.ID, fxSource.ID, fxDest.ID = 1, 2, 3, 4
+		payment := Payment{AccountFromID: 1, AccountToID: 2, Amount: test.amount, Currency: "USD"}
+		transfer, err := payment.Exchange(&source, &dest, &fxSource, &fxDest, test.rate, roundHalfUp)
+		if (err != nil) != test.fail {
+			t.Errorf("Unexpected error %v for exchange #%d", err, i)
+		}
+		if source.Balance != test.sourceAfter || fxDest.Balance != test.fxAfter {
+			t.Errorf("Unexpected balances %d, %d after exchange #%d", source.Balance, fxDest.Balance, i)
+		}
+		if err != nil {
+			continue
+		}
+		if err := transfer.Validate(); err != nil || len(transfer.Payments) != 4 {
+			t.Errorf("Unexpected legs %v of exchange #%d (%v)", transfer.Payments, i, err)
+		}
+		if dest.Balance != test.converted || fxSource.Balance != test.amount {
+			t.Errorf("Unexpected balances %d, %d after exchange #%d", dest.Balance, fxSource.Balance, i)
+		}
+		for _, leg := range transfer.Payments {
+			if leg.Rate != test.rate.Rate || leg.SourceAmount != test.amount || leg.DestinationAmount != test.converted {
+				t.Errorf("Leg %s doesn't record conversion of exchange #%d", leg, i)
+			}
+		}
+	}
+}
+
+func TestFeeScheduleFee(t *testing.T) {
+	tests := []struct {
+		schedule FeeSchedule
+		amount   Amount
+		expected Amount
+	}{
+		{schedule: FeeSchedule{Currency: "USD", Flat: 30}, amount: 1000, expected: 30},
+		{schedule: FeeSchedule{Currency: "USD", Flat: 30, Percent: "2.9"}, amount: 1000, expected: 59},
+		{schedule: FeeSchedule{Currency: "USD", Percent: "2.9"}, amount: 5, expected: 0},
+		{schedule: FeeSchedule{Currency: "USD", Flat: 30, Percent: "2.9", Min: 50}, amount: 500, expected: 50},
+		{schedule: FeeSchedule{Currency: "USD", Percent: "1", Max: 500}, amount: 100000, expected: 500},
+		{schedule: FeeSchedule{Currency: "USD"}, amount: 100000, expected: 0},
+	}
+
+	for i, test := range tests {
+		fee, err := test.schedule.Fee(test.amount, roundHalfUp)
+		if err != nil {
+			t.Errorf("Unexpected error %v for schedule #%d", err, i)
+		}
+		if fee != test.expected {
+			t.Errorf("Unexpected fee %d of %d for schedule #%d, expected %d", fee, test.amount, i, test.expected)
+		}
+	}
+}
+
+func TestTransferChargeFee(t *testing.T) {
+	source, dest, revenue := Account{Balance: 1000, Currency: "USD"}, Account{Currency: "USD"}, Account{Owner: revenueOwner, Currency: "USD"}
+	source.ID, dest.ID, revenue.ID = 1, 2, 3
+	payment := Payment{AccountFromID: 1, AccountToID: 2, Amount: 900, Currency: "USD"}
+	transfer, err := payment.Transfer(&source, &dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := transfer.ChargeFee(&source, &revenue, 101); err == nil || len(transfer.Payments) != 2 || source.Balance != 100 {
+		t.Errorf("Fee exceeding balance should not be charged: %v, %v", err, transfer.Payments)
+	}
+	if err := transfer.ChargeFee(&source, &revenue, 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := transfer.Validate(); err != nil || len(transfer.Payments) != 4 {
+		t.Errorf("Unexpected legs %v (%v)", transfer.Payments, err)
+	}
+	if source.Balance != 0 || revenue.Balance != 100 || dest.Balance != 900 {
+		t.Errorf("Unexpected balances %d, %d, %d", source.Balance, revenue.Balance, dest.Balance)
+	}
+	for _, leg := range transfer.Payments {
+		if (leg.Kind == feeKind) != (leg.AccountID == 3 || leg.AccountToID == 3) || leg.Fee != 100 && leg.Kind != feeKind {
+			t.Errorf("Unexpected leg %+v", leg)
+		}
+	}
+	if total, _ := transfer.Total(); total != 900 {
+		t.Errorf("Fee should not count towards total %d", total)
+	}
+}
+
+func TestHoldCaptures(t *testing.T) {
+	now := time.Now()
+	hold := Hold{Amount: 500, Currency: "USD", Status: holdActive, ExpiresAt: now.Add(time.Minute)}
+	testCases := []struct {
+		status string
+		amount Amount
+		at     time.Time
+		valid  bool
+	}{
+		{status: holdActive, amount: 500, at: now, valid: true},
+		{status: holdActive, amount: 1, at: now, valid: true},
+		{status: holdActive, amount: 501, at: now},
+		{status: holdActive, amount: 500, at: hold.ExpiresAt},
+		{status: holdCaptured, amount: 500, at: now},
+		{status: holdVoided, amount: 500, at: now},
+	}
+	for _, testCase := range testCases {
+		hold.Status = testCase.status
+		if err := hold.Captures(testCase.amount, testCase.at); (err == nil) != testCase.valid {
+			t.Errorf("Unexpected result of %s hold capture of %d: %v", testCase.status, testCase.amount, err)
+		}
+	}
+}
+
+func TestTransferApplyHeld(t *testing.T) {
+	source, dest := Account{Balance: 1000, Held: 300, Currency: "USD"}, Account{Currency: "USD"}
+	source.ID, dest.ID = 1, 2
+	accounts := map[uint]*Account{1: &source, 2: &dest}
+
+	payment := Payment{AccountFromID: 1, AccountToID: 2, Amount: 701, Currency: "USD"}
+	transfer := Transfer{Payments: []Payment{payment.Outgoing(), payment.Incoming()}}
+	if err := transfer.Apply(accounts); err == nil || source.Balance != 1000 {
+		t.Errorf("Held funds should not be spent: %v, %d", err, source.Balance)
+	}
+	payment.Amount = 700
+	transfer = Transfer{Payments: []Payment{payment.Outgoing(), payment.Incoming()}}
+	if err := transfer.Apply(accounts); err != nil || source.Available() != 0 || source.Held != 300 {
+		t.Errorf("Unexpected result %v, %d available", err, source.Available())
+	}
+}
+
+func TestLimitCheck(t *testing.T) {
+	limit := Limit{AccountID: 1, Currency: "USD", MaxAmount: 500, DailyAmount: 1000, MonthlyAmount: 2000, HourlyCount: 3}
+	testCases := []struct {
+		amount Amount
+		usage  LimitUsage
+		valid  bool
+	}{
+		{amount: 500, valid: true},
+		{amount: 501},
+		{amount: 500, usage: LimitUsage{Daily: 500, Monthly: 1500, Hourly: 2}, valid: true},
+		{amount: 500, usage: LimitUsage{Daily: 501, Monthly: 501}},
+		{amount: 500, usage: LimitUsage{Daily: 0, Monthly: 1501}},
+		{amount: 1, usage: LimitUsage{Hourly: 3}},
+	}
+	for _, testCase := range testCases {
+		err := limit.Check(testCase.amount, testCase.usage)
+		if (err == nil) != testCase.valid {
+			t.Errorf("Unexpected result of %d payment with %+v used: %v", testCase.amount, testCase.usage, err)
+		}
+		if _, ok := err.(limitError); err != nil && !ok {
+			t.Errorf("Unexpected error type %T", err)
+		}
+	}
+
+	// No restrictions
+	if err := (Limit{Currency: "USD"}).Check(1000000, LimitUsage{Daily: 1000000, Hourly: 1000}); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestApprovalDecide(t *testing.T) {
+	now := time.Now()
+	approval := Approval{Maker: "alice", Status: approvalPending, ExpiresAt: now.Add(time.Minute)}
+	testCases := []struct {
+		status   string
+		checker  string
+		decision string
+		at       time.Time
+		valid    bool
+	}{
+		{status: approvalPending, checker: "bob", decision: reviewApproved, at: now, valid: true},
+		{status: approvalPending, checker: "bob", decision: reviewRejected, at: now, valid: true},
+		{status: approvalPending, checker: "alice", decision: reviewApproved, at: now},
+		{status: approvalPending, checker: "alice", decision: reviewRejected, at: now, valid: true},
+		{status: approvalPending, checker: "bob", decision: reviewApproved, at: approval.ExpiresAt},
+		{status: approvalApproved, checker: "bob", decision: reviewApproved, at: now},
+		{status: approvalExpired, checker: "bob", decision: reviewRejected, at: now},
+	}
+	for _, testCase := range testCases {
+		approval.Status = testCase.status
+		if err := approval.Decide(testCase.checker, testCase.decision, testCase.at); (err == nil) != testCase.valid {
+			t.Errorf("Unexpected result of %s decision on %s approval by %s: %v", testCase.decision, testCase.status, testCase.checker, err)
+		}
+	}
+}
+
+func TestMandateFail(t *testing.T) {
+	start := time.Date(2018, time.January, 1, 9, 0, 0, 0, time.UTC)
+	recurrence, _ := parseRecurrence(weeklyRecurrence, start)
+	testCases := []struct {
+		behavior string
+		retries  int
+		attempts int
+		status   string
+		next     time.Time
+		left     int
+	}{
+		{behavior: insufficientSkip, status: mandateActive, next: start.AddDate(0, 0, 7)},
+		{behavior: insufficientRetry, retries: 2, status: mandateActive, next: start.Add(time.Hour), left: 1},
+		{behavior: insufficientRetry, retries: 2, attempts: 1, status: mandateActive, next: start.Add(time.Hour), left: 2},
+		{behavior: insufficientRetry, retries: 2, attempts: 2, status: mandateActive, next: start.AddDate(0, 0, 7)},
+		{behavior: insufficientSuspend, status: mandateSuspended, next: start, left: 1},
+	}
+	for _, testCase := range testCases {
+		mandate := Mandate{
+			OnInsufficientFunds: testCase.behavior,
+			Retries:             testCase.retries,
+			Status:              mandateActive,
+			DueAt:               start,
+			NextRunAt:           start,
+			Attempts:            testCase.attempts,
+		}
+		mandate.Fail(recurrence, start, time.Hour)
+		if mandate.Status != testCase.status || !mandate.NextRunAt.Equal(testCase.next) || mandate.Attempts != testCase.left {
+			t.Errorf("Unexpected mandate %+v after failure with %s", mandate, testCase.behavior)
+		}
+	}
+
+	// Retry isn't made once the next occurrence is due
+	mandate := Mandate{OnInsufficientFunds: insufficientRetry, Retries: 5, Status: mandateActive, DueAt: start}
+	mandate.Fail(recurrence, start, 8*24*time.Hour)
+	if !mandate.DueAt.Equal(start.AddDate(0, 0, 7)) || mandate.Attempts != 0 {
+		t.Errorf("Unexpected mandate %+v after failure", mandate)
+	}
+}
+
+func TestMandateSetStatus(t *testing.T) {
+	start := time.Date(2018, time.January, 1, 9, 0, 0, 0, time.UTC)
+	mandate := Mandate{Schedule: dailyRecurrence, StartAt: start, Status: mandateActive, DueAt: start, NextRunAt: start}
+	if err := mandate.SetStatus(mandateActive, start); err == nil {
+		t.Error("Active mandate can't be resumed")
+	}
+	if err := mandate.SetStatus(mandatePaused, start); err != nil || mandate.Status != mandatePaused {
+		t.Errorf("Unexpected result %+v, %v", mandate, err)
+	}
+	// Occurrences missed while paused are not paid
+	at := start.Add(50 * time.Hour)
+	if err := mandate.SetStatus(mandateActive, at); err != nil || !mandate.NextRunAt.Equal(start.AddDate(0, 0, 3)) {
+		t.Errorf("Unexpected result %+v, %v", mandate, err)
+	}
+	if err := mandate.SetStatus(mandateCanceled, at); err != nil || mandate.Status != mandateCanceled {
+		t.Errorf("Unexpected result %+v, %v", mandate, err)
+	}
+	if err := mandate.SetStatus(mandateActive, at); err == nil {
+		t.Error("Canceled mandate can't be resumed")
+	}
+}
+
+func TestPaymentBatchComplete(t *testing.T) {
+	testCases := []struct {
+		items  []string
+		status string
+	}{
+		{items: []string{statusPosted, statusReview}, status: batchCompleted},
+		{items: []string{statusPosted, statusFailed}, status: batchPartial},
+		{items: []string{statusFailed, statusFailed}, status: batchFailed},
+	}
+	for _, testCase := range testCases {
+		batch := PaymentBatch{Status: batchProcessing}
+		for _, status := range testCase.items {
+			batch.Items = append(batch.Items, BatchItem{Status: status})
+		}
+		if batch.Complete(); batch.Status != testCase.status {
+			t.Errorf("Batch of %v should be %s, was %s", testCase.items, testCase.status, batch.Status)
+		}
+	}
+}
+
+func TestStatement(t *testing.T) {
+	at := time.Date(2018, time.March, 31, 23, 59, 0, 0, time.UTC)
+	statement := Statement{AccountID: 1, Currency: "USD", To: at.Add(time.Minute), OpeningBalance: 1000, ClosingBalance: 1000}
+	for _, payment := range []Payment{
+		{AccountID: 1, Amount: 500, Direction: incoming, AccountFromID: 2, TransferID: 1, PostedAt: &at},
+		// Counterparty of outgoing payment is its destination account
+		{AccountID: 1, Amount: 2000, Direction: outgoing, AccountFromID: 1, AccountToID: 3, TransferID: 2, PostedAt: &at},
+		{AccountID: 1, Amount: 10, Direction: outgoing, AccountToID: 4, TransferID: 2, Kind: feeKind, PostedAt: &at},
+	} {
+		statement.Add(payment)
+	}
+	if statement.OpeningBalance != 1000 || statement.ClosingBalance != -510 {
+		t.Errorf("Unexpected statement balances %d and %d", statement.OpeningBalance, statement.ClosingBalance)
+	}
+	for i, balance := range []Amount{1500, -500, -510} {
+		if statement.Lines[i].Balance != balance {
+			t.Errorf("Unexpected balance %d after movement #%d", statement.Lines[i].Balance, i)
+		}
+	}
+
+	expected := [][]string{
+		statementCSVHeader,
+		{"", "opening", "", "", "", "", "10.00", "USD"},
+		{"2018-03-31T23:59:00Z", "incoming", "0", "1", "2", "5.00", "15.00", "USD"},
+		{"2018-03-31T23:59:00Z", "outgoing", "0", "2", "3", "-20.00", "-5.00", "USD"},
+		{"2018-03-31T23:59:00Z", "fee", "0", "2", "4", "-0.10", "-5.10", "USD"},
+		{"2018-04-01T00:00:00Z", "closing", "", "", "", "", "-5.10", "USD"},
+	}
+	if records := statement.CSV(); !reflect.DeepEqual(records, expected) {
+		t.Errorf("Unexpected CSV records %v", records)
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// defaultExponent is used for currencies missing in `currencyExponents`
+const defaultExponent = 2
+
+// currencyExponents lists supported currencies with the number of digits
+// of their minor unit (see ISO 4217).
+var currencyExponents = map[string]int{
+	"AUD": 2,
+	"BHD": 3,
+	"CAD": 2,
+	"CHF": 2,
+	"CNY": 2,
+	"EUR": 2,
+	"GBP": 2,
+	"JPY": 0,
+	"KRW": 0,
+	"KWD": 3,
+	"PHP": 2,
+	"RUB": 2,
+	"USD": 2,
+}
+
+// Rounding modes of converted amounts, see `Amount.Convert`
+const (
+	roundHalfUp   = "half-up"
+	roundHalfEven = "half-even"
+	roundDown     = "down"
+	roundUp       = "up"
+)
+
+// defaultRounding is used for currencies without configured rounding mode
+const defaultRounding = roundHalfUp
+
+// knownRounding checks rounding is one of rounding modes
+func knownRounding(rounding string) bool {
+	switch rounding {
+	case roundHalfUp, roundHalfEven, roundDown, roundUp:
+		return true
+	}
+	return false
+}
+
+// decimalPattern is a format of decimal numbers accepted from API clients.
+// Exponent notation is not allowed.
+var decimalPattern = regexp.MustCompile(`^-?[0-9]+(\.[0-9]+)?$`)
+
+// supportedCurrency checks currency is known to `currencyExponents`
+func supportedCurrency(currency string) bool {
+	_, ok := currencyExponents[currency]
+	return ok
+}
+
+// currencyExponent returns number of digits after decimal point for currency
+func currencyExponent(currency string) int {
+	if exp, ok := currencyExponents[currency]; ok {
+		return exp
+	}
+	return defaultExponent
+}
+
+// Amount is an exact money amount in minor units of some currency (e.g. cents
+// for USD). It's stored as integer in the database and formatted as decimal
+// string for API clients, see `Decimal`.
+type Amount int64
+
+// Decimal formats amount as a decimal number using currency exponent,
+// e.g. 1005 USD becomes "10.05" and 1005 JPY becomes "1005".
+func (a Amount) Decimal(currency string) Decimal {
+	exp := currencyExponent(currency)
+	sign, units := "", int64(a)
+	if units < 0 {
+		sign, units = "-", -units
+	}
+	digits := strconv.FormatInt(units, 10)
+	if exp == 0 {
+		return Decimal(sign + digits)
+	}
+	if len(digits) <= exp {
+		digits = strings.Repeat("0", exp-len(digits)+1) + digits
+	}
+	return Decimal(sign + digits[:len(digits)-exp] + "." + digits[len(digits)-exp:])
+}
+
+// Convert converts amount from one currency into another with exchange rate,
+// which is a price of a unit of `from` currency in `to` currency. Converted
+// amount is rounded to minor units of `to` currency, see `Amount.scale`.
+// Returns error if rate or rounding are not valid or result is out of range.
+func (a Amount) Convert(from string, to string, rate Decimal, rounding string) (Amount, error) {
+	if !rate.Positive() {
+		return 0, fmt.Errorf("Invalid exchange rate %q", rate)
+	}
+	// Minor units of currencies with different exponents differ in scale
+	res, err := a.scale(rate, currencyExponent(to)-currencyExponent(from), rounding)
+	if err != nil {
+		return 0, fmt.Errorf("Can't convert %s %s: %s", a.Decimal(from), from, err)
+	}
+	return res, nil
+}
+
+// Percent returns percentage of amount, rounded to minor units.
+// Returns error if percentage or rounding are not valid or result is out of range.
+func (a Amount) Percent(percent Decimal, rounding string) (Amount, error) {
+	return a.scale(percent, -2, rounding)
+}
+
+// scale multiplies amount by factor and by 10 to the power of shift and rounds
+// the result to integer: `down` and `up` round towards and away from zero,
+// `half-up` and `half-even` round to the nearest integer and differ only in
+// how ties are broken.
+// Returns error if factor or rounding are not valid or result is out of range.
+func (a Amount) scale(factor Decimal, shift int, rounding string) (Amount, error) {
+	f, ok := new(big.Rat).SetString(string(factor))
+	if !ok || !decimalPattern.MatchString(string(factor)) {
+		return 0, fmt.Errorf("Malformed decimal number %q", factor)
+	}
+	if !knownRounding(rounding) {
+		return 0, fmt.Errorf("Unknown rounding %q", rounding)
+	}
+	value := new(big.Rat).Mul(new(big.Rat).SetInt64(int64(a)), f)
+	for ; shift > 0; shift-- {
+		value.Mul(value, big.NewRat(10, 1))
+	}
+	for ; shift < 0; shift++ {
+		value.Quo(value, big.NewRat(10, 1))
+	}
+
+	units, rem := new(big.Int).QuoRem(value.Num(), value.Denom(), new(big.Int))
+	if rem.Sign() != 0 {
+		// Compares remainder with a half
+		half := new(big.Int).Mul(new(big.Int).Abs(rem), big.NewInt(2)).Cmp(value.Denom())
+		away := false
+		switch rounding {
+		case roundDown:
+		case roundUp:
+			away = true
+		case roundHalfUp:
+			away = half >= 0
+		case roundHalfEven:
+			away = half > 0 || half == 0 && units.Bit(0) == 1
+		}
+		if away {
+			units.Add(units, big.NewInt(int64(value.Sign())))
+		}
+	}
+	if !units.IsInt64() {
+		return 0, errors.New("result is out of range")
+	}
+	return Amount(units.Int64()), nil
+}
+
+// Decimal is an exact decimal number as sent to and by API clients. Both JSON
+// strings ("10.05") and numbers (10.05) are accepted, the value never goes
+// through float64. Decimal is converted to `Amount` once currency is known.
+type Decimal string
+
+// UnmarshalJSON implements json.Unmarshaler interface
+func (d *Decimal) UnmarshalJSON(data []byte) error {
+	value := string(data)
+	if value == "null" {
+		*d = ""
+		return nil
+	}
+	if strings.HasPrefix(value, `"`) {
+		if err := json.Unmarshal(data, &value); err != nil {
+			return err
+		}
+	}
+	if !decimalPattern.MatchString(value) {
+		return fmt.Errorf("Malformed decimal number %s", data)
+	}
+	*d = Decimal(value)
+	return nil
+}
+
+// Positive checks decimal number is greater than zero
+func (d Decimal) Positive() bool {
+	return !strings.HasPrefix(string(d), "-") && strings.Trim(string(d), "0.") != ""
+}
+
+// Amount converts decimal number into minor units of currency.
+// Returns error if number is malformed, out of range or is more precise than
+// the currency minor unit. Empty decimal is zero.
+func (d Decimal) Amount(currency string) (Amount, error) {
+	if d == "" {
+		return 0, nil
+	}
+	if !decimalPattern.MatchString(string(d)) {
+		return 0, fmt.Errorf("Malformed decimal number %s", d)
+	}
+	exp := currencyExponent(currency)
+	value := strings.TrimPrefix(string(d), "-")
+	whole, fraction := value, ""
+	if i := strings.Index(value, "."); i >= 0 {
+		whole, fraction = value[:i], strings.TrimRight(value[i+1:], "0")
+	}
+	if len(fraction) > exp {
+		return 0, fmt.Errorf("%s amounts can't have more than %d decimal places", currency, exp)
+	}
+	units, err := strconv.ParseInt(whole+fraction+strings.Repeat("0", exp-len(fraction)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Amount %s is out of range", d)
+	}
+	if strings.HasPrefix(string(d), "-") {
+		units = -units
+	}
+	return Amount(units), nil
+}
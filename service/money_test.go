@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestDecimalAmount(t *testing.T) {
+	decimals := []struct {
+		value    Decimal
+		currency string
+		expected Amount
+		fail     bool
+	}{
+		{value: "10.05", currency: "USD", expected: 1005},
+		{value: "0.1", currency: "USD", expected: 10},
+		{value: "-0.01", currency: "USD", expected: -1},
+		{value: "10.500", currency: "USD", expected: 1050},
+		{value: "7", currency: "USD", expected: 700},
+		{value: "", currency: "USD", expected: 0},
+		{value: "1000", currency: "JPY", expected: 1000},
+		{value: "1.234", currency: "KWD", expected: 1234},
+		{value: "0.001", currency: "USD", fail: true},
+		{value: "10.5", currency: "JPY", fail: true},
+		{value: "1e3", currency: "USD", fail: true},
+		{value: "99999999999999999999", currency: "USD", fail: true},
+	}
+
+	for _, test := range decimals {
+		amount, err := test.value.Amount(test.currency)
+		if (err != nil) != test.fail {
+			t.Errorf("Unexpected error %v for %s %s", err, test.value, test.currency)
+		}
+		if err == nil && amount != test.expected {
+			t.Errorf("Unexpected amount %d for %s %s, expected %d", amount, test.value, test.currency, test.expected)
+		}
+	}
+}
+
+func TestAmountDecimal(t *testing.T) {
+	amounts := []struct {
+		amount   Amount
+		currency string
+		expected Decimal
+	}{
+		{amount: 1005, currency: "USD", expected: "10.05"},
+		{amount: 5, currency: "USD", expected: "0.05"},
+		{amount: -5, currency: "USD", expected: "-0.05"},
+		{amount: 0, currency: "USD", expected: "0.00"},
+		{amount: 1005, currency: "JPY", expected: "1005"},
+		{amount: 1005, currency: "KWD", expected: "1.005"},
+	}
+
+	for _, test := range amounts {
+		if out := test.amount.Decimal(test.currency); out != test.expected {
+			t.Errorf("Unexpected decimal %s for %d %s, expected %s", out, test.amount, test.currency, test.expected)
+		}
+	}
+}
+
+func TestDecimalUnmarshal(t *testing.T) {
+	values := []struct {
+		json     string
+		expected Decimal
+		fail     bool
+	}{
+		{json: `"10.05"`, expected: "10.05"},
+		{json: `10.05`, expected: "10.05"},
+		{json: `null`, expected: ""},
+		{json: `"ten"`, fail: true},
+		{json: `1e3`, fail: true},
+		{json: `" 1"`, fail: true},
+	}
+
+	for _, test := range values {
+		var out Decimal
+		err := json.Unmarshal([]byte(test.json), &out)
+		if (err != nil) != test.fail {
+			t.Errorf("Unexpected error %v for %s", err, test.json)
+		}
+		if err == nil && out != test.expected {
+			t.Errorf("Unexpected decimal %s for %s", out, test.json)
+		}
+	}
+}
+
+func TestDecimalPositive(t *testing.T) {
+	values := map[Decimal]bool{
+		"1":     true,
+		"0.01":  true,
+		"0":     false,
+		"0.00":  false,
+		"-1":    false,
+		"":      false,
+		"10.00": true,
+	}
+
+	for value, expected := range values {
+		if value.Positive() != expected {
+			t.Errorf("Unexpected Positive() for %s", value)
+		}
+	}
+}
+
+func TestAmountConvert(t *testing.T) {
+	conversions := []struct {
+		amount   Amount
+		from, to string
+		rate     Decimal
+		rounding string
+		expected Amount
+		fail     bool
+	}{
+		{amount: 1000, from: "USD", to: "EUR", rate: "0.85", rounding: roundHalfUp, expected: 850},
+		{amount: 1000, from: "USD", to: "JPY", rate: "110.125", rounding: roundHalfUp, expected: 1101},
+		{amount: 1000, from: "USD", to: "KWD", rate: "0.3021", rounding: roundHalfUp, expected: 3021},
+		{amount: 1101, from: "JPY", to: "USD", rate: "0.0091", rounding: roundHalfUp, expected: 1002},
+		{amount: 1, from: "USD", to: "EUR", rate: "0.5", rounding: roundHalfUp, expected: 1},
+		{amount: 1, from: "USD", to: "EUR", rate: "0.5", rounding: roundHalfEven, expected: 0},
+		{amount: 3, from: "USD", to: "EUR", rate: "0.5", rounding: roundHalfEven, expected: 2},
+		{amount: 3, from: "USD", to: "EUR", rate: "0.7", rounding: roundDown, expected: 2},
+		{amount: 3, from: "USD", to: "EUR", rate: "0.7", rounding: roundUp, expected: 3},
+		{amount: 3, from: "USD", to: "EUR", rate: "0.7", rounding: roundHalfEven, expected: 2},
+		{amount: -3, from: "USD", to: "EUR", rate: "0.5", rounding: roundHalfUp, expected: -2},
+		{amount: 1000, from: "USD", to: "EUR", rate: "0", rounding: roundHalfUp, fail: true},
+		{amount: 1000, from: "USD", to: "EUR", rate: "-1", rounding: roundHalfUp, fail: true},
+		{amount: 1000, from: "USD", to: "EUR", rate: "1/3", rounding: roundHalfUp, fail: true},
+		{amount: 1000, from: "USD", to: "EUR", rate: "0.3", rounding: "nearest", fail: true},
+		{amount: 1 << 62, from: "USD", to: "EUR", rate: "4", rounding: roundHalfUp, fail: true},
+	}
+
+	for _, test := range conversions {
+		amount, err := test.amount.Convert(test.from, test.to, test.rate, test.rounding)
+		if (err != nil) != test.fail {
+			t.Errorf("Unexpected error %v for %d %s at %s", err, test.amount, test.from, test.rate)
+		}
+		if err == nil && amount != test.expected {
+			t.Errorf("Unexpected amount %d for %d %s at %s %s, expected %d", amount, test.amount, test.from, test.rate, test.rounding, test.expected)
+		}
+	}
+}
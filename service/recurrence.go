@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Interval recurrences of mandates, see `parseRecurrence`
+const (
+	dailyRecurrence   = "daily"
+	weeklyRecurrence  = "weekly"
+	monthlyRecurrence = "monthly"
+)
+
+// cronSearchYears limits search of the next cron occurrence, so expressions
+// which never match (e.g. February 30) don't loop forever
+const cronSearchYears = 5
+
+// errNoOccurrence is returned for recurrences which never occur
+var errNoOccurrence = errors.New("Recurrence never occurs")
+
+// Recurrence yields occurrence times of recurring payments, see `Mandate`.
+type Recurrence interface {
+	// Next returns the first occurrence strictly after given time, zero time
+	// if there is none.
+	Next(after time.Time) time.Time
+}
+
+// parseRecurrence parses recurrence spec starting at given time: `daily`,
+// `weekly` and `monthly` recur at the start time every day, week or month
+// (at the last day of shorter months), anything else is a cron expression
+// in UTC, see `cronRecurrence`.
+// Returns error if spec is not valid.
+func parseRecurrence(spec string, start time.Time) (Recurrence, error) {
+	start = start.UTC()
+	switch spec {
+	case dailyRecurrence:
+		return intervalRecurrence{start: start, days: 1}, nil
+	case weeklyRecurrence:
+		return intervalRecurrence{start: start, days: 7}, nil
+	case monthlyRecurrence:
+		return intervalRecurrence{start: start, months: 1}, nil
+	}
+	return parseCron(spec)
+}
+
+// intervalRecurrence recurs at start every number of days or months
+type intervalRecurrence struct {
+	start  time.Time
+	days   int
+	months int
+}
+
+// Next implements Recurrence interface
+func (r intervalRecurrence) Next(after time.Time) time.Time {
+	if after.Before(r.start) {
+		return r.start
+	}
+	if r.days > 0 {
+		period := time.Duration(r.days) * 24 * time.Hour
+		return r.start.Add((after.Sub(r.start)/period + 1) * period)
+	}
+	for n := 1; ; n++ {
+		if next := r.addMonths(n * r.months); next.After(after) {
+			return next
+		}
+	}
+}
+
+// addMonths adds n months to start, clamping the day to the end of month
+// (e.g. January 31st becomes February 28th, not March 3rd)
+func (r intervalRecurrence) addMonths(n int) time.Time {
+	year, month, day := r.start.Date()
+	first := time.Date(year, month+time.Month(n), 1, r.start.Hour(), r.start.Minute(), r.start.Second(), r.start.Nanosecond(), time.UTC)
+	if last := first.AddDate(0, 1, -1).Day(); day > last {
+		day = last
+	}
+	return first.AddDate(0, 0, day-1)
+}
+
+// cronRecurrence is a cron expression of five space separated fields:
+// minute (0-59), hour (0-23), day of month (1-31), month (1-12) and day of
+// week (0-6, Sunday is 0). Field is either `*` or comma separated list of
+// values and ranges (e.g. `1-5`), both `*` and ranges may have a step (e.g.
+// `*/15`). Like in cron, if both day fields are restricted, either one
+// matching is enough.
+type cronRecurrence struct {
+	minutes  []bool
+	hours    []bool
+	days     []bool
+	months   []bool
+	weekdays []bool
+	anyDay   bool
+	anyWeek  bool
+}
+
+// parseCron parses cron expression, see `cronRecurrence`.
+// Returns error if expression is not valid.
+func parseCron(spec string) (Recurrence, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("Invalid recurrence %q", spec)
+	}
+	var r cronRecurrence
+	var err error
+	for i, field := range []struct {
+		out      *[]bool
+		min, max int
+	}{
+		{&r.minutes, 0, 59},
+		{&r.hours, 0, 23},
+		{&r.days, 1, 31},
+		{&r.months, 1, 12},
+		{&r.weekdays, 0, 6},
+	} {
+		if *field.out, err = parseCronField(fields[i], field.min, field.max); err != nil {
+			return nil, fmt.Errorf("Invalid recurrence %q: %s", spec, err)
+		}
+	}
+	r.anyDay, r.anyWeek = fields[2] == "*", fields[4] == "*"
+	return r, nil
+}
+
+// parseCronField parses one field of cron expression with values from min
+// to max. Returns values matched by field, indexed by value.
+func parseCronField(field string, min, max int) ([]bool, error) {
+	res := make([]bool, max+1)
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+				return nil, fmt.Errorf("invalid step %q", part)
+			}
+			part = part[:i]
+		}
+		from, to := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if from, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, fmt.Errorf("invalid value %q", part)
+			}
+			to = from
+			if len(bounds) == 2 {
+				if to, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, fmt.Errorf("invalid value %q", part)
+				}
+			}
+		}
+		if from < min || to > max || from > to {
+			return nil, fmt.Errorf("%q is out of range %d-%d", part, min, max)
+		}
+		for value := from; value <= to; value += step {
+			res[value] = true
+		}
+	}
+	return res, nil
+}
+
+// matchesDay checks both day fields against the date
+func (r cronRecurrence) matchesDay(t time.Time) bool {
+	day, weekday := r.days[t.Day()], r.weekdays[int(t.Weekday())]
+	switch {
+	case r.anyDay && r.anyWeek:
+		return true
+	case r.anyDay:
+		return weekday
+	case r.anyWeek:
+		return day
+	}
+	return day || weekday
+}
+
+// Next implements Recurrence interface. Occurrences are whole minutes.
+func (r cronRecurrence) Next(after time.Time) time.Time {
+	t := after.UTC().Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(cronSearchYears, 0, 0)
+	for t.Before(limit) {
+		year, month, day := t.Date()
+		switch {
+		case !r.months[int(month)]:
+			t = time.Date(year, month+1, 1, 0, 0, 0, 0, time.UTC)
+		case !r.matchesDay(t):
+			t = time.Date(year, month, day+1, 0, 0, 0, 0, time.UTC)
+		case !r.hours[t.Hour()]:
+			t = t.Truncate(time.Hour).Add(time.Hour)
+		case !r.minutes[t.Minute()]:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRecurrence(t *testing.T) {
+	start := time.Date(2018, time.January, 31, 9, 0, 0, 0, time.UTC)
+	testCases := []struct {
+		spec  string
+		valid bool
+	}{
+		{spec: dailyRecurrence, valid: true},
+		{spec: weeklyRecurrence, valid: true},
+		{spec: monthlyRecurrence, valid: true},
+		{spec: "0 9 * * 1-5", valid: true},
+		{spec: "*/15 0,12 1 */3 *", valid: true},
+		{spec: "yearly"},
+		{spec: "0 9 * *"},
+		{spec: "60 9 * * *"},
+		{spec: "0 9 0 * *"},
+		{spec: "0 9 * * 7"},
+		{spec: "0 9-5 * * *"},
+		{spec: "*/0 9 * * *"},
+		{spec: "a 9 * * *"},
+	}
+	for _, testCase := range testCases {
+		if _, err := parseRecurrence(testCase.spec, start); (err == nil) != testCase.valid {
+			t.Errorf("Unexpected result for %q: %v", testCase.spec, err)
+		}
+	}
+}
+
+func TestRecurrenceNext(t *testing.T) {
+	start := time.Date(2018, time.January, 31, 9, 0, 0, 0, time.UTC)
+	testCases := []struct {
+		spec  string
+		after time.Time
+		next  time.Time
+	}{
+		{spec: dailyRecurrence, after: start.Add(-time.Nanosecond), next: start},
+		{spec: dailyRecurrence, after: start, next: start.AddDate(0, 0, 1)},
+		{spec: weeklyRecurrence, after: start.Add(200 * time.Hour), next: start.AddDate(0, 0, 14)},
+		{spec: monthlyRecurrence, after: start, next: time.Date(2018, time.February, 28, 9, 0, 0, 0, time.UTC)},
+		{spec: monthlyRecurrence, after: time.Date(2018, time.March, 1, 0, 0, 0, 0, time.UTC), next: time.Date(2018, time.March, 31, 9, 0, 0, 0, time.UTC)},
+		{spec: monthlyRecurrence, after: time.Date(2018, time.March, 31, 9, 0, 0, 0, time.UTC), next: time.Date(2018, time.April, 30, 9, 0, 0, 0, time.UTC)},
+		// Saturday to Monday
+		{spec: "0 9 * * 1-5", after: time.Date(2018, time.February, 3, 10, 0, 0, 0, time.UTC), next: time.Date(2018, time.February, 5, 9, 0, 0, 0, time.UTC)},
+		{spec: "30 */6 * * *", after: time.Date(2018, time.February, 3, 6, 30, 0, 0, time.UTC), next: time.Date(2018, time.February, 3, 12, 30, 0, 0, time.UTC)},
+		{spec: "0 0 1 1 *", after: start, next: time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		// Either day field matches: 15th or Sunday
+		{spec: "0 0 15 * 0", after: start, next: time.Date(2018, time.February, 4, 0, 0, 0, 0, time.UTC)},
+		{spec: "0 0 30 2 *", after: start},
+	}
+	for _, testCase := range testCases {
+		recurrence, err := parseRecurrence(testCase.spec, start)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if next := recurrence.Next(testCase.after); !next.Equal(testCase.next) {
+			t.Errorf("Next occurrence of %q after %s should be %s, was %s", testCase.spec, testCase.after, testCase.next, next)
+		}
+	}
+}
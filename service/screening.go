@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Screening decisions. Allowed payment is made right away, rejected one is
+// recorded as failed and payment for review is parked until it's reviewed.
+const (
+	screeningAllow  = "allow"
+	screeningReject = "reject"
+	screeningReview = "review"
+)
+
+// Screening rule types, see `ScreeningRule`
+const (
+	amountRule          = "amount"
+	newDestinationRule  = "new_destination"
+	rapidSuccessionRule = "rapid_succession"
+	roundAmountRule     = "round_amount"
+)
+
+// Screener decides whether payment may be made before it's made.
+// Destinations are accounts paid by payment: its destination account or
+// destination accounts of split payment, which has none itself.
+// Returns screening decision, error if payment can't be screened.
+type Screener interface {
+	Screen(db *gorm.DB, payment Payment, destinations []uint, at time.Time) (Screening, error)
+}
+
+// Screening is a screening decision on a transfer recorded for audit: total
+// Score of matched Rules (comma separated names) and Decision made by it.
+type Screening struct {
+	ID         uint      `gorm:"primary_key" json:"-"`
+	CreatedAt  time.Time `json:"at"`
+	TransferID uint      `json:"-" sql:"index"`
+	Decision   string    `json:"decision"`
+	Score      int       `json:"score"`
+	Rules      string    `json:"rules"`
+}
+
+// ScreeningRule adds Score to payments it matches. Rule of `amount` Type
+// matches payments in Currency of at least Amount, `round_amount` matches
+// payments in Currency which are multiples of Amount (e.g. "100.00"),
+// `new_destination` matches payments to accounts (any of split payment
+// destinations) the source account has never paid to before and
+// `rapid_succession` matches payments from accounts which have made at least
+// Count payments during the last Window (e.g. "10m").
+type ScreeningRule struct {
+	Name     string  `json:"name"`
+	Type     string  `json:"type"`
+	Score    int     `json:"score"`
+	Currency string  `json:"currency"`
+	Amount   Decimal `json:"amount"`
+	Count    int     `json:"count"`
+	Window   string  `json:"window"`
+
+	amount Amount
+	window time.Duration
+}
+
+// ScreeningRules is a `Screener` scoring payments by rules. Payment is
+// rejected if its score is at least RejectScore and is sent for review if
+// it's at least ReviewScore (zero score never counts).
+type ScreeningRules struct {
+	ReviewScore int             `json:"review_score"`
+	RejectScore int             `json:"reject_score"`
+	Rules       []ScreeningRule `json:"rules"`
+}
+
+// loadScreeningRules reads screening rules from JSON file, see `ScreeningRules`.
+// Returns error if file can't be read or rules are not valid.
+func loadScreeningRules(path string) (*ScreeningRules, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var rules ScreeningRules
+	if err := json.NewDecoder(file).Decode(&rules); err != nil {
+		return nil, fmt.Errorf("Malformed screening rules: %s", err)
+	}
+	if err := rules.prepare(); err != nil {
+		return nil, err
+	}
+	return &rules, nil
+}
+
+// prepare validates rules and parses their amounts and windows.
+// Returns error if any rule is not valid, nil otherwise.
+func (r *ScreeningRules) prepare() error {
+	if r.ReviewScore < 0 || r.RejectScore < 0 {
+		return errors.New("Screening scores can't be negative")
+	}
+	for i := range r.Rules {
+		if err := r.Rules[i].prepare(); err != nil {
+			return fmt.Errorf("Screening rule #%d: %s", i, err)
+		}
+	}
+	return nil
+}
+
+// prepare validates rule and parses its amount and window.
+// Returns error if rule is not valid, nil otherwise.
+func (r *ScreeningRule) prepare() (err error) {
+	if r.Name == "" {
+		return errors.New("Rule name can't be empty")
+	}
+	if strings.Contains(r.Name, ",") {
+		return errors.New("Rule name can't contain commas")
+	}
+	switch r.Type {
+	case amountRule, roundAmountRule:
+		if !supportedCurrency(r.Currency) {
+			return fmt.Errorf("Unsupported currency %q", r.Currency)
+		}
+		if !r.Amount.Positive() {
+			return errors.New("Amount should be positive")
+		}
+		r.amount, err = r.Amount.Amount(r.Currency)
+	case newDestinationRule:
+	case rapidSuccessionRule:
+		if r.Count <= 0 {
+			return errors.New("Count should be positive")
+		}
+		if r.window, err = time.ParseDuration(r.Window); err == nil && r.window <= 0 {
+			err = errors.New("Window should be positive")
+		}
+	default:
+		err = fmt.Errorf("Unknown rule type %q", r.Type)
+	}
+	return err
+}
+
+// Match checks whether rule matches payment to destinations (see `Screener`)
+// made at given time. Payment history is looked up in db.
+// Returns error if history can't be looked up.
+func (r ScreeningRule) Match(db *gorm.DB, payment Payment, destinations []uint, at time.Time) (bool, error) {
+	var count int
+	switch r.Type {
+	case amountRule:
+		return payment.Currency == r.Currency && payment.Amount >= r.amount, nil
+	case roundAmountRule:
+		return payment.Currency == r.Currency && payment.Amount%r.amount == 0, nil
+	case newDestinationRule:
+		// Incoming legs are looked up: split payments have a single outgoing
+		// leg without destination
+		for _, dest := range destinations {
+			if err := db.Model(&Payment{}).
+				Where("payments.account_id = ? AND payments.direction = ? AND payments.account_from_id = ? AND (payments.kind IS NULL OR payments.kind <> ?) AND "+postedSQL,
+					dest, incoming, payment.AccountFromID, feeKind).
+				Count(&count).Error; err != nil || count == 0 {
+				return err == nil, err
+			}
+		}
+		return false, nil
+	case rapidSuccessionRule:
+		err := db.Model(&Payment{}).
+			Where("payments.account_id = ? AND payments.direction = ? AND (payments.kind IS NULL OR payments.kind <> ?) AND "+postedSQL,
+				payment.AccountFromID, outgoing, feeKind).
+			Where("payments.created_at >= ?", at.Add(-r.window).UTC()).Count(&count).Error
+		return count >= r.Count, err
+	}
+	return false, fmt.Errorf("Unknown rule type %q", r.Type)
+}
+
+// Screen implements Screener interface: sums scores of rules payment matches
+// and decides by the total score.
+func (r *ScreeningRules) Screen(db *gorm.DB, payment Payment, destinations []uint, at time.Time) (Screening, error) {
+	res := Screening{Decision: screeningAllow}
+	var matched []string
+	for _, rule := range r.Rules {
+		ok, err := rule.Match(db, payment, destinations, at)
+		if err != nil {
+			return res, err
+		}
+		if ok {
+			res.Score += rule.Score
+			matched = append(matched, rule.Name)
+		}
+	}
+	res.Rules = strings.Join(matched, ",")
+
+	switch {
+	case res.Score <= 0:
+	case r.RejectScore > 0 && res.Score >= r.RejectScore:
+		res.Decision = screeningReject
+	case r.ReviewScore > 0 && res.Score >= r.ReviewScore:
+		res.Decision = screeningReview
+	}
+	return res, nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScreeningRulesPrepare(t *testing.T) {
+	testCases := []struct {
+		rule  ScreeningRule
+		valid bool
+	}{
+		{rule: ScreeningRule{Name: "large", Type: amountRule, Currency: "USD", Amount: "1000.00"}, valid: true},
+		{rule: ScreeningRule{Name: "round", Type: roundAmountRule, Currency: "JPY", Amount: "1000"}, valid: true},
+		{rule: ScreeningRule{Name: "new", Type: newDestinationRule}, valid: true},
+		{rule: ScreeningRule{Name: "rapid", Type: rapidSuccessionRule, Count: 3, Window: "10m"}, valid: true},
+		{rule: ScreeningRule{Type: newDestinationRule}},
+		{rule: ScreeningRule{Name: "a,b", Type: newDestinationRule}},
+		{rule: ScreeningRule{Name: "unknown", Type: "unknown"}},
+		{rule: ScreeningRule{Name: "large", Type: amountRule, Currency: "XXX", Amount: "1000.00"}},
+		{rule: ScreeningRule{Name: "large", Type: amountRule, Currency: "USD", Amount: "1000.001"}},
+		{rule: ScreeningRule{Name: "round", Type: roundAmountRule, Currency: "USD"}},
+		{rule: ScreeningRule{Name: "rapid", Type: rapidSuccessionRule, Window: "10m"}},
+		{rule: ScreeningRule{Name: "rapid", Type: rapidSuccessionRule, Count: 3, Window: "ten minutes"}},
+		{rule: ScreeningRule{Name: "rapid", Type: rapidSuccessionRule, Count: 3, Window: "-10m"}},
+	}
+	for _, testCase := range testCases {
+		rules := ScreeningRules{Rules: []ScreeningRule{testCase.rule}}
+		if err := rules.prepare(); (err == nil) != testCase.valid {
+			t.Errorf("Unexpected result for %+v: %v", testCase.rule, err)
+		}
+	}
+}
+
+func TestScreeningRulesScreen(t *testing.T) {
+	rules := ScreeningRules{
+		ReviewScore: 50,
+		RejectScore: 100,
+		Rules: []ScreeningRule{
+			{Name: "large", Type: amountRule, Currency: "USD", Amount: "1000.00", Score: 60},
+			{Name: "huge", Type: amountRule, Currency: "USD", Amount: "5000.00", Score: 40},
+			{Name: "round", Type: roundAmountRule, Currency: "USD", Amount: "100.00", Score: 10},
+		},
+	}
+	if err := rules.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		payment  Payment
+		decision string
+		score    int
+		matched  string
+	}{
+		{payment: Payment{Amount: 99999, Currency: "USD"}, decision: screeningAllow},
+		{payment: Payment{Amount: 10000, Currency: "USD"}, decision: screeningAllow, score: 10, matched: "round"},
+		{payment: Payment{Amount: 100001, Currency: "USD"}, decision: screeningReview, score: 60, matched: "large"},
+		{payment: Payment{Amount: 100000, Currency: "USD"}, decision: screeningReview, score: 70, matched: "large,round"},
+		{payment: Payment{Amount: 500000, Currency: "USD"}, decision: screeningReject, score: 110, matched: "large,huge,round"},
+		{payment: Payment{Amount: 500000, Currency: "EUR"}, decision: screeningAllow},
+	}
+	for _, testCase := range testCases {
+		// Amount rules don't look up payment history
+		screening, err := rules.Screen(nil, testCase.payment, nil, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if screening.Decision != testCase.decision || screening.Score != testCase.score || screening.Rules != testCase.matched {
+			t.Errorf("Unexpected screening %+v of %s", screening, testCase.payment)
+		}
+	}
+}